@@ -0,0 +1,238 @@
+package accesslog
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/natk64/pancake-proxy/auth"
+	"github.com/natk64/pancake-proxy/payload"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"google.golang.org/grpc/codes"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Formats of the access log, see [Config.Format].
+const (
+	FormatJSON = "json"
+	FormatText = "text"
+)
+
+// Outputs that don't refer to a file, see [Config.Output].
+const (
+	OutputStdout = "stdout"
+	OutputStderr = "stderr"
+)
+
+// DefaultTemplate is the template used for the text format if none is configured.
+const DefaultTemplate = `{{.Time.Format "2006-01-02T15:04:05.000Z07:00"}} {{.Peer}} "{{.Method}}" {{.Code}} {{.Duration}}` +
+	` upstream={{.Upstream}} provider={{.Provider}} in={{.BytesReceived}}B/{{.MessagesReceived}} out={{.BytesSent}}B/{{.MessagesSent}}` +
+	` client="{{.Client}}" user_agent="{{.UserAgent}}"`
+
+// Config configures a [Logger].
+type Config struct {
+	// Format is either 'json' or 'text'. The default is 'json'.
+	Format string `mapstructure:"format"`
+
+	// Template is a text/template executed with an [Entry] for every line of the text format.
+	// The default is [DefaultTemplate].
+	Template string `mapstructure:"template"`
+
+	// Output is 'stdout', 'stderr' or the path of a file. The default is 'stdout'.
+	Output string `mapstructure:"output"`
+
+	// MaxSize is the size in megabytes at which the file is rotated. The default is 100.
+	MaxSize int `mapstructure:"max_size"`
+
+	// MaxBackups is the number of rotated files that are kept, all if 0.
+	MaxBackups int `mapstructure:"max_backups"`
+
+	// MaxAge is the number of days rotated files are kept, forever if 0.
+	MaxAge int `mapstructure:"max_age"`
+
+	// Compress compresses rotated files using gzip.
+	Compress bool `mapstructure:"compress"`
+
+	// SampleRatio is the fraction of successful calls that are logged, failed calls are always logged.
+	// With 0, only failed calls are logged. The default is 1.
+	SampleRatio *float64 `mapstructure:"sample_ratio"`
+
+	// Exclude lists methods that aren't logged, see [auth.MatchMethod] for the syntax.
+	Exclude []string `mapstructure:"exclude"`
+
+	// Payloads configures the logging of messages, see [PayloadConfig].
+	Payloads PayloadConfig `mapstructure:"payloads"`
+
+	Logger *zap.Logger `mapstructure:"-"`
+}
+
+// Entry describes a single call.
+type Entry struct {
+	Time time.Time
+
+	// Peer is the address of the client.
+	Peer string
+
+	// Client is the name of the authenticated client, if any.
+	Client string
+
+	// Protocol is the protocol used by the client, e.g. 'grpc' or 'grpc_web'.
+	Protocol string
+
+	// Method is the full method name like '/package.Service/Method'.
+	Method string
+
+	// Upstream and Provider describe the server the call was forwarded to, if any.
+	Upstream string
+	Provider string
+
+	Code     codes.Code
+	Duration time.Duration
+
+	// BytesReceived and MessagesReceived count the data received from the client.
+	BytesReceived    int64
+	MessagesReceived int64
+
+	// BytesSent and MessagesSent count the data sent to the client.
+	BytesSent    int64
+	MessagesSent int64
+
+	UserAgent string
+
+	// Requests and Responses contain the messages as JSON, if payloads are logged for the method.
+	Requests  []string
+	Responses []string
+}
+
+// Logger writes access logs.
+//
+// Logger must be created using [New].
+type Logger struct {
+	config  Config
+	decoder *payload.Decoder
+
+	// json is used for the JSON format.
+	json *zap.Logger
+
+	// template and output are used for the text format.
+	template *template.Template
+	output   io.Writer
+	mutex    *sync.Mutex
+}
+
+// New creates a logger writing to the configured output.
+func New(config Config) (*Logger, error) {
+	if config.Logger == nil {
+		config.Logger = zap.NewNop()
+	}
+	if config.SampleRatio == nil {
+		sampleRatio := 1.0
+		config.SampleRatio = &sampleRatio
+	}
+	if *config.SampleRatio < 0 || *config.SampleRatio > 1 {
+		return nil, fmt.Errorf("the sample ratio must be between 0 and 1")
+	}
+	if config.Payloads.MaxMessages <= 0 {
+		config.Payloads.MaxMessages = 10
+	}
+	decoder, err := payload.NewDecoder(config.Payloads.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	var output io.Writer
+	switch config.Output {
+	case "", OutputStdout:
+		output = os.Stdout
+	case OutputStderr:
+		output = os.Stderr
+	default:
+		output = &lumberjack.Logger{
+			Filename:   config.Output,
+			MaxSize:    config.MaxSize,
+			MaxBackups: config.MaxBackups,
+			MaxAge:     config.MaxAge,
+			Compress:   config.Compress,
+		}
+	}
+
+	l := &Logger{config: config, decoder: decoder}
+	switch config.Format {
+	case "", FormatJSON:
+		// The time is logged as a field, since it's the start of the call.
+		encoderConfig := zapcore.EncoderConfig{
+			LineEnding:     zapcore.DefaultLineEnding,
+			EncodeTime:     zapcore.ISO8601TimeEncoder,
+			EncodeDuration: zapcore.SecondsDurationEncoder,
+		}
+		l.json = zap.New(zapcore.NewCore(zapcore.NewJSONEncoder(encoderConfig), zapcore.AddSync(output), zapcore.InfoLevel))
+	case FormatText:
+		text := config.Template
+		if text == "" {
+			text = DefaultTemplate
+		}
+
+		if l.template, err = template.New("access_log").Parse(text); err != nil {
+			return nil, fmt.Errorf("invalid access log template, %w", err)
+		}
+		l.output = output
+		l.mutex = &sync.Mutex{}
+	default:
+		return nil, fmt.Errorf("unknown access log format '%s'", config.Format)
+	}
+
+	return l, nil
+}
+
+// Log writes an entry, unless its method is excluded or it isn't sampled.
+func (l *Logger) Log(entry Entry) {
+	if auth.MatchAnyMethod(l.config.Exclude, entry.Method) {
+		return
+	}
+	if entry.Code == codes.OK && *l.config.SampleRatio < 1 && rand.Float64() >= *l.config.SampleRatio {
+		return
+	}
+
+	if l.json != nil {
+		fields := []zap.Field{
+			zap.Time("time", entry.Time),
+			zap.String("peer", entry.Peer),
+			zap.String("client", entry.Client),
+			zap.String("protocol", entry.Protocol),
+			zap.String("method", entry.Method),
+			zap.String("upstream", entry.Upstream),
+			zap.String("provider", entry.Provider),
+			zap.String("code", entry.Code.String()),
+			zap.Duration("duration", entry.Duration),
+			zap.Int64("bytes_received", entry.BytesReceived),
+			zap.Int64("bytes_sent", entry.BytesSent),
+			zap.Int64("messages_received", entry.MessagesReceived),
+			zap.Int64("messages_sent", entry.MessagesSent),
+			zap.String("user_agent", entry.UserAgent),
+		}
+		if entry.Requests != nil || entry.Responses != nil {
+			fields = append(fields, zap.Strings("requests", entry.Requests), zap.Strings("responses", entry.Responses))
+		}
+		l.json.Info("", fields...)
+		return
+	}
+
+	var line bytes.Buffer
+	if err := l.template.Execute(&line, entry); err != nil {
+		l.config.Logger.Error("Failed to execute access log template", zap.Error(err))
+		return
+	}
+	line.WriteByte('\n')
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if _, err := l.output.Write(line.Bytes()); err != nil {
+		l.config.Logger.Error("Failed to write access log", zap.Error(err))
+	}
+}
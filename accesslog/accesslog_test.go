@@ -0,0 +1,88 @@
+package accesslog
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+)
+
+// newTestLogger creates a logger writing the method and code of every call to a file.
+func newTestLogger(t *testing.T, config Config) (*Logger, func() []string) {
+	t.Helper()
+
+	config.Format = FormatText
+	config.Template = "{{.Method}} {{.Code}}"
+	config.Output = filepath.Join(t.TempDir(), "access.log")
+	l, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := func() []string {
+		data, err := os.ReadFile(config.Output)
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		if len(data) == 0 {
+			return nil
+		}
+		return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	}
+	return l, lines
+}
+
+func TestLogSampleRatio(t *testing.T) {
+	// Without a sample ratio, every call is logged.
+	l, lines := newTestLogger(t, Config{})
+	for range 10 {
+		l.Log(Entry{Method: "/test.Service/Get", Code: codes.OK})
+	}
+	if n := len(lines()); n != 10 {
+		t.Errorf("expected 10 lines without a sample ratio, got %d", n)
+	}
+
+	// A ratio of 0 only logs failed calls.
+	sampleRatio := 0.0
+	l, lines = newTestLogger(t, Config{SampleRatio: &sampleRatio})
+	for range 10 {
+		l.Log(Entry{Method: "/test.Service/Get", Code: codes.OK})
+	}
+	l.Log(Entry{Method: "/test.Service/Get", Code: codes.Internal})
+	if got := lines(); len(got) != 1 || got[0] != "/test.Service/Get Internal" {
+		t.Errorf("expected only the failed call with a sample ratio of 0, got %v", got)
+	}
+
+	// Other ratios log roughly that fraction of the successful calls.
+	sampleRatio = 0.5
+	l, lines = newTestLogger(t, Config{SampleRatio: &sampleRatio})
+	for range 1000 {
+		l.Log(Entry{Method: "/test.Service/Get", Code: codes.OK})
+	}
+	if n := len(lines()); n < 400 || n > 600 {
+		t.Errorf("expected about 500 of 1000 calls to be logged, got %d", n)
+	}
+}
+
+func TestLogExclude(t *testing.T) {
+	l, lines := newTestLogger(t, Config{Exclude: []string{"grpc.health.v1.Health", "/test.Service/Ping"}})
+	l.Log(Entry{Method: "/grpc.health.v1.Health/Check", Code: codes.OK})
+	l.Log(Entry{Method: "/test.Service/Ping", Code: codes.Unavailable})
+	l.Log(Entry{Method: "/test.Service/Get", Code: codes.OK})
+
+	if got := lines(); len(got) != 1 || got[0] != "/test.Service/Get OK" {
+		t.Errorf("expected only the call that isn't excluded, got %v", got)
+	}
+}
+
+func TestNewConfig(t *testing.T) {
+	sampleRatio := 1.5
+	if _, err := New(Config{SampleRatio: &sampleRatio}); err == nil {
+		t.Error("expected an error for a sample ratio above 1")
+	}
+	if _, err := New(Config{Format: "xml"}); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+}
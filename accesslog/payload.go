@@ -0,0 +1,35 @@
+package accesslog
+
+import (
+	"github.com/natk64/pancake-proxy/auth"
+	"github.com/natk64/pancake-proxy/payload"
+	"github.com/natk64/pancake-proxy/reflection"
+)
+
+// PayloadConfig configures the logging of request and response messages.
+type PayloadConfig struct {
+	// Methods lists the methods whose messages are logged, see [auth.MatchMethod] for the syntax.
+	// Payloads aren't logged if empty.
+	Methods []string `mapstructure:"methods"`
+
+	// Redaction and truncation of the messages, see [payload.Config].
+	payload.Config `mapstructure:",squash"`
+
+	// MaxMessages is the maximum number of messages logged per direction of a call. The default is 10.
+	MaxMessages int `mapstructure:"max_messages"`
+}
+
+// CapturesPayloads reports whether the messages of a method should be captured for the access log.
+func (l *Logger) CapturesPayloads(method string) bool {
+	return auth.MatchAnyMethod(l.config.Payloads.Methods, method) && !auth.MatchAnyMethod(l.config.Exclude, method)
+}
+
+// MaxPayloadMessages returns the maximum number of messages logged per direction of a call.
+func (l *Logger) MaxPayloadMessages() int {
+	return l.config.Payloads.MaxMessages
+}
+
+// DecodePayload converts a binary message of a method to redacted JSON, see [payload.Decoder.Decode].
+func (l *Logger) DecodePayload(resolver reflection.FileExtensionResolver, method string, request bool, data []byte) string {
+	return l.decoder.Decode(resolver, method, request, data)
+}
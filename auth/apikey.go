@@ -0,0 +1,216 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gopkg.in/yaml.v3"
+)
+
+// APIKeyConfig configures an [APIKeyAuthenticator].
+type APIKeyConfig struct {
+	// File is the path of the key file, see [APIKeyFile].
+	File string `mapstructure:"file"`
+
+	// Env is the name of an environment variable containing the key file, used if File is empty.
+	Env string `mapstructure:"env"`
+
+	// Header is the metadata key containing the API key.
+	Header string `mapstructure:"header"`
+
+	// ClientHeader is the header used to forward the client name to the upstream servers.
+	ClientHeader string `mapstructure:"client_header"`
+
+	// Required rejects requests without an API key.
+	Required bool `mapstructure:"required"`
+
+	Logger *zap.Logger `mapstructure:"-"`
+}
+
+// APIKeyFile is the content of a key file.
+type APIKeyFile struct {
+	Keys []APIKey `yaml:"keys"`
+}
+
+// APIKey describes a single API key.
+type APIKey struct {
+	// Client is the name of the client using the key.
+	Client string `yaml:"client"`
+
+	// Hash is the salted hash of the key in the format '<salt>:<hash>', see [HashAPIKey].
+	Hash string `yaml:"hash"`
+
+	// Services lists the services or methods the key can be used for, see [MatchMethod] for the syntax.
+	// All services are allowed if empty.
+	Services []string `yaml:"services"`
+
+	// RateLimit limits the requests per second using the key, unlimited if 0.
+	RateLimit float64 `yaml:"rate_limit"`
+
+	// Burst is the number of requests allowed to exceed the rate limit at once, the default is the rate limit rounded up.
+	Burst int `yaml:"burst"`
+}
+
+// HashAPIKey returns the hash of a key in the format used by [APIKey.Hash],
+// which is the salt and the hex encoded SHA-256 hash of the salt followed by the key.
+func HashAPIKey(salt, key string) string {
+	hash := sha256.Sum256([]byte(salt + key))
+	return salt + ":" + hex.EncodeToString(hash[:])
+}
+
+type apiKeyEntry struct {
+	APIKey
+	salt    string
+	hash    []byte
+	limiter *rate.Limiter
+}
+
+type apiKeyClientKey struct{}
+
+// APIKeyClientFromContext returns the client name of the API key used for a request.
+func APIKeyClientFromContext(ctx context.Context) (string, bool) {
+	client, ok := ctx.Value(apiKeyClientKey{}).(string)
+	return client, ok
+}
+
+// APIKeyAuthenticator authenticates clients using API keys.
+//
+// APIKeyAuthenticator must be created using [NewAPIKeyAuthenticator].
+type APIKeyAuthenticator struct {
+	config APIKeyConfig
+	keys   []*apiKeyEntry
+	logger *zap.Logger
+}
+
+// NewAPIKeyAuthenticator creates an authenticator and loads the keys.
+func NewAPIKeyAuthenticator(config APIKeyConfig) (*APIKeyAuthenticator, error) {
+	if config.Logger == nil {
+		config.Logger = zap.NewNop()
+	}
+	if config.Header == "" {
+		config.Header = "X-Api-Key"
+	}
+	if config.ClientHeader == "" {
+		config.ClientHeader = "X-Client-Name"
+	}
+
+	var data []byte
+	switch {
+	case config.File != "":
+		var err error
+		if data, err = os.ReadFile(config.File); err != nil {
+			return nil, err
+		}
+	case config.Env != "":
+		data = []byte(os.Getenv(config.Env))
+	default:
+		return nil, fmt.Errorf("either a key file or an environment variable is required")
+	}
+
+	var file APIKeyFile
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&file); err != nil {
+		return nil, fmt.Errorf("invalid API key file, %w", err)
+	}
+
+	a := &APIKeyAuthenticator{config: config, logger: config.Logger}
+	for _, key := range file.Keys {
+		entry, err := newAPIKeyEntry(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid API key of client '%s', %w", key.Client, err)
+		}
+		a.keys = append(a.keys, entry)
+	}
+
+	a.logger.Info("Loaded API keys", zap.Int("keys", len(a.keys)))
+	return a, nil
+}
+
+func newAPIKeyEntry(key APIKey) (*apiKeyEntry, error) {
+	if key.Client == "" {
+		return nil, fmt.Errorf("missing client name")
+	}
+
+	salt, encodedHash, ok := strings.Cut(key.Hash, ":")
+	if !ok {
+		return nil, fmt.Errorf("hash must have the format '<salt>:<hash>'")
+	}
+
+	hash, err := hex.DecodeString(encodedHash)
+	if err != nil || len(hash) != sha256.Size {
+		return nil, fmt.Errorf("hash must be a hex encoded SHA-256 hash")
+	}
+
+	entry := &apiKeyEntry{APIKey: key, salt: salt, hash: hash}
+	if key.RateLimit > 0 {
+		burst := key.Burst
+		if burst <= 0 {
+			burst = int(math.Ceil(key.RateLimit))
+		}
+		entry.limiter = rate.NewLimiter(rate.Limit(key.RateLimit), burst)
+	}
+
+	return entry, nil
+}
+
+// Authenticate checks the API key of a request to the specified method.
+// Requests with an unknown key are always rejected, requests without a key only if a key is required.
+//
+// On success, the returned request contains the client name as a header and in its context, see [APIKeyClientFromContext].
+// The API key itself is removed from the request. Otherwise, the returned error is a gRPC status error.
+func (a *APIKeyAuthenticator) Authenticate(r *http.Request, method string) (*http.Request, error) {
+	key := r.Header.Get(a.config.Header)
+
+	// The key is not forwarded and clients must not be able to set the client name themselves.
+	r = r.Clone(r.Context())
+	r.Header.Del(a.config.Header)
+	r.Header.Del(a.config.ClientHeader)
+
+	if key == "" {
+		if a.config.Required {
+			return nil, status.Error(codes.Unauthenticated, "missing API key")
+		}
+		return r, nil
+	}
+
+	entry := a.find(key)
+	if entry == nil {
+		a.logger.Debug("Rejected unknown API key", zap.String("method", method))
+		return nil, status.Error(codes.Unauthenticated, "invalid API key")
+	}
+
+	if len(entry.Services) != 0 && !MatchAnyMethod(entry.Services, method) {
+		a.logger.Debug("Rejected API key for method", zap.String("client", entry.Client), zap.String("method", method))
+		return nil, status.Errorf(codes.PermissionDenied, "API key is not allowed to call %s", method)
+	}
+
+	if entry.limiter != nil && !entry.limiter.Allow() {
+		return nil, status.Error(codes.ResourceExhausted, "API key rate limit exceeded")
+	}
+
+	r.Header.Set(a.config.ClientHeader, entry.Client)
+	return r.WithContext(context.WithValue(r.Context(), apiKeyClientKey{}, entry.Client)), nil
+}
+
+func (a *APIKeyAuthenticator) find(key string) *apiKeyEntry {
+	for _, entry := range a.keys {
+		hash := sha256.Sum256([]byte(entry.salt + key))
+		if subtle.ConstantTimeCompare(hash[:], entry.hash) == 1 {
+			return entry
+		}
+	}
+	return nil
+}
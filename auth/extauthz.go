@@ -0,0 +1,431 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// maxCachedDecisions limits the size of the decision cache.
+const maxCachedDecisions = 10000
+
+// Headers that are never sent to the authorization service.
+var extAuthzIgnoredHeaders = []string{
+	"Accept-Encoding",
+	"Content-Length",
+	"Grpc-Accept-Encoding",
+	"Grpc-Timeout",
+	"Te",
+	"Trailer",
+}
+
+// ExtAuthzConfig configures an [ExtAuthorizer].
+type ExtAuthzConfig struct {
+	// GRPCAddress is the address of a gRPC service implementing envoy.service.auth.v3.Authorization.
+	GRPCAddress string `mapstructure:"grpc_address"`
+
+	// Plaintext disables TLS for the gRPC service.
+	Plaintext bool `mapstructure:"plaintext"`
+
+	// HTTPURL is the base URL of an HTTP authorization service, used if GRPCAddress is empty.
+	// The path of the request is appended to the URL and the headers are sent in a POST request without a body.
+	// A 2xx response allows the request, any other response denies it.
+	HTTPURL string `mapstructure:"http_url"`
+
+	// HTTPUpstreamHeaders lists headers of the HTTP authorization response that are added to allowed requests.
+	HTTPUpstreamHeaders []string `mapstructure:"http_upstream_headers"`
+
+	// Methods lists the methods that are checked, see [MatchMethod] for the syntax. All methods are checked if empty.
+	Methods []string `mapstructure:"methods"`
+
+	// IncludeHeaders lists the request headers sent to the authorization service. All headers are sent if empty.
+	IncludeHeaders []string `mapstructure:"include_headers"`
+
+	// Timeout limits the duration of a check. The default is 1s.
+	Timeout time.Duration `mapstructure:"timeout"`
+
+	// FailOpen allows requests if the authorization service fails, instead of rejecting them with UNAVAILABLE.
+	FailOpen bool `mapstructure:"fail_open"`
+
+	// CacheDuration specifies how long decisions are cached, decisions aren't cached if 0.
+	// Requests share a decision if the method, the sent headers and the peer are the same.
+	CacheDuration time.Duration `mapstructure:"cache_duration"`
+
+	Logger *zap.Logger `mapstructure:"-"`
+}
+
+// Peer describes the client of a request that is checked by an [ExtAuthorizer].
+type Peer struct {
+	// Address is the remote address of the client.
+	Address string
+
+	// Principal identifies the client, e.g. the SPIFFE ID or subject of its certificate.
+	Principal string
+}
+
+// extAuthzDecision is the result of a check.
+type extAuthzDecision struct {
+	allowed bool
+	status  *status.Status
+
+	// setHeaders and removeHeaders are applied to allowed requests.
+	setHeaders    []headerMutation
+	removeHeaders []string
+}
+
+type headerMutation struct {
+	key    string
+	value  string
+	action corev3.HeaderValueOption_HeaderAppendAction
+}
+
+type cachedDecision struct {
+	decision *extAuthzDecision
+	expires  time.Time
+}
+
+type extAuthzChecker interface {
+	check(ctx context.Context, r *http.Request, method string, headers http.Header, peer Peer) (*extAuthzDecision, error)
+}
+
+// ExtAuthorizer asks an external service whether requests are allowed, like Envoy's ext_authz filter.
+//
+// ExtAuthorizer must be created using [NewExtAuthorizer].
+type ExtAuthorizer struct {
+	config  ExtAuthzConfig
+	checker extAuthzChecker
+	logger  *zap.Logger
+
+	cacheMutex *sync.Mutex
+	cache      map[string]cachedDecision
+}
+
+// NewExtAuthorizer creates an authorizer using either the gRPC or the HTTP authorization service.
+func NewExtAuthorizer(config ExtAuthzConfig) (*ExtAuthorizer, error) {
+	if config.Logger == nil {
+		config.Logger = zap.NewNop()
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = time.Second
+	}
+
+	a := &ExtAuthorizer{
+		config:     config,
+		logger:     config.Logger,
+		cacheMutex: &sync.Mutex{},
+		cache:      make(map[string]cachedDecision),
+	}
+
+	switch {
+	case config.GRPCAddress != "":
+		creds := credentials.NewTLS(nil)
+		if config.Plaintext {
+			creds = insecure.NewCredentials()
+		}
+
+		conn, err := grpc.NewClient(config.GRPCAddress, grpc.WithTransportCredentials(creds))
+		if err != nil {
+			return nil, err
+		}
+		a.checker = &grpcAuthzChecker{client: authv3.NewAuthorizationClient(conn)}
+	case config.HTTPURL != "":
+		if _, err := url.Parse(config.HTTPURL); err != nil {
+			return nil, fmt.Errorf("invalid authorization service URL, %w", err)
+		}
+		a.checker = &httpAuthzChecker{url: strings.TrimSuffix(config.HTTPURL, "/"), upstreamHeaders: config.HTTPUpstreamHeaders}
+	default:
+		return nil, fmt.Errorf("either the gRPC address or the HTTP URL of the authorization service is required")
+	}
+
+	return a, nil
+}
+
+// Authorize checks whether the request to the specified method is allowed.
+// If it is, the headers of the request are modified as requested by the authorization service.
+// Otherwise, the returned error is a gRPC status error.
+func (a *ExtAuthorizer) Authorize(r *http.Request, method string, peer Peer) error {
+	if len(a.config.Methods) != 0 && !MatchAnyMethod(a.config.Methods, method) {
+		return nil
+	}
+
+	headers := a.checkedHeaders(r.Header)
+	cacheKey := decisionCacheKey(method, headers, peer)
+
+	decision, ok := a.cachedDecision(cacheKey)
+	if !ok {
+		ctx, cancel := context.WithTimeout(r.Context(), a.config.Timeout)
+		defer cancel()
+
+		var err error
+		decision, err = a.checker.check(ctx, r, method, headers, peer)
+		if err != nil {
+			if a.config.FailOpen {
+				a.logger.Warn("Authorization check failed, allowing request", zap.String("method", method), zap.Error(err))
+				return nil
+			}
+			a.logger.Warn("Authorization check failed, rejecting request", zap.String("method", method), zap.Error(err))
+			return status.Error(codes.Unavailable, "authorization service unavailable")
+		}
+
+		a.cacheDecision(cacheKey, decision)
+	}
+
+	if !decision.allowed {
+		return decision.status.Err()
+	}
+
+	for _, key := range decision.removeHeaders {
+		r.Header.Del(key)
+	}
+	for _, header := range decision.setHeaders {
+		applyHeaderMutation(r.Header, header)
+	}
+	return nil
+}
+
+func (a *ExtAuthorizer) checkedHeaders(header http.Header) http.Header {
+	checked := make(http.Header)
+	for key, values := range header {
+		if slices.Contains(extAuthzIgnoredHeaders, key) {
+			continue
+		}
+		if len(a.config.IncludeHeaders) != 0 && !slices.ContainsFunc(a.config.IncludeHeaders, func(h string) bool { return strings.EqualFold(h, key) }) {
+			continue
+		}
+		checked[key] = values
+	}
+	return checked
+}
+
+func decisionCacheKey(method string, headers http.Header, peer Peer) string {
+	hash := sha256.New()
+	host, _, err := net.SplitHostPort(peer.Address)
+	if err != nil {
+		host = peer.Address
+	}
+	fmt.Fprintf(hash, "%s\n%s\n%s\n", method, host, peer.Principal)
+	headers.Write(hash)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func (a *ExtAuthorizer) cachedDecision(key string) (*extAuthzDecision, bool) {
+	if a.config.CacheDuration <= 0 {
+		return nil, false
+	}
+
+	a.cacheMutex.Lock()
+	defer a.cacheMutex.Unlock()
+
+	cached, ok := a.cache[key]
+	if !ok || time.Now().After(cached.expires) {
+		return nil, false
+	}
+	return cached.decision, true
+}
+
+func (a *ExtAuthorizer) cacheDecision(key string, decision *extAuthzDecision) {
+	if a.config.CacheDuration <= 0 {
+		return
+	}
+
+	a.cacheMutex.Lock()
+	defer a.cacheMutex.Unlock()
+
+	now := time.Now()
+	if len(a.cache) >= maxCachedDecisions {
+		for key, cached := range a.cache {
+			if now.After(cached.expires) {
+				delete(a.cache, key)
+			}
+		}
+	}
+	if len(a.cache) >= maxCachedDecisions {
+		clear(a.cache)
+	}
+
+	a.cache[key] = cachedDecision{decision: decision, expires: now.Add(a.config.CacheDuration)}
+}
+
+func applyHeaderMutation(header http.Header, mutation headerMutation) {
+	_, exists := header[http.CanonicalHeaderKey(mutation.key)]
+	switch mutation.action {
+	case corev3.HeaderValueOption_ADD_IF_ABSENT:
+		if !exists {
+			header.Set(mutation.key, mutation.value)
+		}
+	case corev3.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD:
+		header.Set(mutation.key, mutation.value)
+	case corev3.HeaderValueOption_OVERWRITE_IF_EXISTS:
+		if exists {
+			header.Set(mutation.key, mutation.value)
+		}
+	default:
+		header.Add(mutation.key, mutation.value)
+	}
+}
+
+// grpcAuthzChecker uses the envoy.service.auth.v3.Authorization service.
+type grpcAuthzChecker struct {
+	client authv3.AuthorizationClient
+}
+
+func (c *grpcAuthzChecker) check(ctx context.Context, r *http.Request, method string, headers http.Header, peer Peer) (*extAuthzDecision, error) {
+	requestHeaders := make(map[string]string, len(headers))
+	for key, values := range headers {
+		requestHeaders[strings.ToLower(key)] = strings.Join(values, ",")
+	}
+
+	response, err := c.client.Check(ctx, &authv3.CheckRequest{
+		Attributes: &authv3.AttributeContext{
+			Source: &authv3.AttributeContext_Peer{
+				Address:   socketAddress(peer.Address),
+				Principal: peer.Principal,
+			},
+			Request: &authv3.AttributeContext_Request{
+				Http: &authv3.AttributeContext_HttpRequest{
+					Method:   r.Method,
+					Path:     method,
+					Host:     r.Host,
+					Protocol: r.Proto,
+					Headers:  requestHeaders,
+				},
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	code := codes.Code(response.GetStatus().GetCode())
+	if code != codes.OK {
+		return &extAuthzDecision{status: status.New(code, response.GetStatus().GetMessage())}, nil
+	}
+
+	decision := &extAuthzDecision{allowed: true}
+	if ok := response.GetOkResponse(); ok != nil {
+		decision.removeHeaders = ok.HeadersToRemove
+		for _, option := range ok.Headers {
+			mutation := headerMutation{
+				key:    option.GetHeader().GetKey(),
+				value:  option.GetHeader().GetValue(),
+				action: option.AppendAction,
+			}
+			if raw := option.GetHeader().GetRawValue(); len(raw) != 0 {
+				mutation.value = string(raw)
+			}
+
+			// The deprecated append field takes precedence, like in Envoy.
+			if option.Append != nil {
+				mutation.action = corev3.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD
+				if option.Append.Value {
+					mutation.action = corev3.HeaderValueOption_APPEND_IF_EXISTS_OR_ADD
+				}
+			}
+			decision.setHeaders = append(decision.setHeaders, mutation)
+		}
+	}
+	return decision, nil
+}
+
+func socketAddress(address string) *corev3.Address {
+	host, rawPort, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil
+	}
+	port, _ := strconv.ParseUint(rawPort, 10, 32)
+
+	return &corev3.Address{
+		Address: &corev3.Address_SocketAddress{
+			SocketAddress: &corev3.SocketAddress{
+				Address:       host,
+				PortSpecifier: &corev3.SocketAddress_PortValue{PortValue: uint32(port)},
+			},
+		},
+	}
+}
+
+// httpAuthzChecker sends the request headers to an HTTP service.
+type httpAuthzChecker struct {
+	url             string
+	upstreamHeaders []string
+}
+
+func (c *httpAuthzChecker) check(ctx context.Context, r *http.Request, method string, headers http.Header, peer Peer) (*extAuthzDecision, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url+method, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	request.Header = headers.Clone()
+	if host, _, err := net.SplitHostPort(peer.Address); err == nil {
+		request.Header.Set("X-Forwarded-For", host)
+	}
+	if peer.Principal != "" {
+		request.Header.Set("X-Forwarded-Client-Principal", peer.Principal)
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return &extAuthzDecision{status: deniedHTTPStatus(response)}, nil
+	}
+
+	decision := &extAuthzDecision{allowed: true}
+	for _, key := range c.upstreamHeaders {
+		// The first value replaces the header of the request, the others are appended to it.
+		action := corev3.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD
+		for _, value := range response.Header.Values(key) {
+			decision.setHeaders = append(decision.setHeaders, headerMutation{key: key, value: value, action: action})
+			action = corev3.HeaderValueOption_APPEND_IF_EXISTS_OR_ADD
+		}
+	}
+	return decision, nil
+}
+
+// deniedHTTPStatus returns the status of a denied request.
+// The service can specify the status using the grpc-status and grpc-message headers,
+// otherwise it's derived from the HTTP status and the body is used as the message.
+func deniedHTTPStatus(response *http.Response) *status.Status {
+	if rawCode := response.Header.Get("Grpc-Status"); rawCode != "" {
+		if code, err := strconv.Atoi(rawCode); err == nil && code != int(codes.OK) {
+			return status.New(codes.Code(code), response.Header.Get("Grpc-Message"))
+		}
+	}
+
+	code := codes.PermissionDenied
+	switch response.StatusCode {
+	case http.StatusUnauthorized:
+		code = codes.Unauthenticated
+	case http.StatusTooManyRequests:
+		code = codes.ResourceExhausted
+	}
+
+	message, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+	if len(message) == 0 {
+		message = []byte(http.StatusText(response.StatusCode))
+	}
+	return status.New(code, strings.TrimSpace(string(message)))
+}
@@ -0,0 +1,320 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// minRefreshInterval limits how often the keys are fetched because of unknown key ids.
+	minRefreshInterval = time.Second * 10
+
+	defaultCacheDuration = time.Minute * 5
+
+	// defaultFetchTimeout limits how long fetching the keys from the URL may take.
+	defaultFetchTimeout = time.Second * 10
+)
+
+// KeySet provides the public keys of a JSON Web Key Set, loaded from a file or a URL.
+// The keys are cached and loaded again once the cache duration has passed,
+// or when a token references a key id that isn't known yet.
+//
+// KeySet must be created using [NewKeySet].
+type KeySet struct {
+	file          string
+	url           string
+	cacheDuration time.Duration
+	fetchTimeout  time.Duration
+	client        *http.Client
+	logger        *zap.Logger
+
+	// refreshing is set while expired keys are loaded in the background.
+	refreshing *atomic.Bool
+
+	mutex    *sync.RWMutex
+	keys     map[string]any
+	loadedAt time.Time
+
+	loadMutex  *sync.Mutex
+	lastLoaded time.Time
+}
+
+// NewKeySet creates a key set loading the keys from either file or url.
+// If client is nil, [http.DefaultClient] is used. Fetching the keys times out after 10 seconds.
+// The keys are cached for 5 minutes if cacheDuration is 0, and until a token uses an unknown key if it's negative.
+//
+// The keys are loaded immediately. If that fails, loading is retried when the keys are needed.
+func NewKeySet(file, url string, cacheDuration time.Duration, client *http.Client, logger *zap.Logger) (*KeySet, error) {
+	if (file == "") == (url == "") {
+		return nil, fmt.Errorf("exactly one of the JWKS file and URL must be specified")
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	if cacheDuration == 0 {
+		cacheDuration = defaultCacheDuration
+	}
+
+	k := &KeySet{
+		file:          file,
+		url:           url,
+		cacheDuration: cacheDuration,
+		fetchTimeout:  defaultFetchTimeout,
+		client:        client,
+		logger:        logger,
+		refreshing:    &atomic.Bool{},
+		mutex:         &sync.RWMutex{},
+		loadMutex:     &sync.Mutex{},
+	}
+
+	if err := k.load(); err != nil {
+		logger.Warn("Failed to load JWKS, retrying when a token is verified", zap.Error(err))
+	}
+	return k, nil
+}
+
+// Key returns the key with the specified id.
+// If the id is empty, the key is only returned if the set contains a single key.
+func (k *KeySet) Key(id string) (any, error) {
+	keys, loadedAt := k.current()
+	expired := keys != nil && k.cacheDuration > 0 && time.Since(loadedAt) > k.cacheDuration
+	if expired && k.refreshing.CompareAndSwap(false, true) {
+		// Keep using the current keys while the new ones are loaded, only one refresh runs at a time.
+		go func() {
+			defer k.refreshing.Store(false)
+			if err := k.loadIfStale(); err != nil {
+				k.logger.Warn("Failed to refresh JWKS, keeping the previous keys", zap.Error(err))
+			}
+		}()
+	}
+
+	if key, ok := lookupKey(keys, id); ok {
+		return key, nil
+	}
+
+	// The key might have been rotated, or the keys couldn't be loaded before.
+	if err := k.loadIfStale(); err != nil {
+		k.logger.Warn("Failed to load JWKS", zap.Error(err))
+		return nil, fmt.Errorf("failed to load JWKS, %w", err)
+	}
+
+	keys, _ = k.current()
+	if key, ok := lookupKey(keys, id); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key id '%s'", id)
+}
+
+func lookupKey(keys map[string]any, id string) (any, bool) {
+	if id == "" && len(keys) == 1 {
+		for _, key := range keys {
+			return key, true
+		}
+	}
+
+	key, ok := keys[id]
+	return key, ok
+}
+
+func (k *KeySet) current() (map[string]any, time.Time) {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	return k.keys, k.loadedAt
+}
+
+// loadIfStale loads the keys, unless they were already loaded within [minRefreshInterval].
+func (k *KeySet) loadIfStale() error {
+	k.loadMutex.Lock()
+	defer k.loadMutex.Unlock()
+
+	if time.Since(k.lastLoaded) < minRefreshInterval {
+		return nil
+	}
+	return k.loadLocked()
+}
+
+// load loads the keys and replaces the current ones.
+// If loading fails, the current keys are kept.
+func (k *KeySet) load() error {
+	k.loadMutex.Lock()
+	defer k.loadMutex.Unlock()
+	return k.loadLocked()
+}
+
+func (k *KeySet) loadLocked() error {
+	k.lastLoaded = time.Now()
+	keys, err := k.fetch()
+	if err != nil {
+		return err
+	}
+
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.keys = keys
+	k.loadedAt = time.Now()
+	k.logger.Debug("Loaded JWKS", zap.Int("keys", len(keys)))
+	return nil
+}
+
+func (k *KeySet) fetch() (map[string]any, error) {
+	if k.file != "" {
+		data, err := os.ReadFile(k.file)
+		if err != nil {
+			return nil, err
+		}
+		return ParseKeySet(data)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), k.fetchTimeout)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, k.url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := k.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", response.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(response.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	return ParseKeySet(data)
+}
+
+type jsonWebKey struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	Use     string `json:"use"`
+	Curve   string `json:"crv"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+	X       string `json:"x"`
+	Y       string `json:"y"`
+}
+
+// ParseKeySet parses a JSON Web Key Set and returns the public keys by their key id.
+// Supported are RSA, EC (P-256, P-384, P-521) and Ed25519 keys, other keys and keys not used for signatures are ignored.
+func ParseKeySet(data []byte) (map[string]any, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("invalid JWKS, %w", err)
+	}
+
+	keys := make(map[string]any)
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		key, err := jwk.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("invalid key '%s', %w", jwk.KeyID, err)
+		}
+		if key != nil {
+			keys[jwk.KeyID] = key
+		}
+	}
+
+	return keys, nil
+}
+
+// publicKey returns the public key, or nil if the key type isn't supported.
+func (jwk jsonWebKey) publicKey() (any, error) {
+	switch jwk.KeyType {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() {
+			return nil, fmt.Errorf("exponent is too large")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, nil
+		}
+
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("point is not on curve %s", jwk.Curve)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+
+	case "OKP":
+		if jwk.Curve != "Ed25519" {
+			return nil, nil
+		}
+
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid key size")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+
+	return nil, nil
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, fmt.Errorf("missing value")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
@@ -0,0 +1,315 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func encodeBigInt(n *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(n.Bytes())
+}
+
+func rsaJWK(id string, key *rsa.PublicKey) jsonWebKey {
+	return jsonWebKey{KeyType: "RSA", KeyID: id, N: encodeBigInt(key.N), E: encodeBigInt(big.NewInt(int64(key.E)))}
+}
+
+func ecJWK(id string, key *ecdsa.PublicKey) jsonWebKey {
+	return jsonWebKey{KeyType: "EC", KeyID: id, Curve: key.Curve.Params().Name, X: encodeBigInt(key.X), Y: encodeBigInt(key.Y)}
+}
+
+// jwksServer serves a JWKS that can be replaced during a test.
+type jwksServer struct {
+	*httptest.Server
+
+	mutex    *sync.Mutex
+	keys     []jsonWebKey
+	failing  bool
+	stalled  bool
+	requests int
+}
+
+func startJWKSServer(t *testing.T, keys ...jsonWebKey) *jwksServer {
+	t.Helper()
+
+	s := &jwksServer{mutex: &sync.Mutex{}, keys: keys}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mutex.Lock()
+		s.requests++
+		if s.stalled {
+			// Stalled requests only end when the client gives up.
+			s.mutex.Unlock()
+			<-r.Context().Done()
+			return
+		}
+		defer s.mutex.Unlock()
+
+		if s.failing {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"keys": s.keys})
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *jwksServer) set(failing bool, keys ...jsonWebKey) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.failing = failing
+	s.keys = keys
+}
+
+func (s *jwksServer) stall() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.stalled = true
+}
+
+func (s *jwksServer) requestCount() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.requests
+}
+
+// allowRefresh lets the key set load the keys again, without waiting for the minimum refresh interval.
+func allowRefresh(k *KeySet) {
+	k.loadMutex.Lock()
+	defer k.loadMutex.Unlock()
+	k.lastLoaded = time.Time{}
+}
+
+func TestParseKeySet(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	edKey, _, _ := ed25519.GenerateKey(rand.Reader)
+
+	encryptionKey := rsaJWK("enc", &rsaKey.PublicKey)
+	encryptionKey.Use = "enc"
+	data, _ := json.Marshal(map[string]any{"keys": []jsonWebKey{
+		rsaJWK("rsa", &rsaKey.PublicKey),
+		ecJWK("ec", &ecKey.PublicKey),
+		{KeyType: "OKP", KeyID: "ed", Curve: "Ed25519", X: base64.RawURLEncoding.EncodeToString(edKey)},
+		{KeyType: "oct", KeyID: "symmetric"},
+		encryptionKey,
+	}})
+
+	keys, err := ParseKeySet(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 3 {
+		t.Fatalf("expected 3 keys, got %d", len(keys))
+	}
+	if key, ok := keys["rsa"].(*rsa.PublicKey); !ok || !key.Equal(&rsaKey.PublicKey) {
+		t.Error("RSA key wasn't parsed")
+	}
+	if key, ok := keys["ec"].(*ecdsa.PublicKey); !ok || !key.Equal(&ecKey.PublicKey) {
+		t.Error("EC key wasn't parsed")
+	}
+	if key, ok := keys["ed"].(ed25519.PublicKey); !ok || !key.Equal(edKey) {
+		t.Error("Ed25519 key wasn't parsed")
+	}
+
+	invalid := ecJWK("ec", &ecKey.PublicKey)
+	invalid.Y = encodeBigInt(big.NewInt(1))
+	data, _ = json.Marshal(map[string]any{"keys": []jsonWebKey{invalid}})
+	if _, err := ParseKeySet(data); err == nil {
+		t.Error("expected an error for a point that isn't on the curve")
+	}
+}
+
+func TestKeySetDefaults(t *testing.T) {
+	server := startJWKSServer(t)
+
+	keys, err := NewKeySet("", server.URL, 0, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys.cacheDuration != time.Minute*5 {
+		t.Errorf("expected the default cache duration of 5m, got %s", keys.cacheDuration)
+	}
+
+	if _, err := NewKeySet("", "", 0, nil, nil); err == nil {
+		t.Error("expected an error without a file and URL")
+	}
+}
+
+func TestKeySetRotation(t *testing.T) {
+	first, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	second, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	server := startJWKSServer(t, ecJWK("first", &first.PublicKey))
+
+	keys, err := NewKeySet("", server.URL, 0, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keys.Key("first"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unknown key ids don't load the keys again within the minimum refresh interval.
+	server.set(false, ecJWK("second", &second.PublicKey))
+	if _, err := keys.Key("second"); err == nil {
+		t.Error("expected the unknown key id to be rejected within the refresh interval")
+	}
+	if count := server.requestCount(); count != 1 {
+		t.Errorf("expected 1 request, got %d", count)
+	}
+
+	allowRefresh(keys)
+	key, err := keys.Key("second")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key.(*ecdsa.PublicKey).Equal(&second.PublicKey) {
+		t.Error("got the wrong key after the rotation")
+	}
+}
+
+func TestKeySetInitialFailure(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	server := startJWKSServer(t, ecJWK("key", &key.PublicKey))
+	server.set(true)
+
+	// Creating the key set succeeds, the keys are loaded when they're needed.
+	keys, err := NewKeySet("", server.URL, 0, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowRefresh(keys)
+	if _, err := keys.Key("key"); err == nil {
+		t.Error("expected an error while the JWKS server fails")
+	}
+
+	server.set(false, ecJWK("key", &key.PublicKey))
+	allowRefresh(keys)
+	if _, err := keys.Key("key"); err != nil {
+		t.Errorf("expected the key after the server recovered, got %v", err)
+	}
+
+	// Keys without an id can be used if the set contains a single key.
+	if _, err := keys.Key(""); err != nil {
+		t.Errorf("expected the only key for an empty key id, got %v", err)
+	}
+}
+
+func TestKeySetCacheExpiry(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	server := startJWKSServer(t, ecJWK("key", &key.PublicKey))
+
+	keys, err := NewKeySet("", server.URL, time.Millisecond, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Expired keys are still used while they're loaded again in the background.
+	time.Sleep(time.Millisecond * 5)
+	allowRefresh(keys)
+	if _, err := keys.Key("key"); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for server.requestCount() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("expired keys weren't loaded again")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestKeySetStalledServer(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	server := startJWKSServer(t, ecJWK("key", &key.PublicKey))
+
+	keys, err := NewKeySet("", server.URL, time.Millisecond, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys.fetchTimeout = time.Millisecond * 200
+	server.stall()
+
+	// Expired keys are refreshed by a single goroutine, no matter how many tokens are verified.
+	time.Sleep(time.Millisecond * 5)
+	allowRefresh(keys)
+	for range 50 {
+		if _, err := keys.Key("key"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(time.Millisecond * 50)
+	if count := server.requestCount(); count != 2 {
+		t.Errorf("expected a single refresh request, got %d requests", count)
+	}
+
+	// Unknown key ids fail once the request times out, instead of blocking.
+	allowRefresh(keys)
+	start := time.Now()
+	if _, err := keys.Key("other"); err == nil {
+		t.Error("expected an error while the JWKS server is stalled")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the request to time out after 200ms, took %s", elapsed)
+	}
+}
+
+func TestJWTAuthenticatorJWKS(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	server := startJWKSServer(t, ecJWK("key", &key.PublicKey))
+
+	authenticator, err := NewJWTAuthenticator(JWTConfig{
+		Issuers:       []string{"https://auth.example.com/"},
+		JWKSURL:       server.URL,
+		Required:      true,
+		ForwardClaims: []ForwardedClaim{{Claim: "sub", Header: "x-user"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"iss": "https://auth.example.com/",
+		"sub": "alice",
+		"exp": time.Now().Add(time.Minute).Unix(),
+	})
+	token.Header["kid"] = "key"
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/test.Service/Get", nil)
+	r.Header.Set("Authorization", "Bearer "+signed)
+	r.Header.Set("x-user", "mallory")
+	r, err = authenticator.Authenticate(r, "/test.Service/Get")
+	if err != nil {
+		t.Fatalf("expected the token to be accepted, got %v", err)
+	}
+	if user := r.Header.Values("x-user"); len(user) != 1 || user[0] != "alice" {
+		t.Errorf("expected the forwarded claim alice, got %v", user)
+	}
+
+	other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	signed, _ = token.SignedString(other)
+	r = httptest.NewRequest(http.MethodPost, "/test.Service/Get", nil)
+	r.Header.Set("Authorization", "Bearer "+signed)
+	if _, err := authenticator.Authenticate(r, "/test.Service/Get"); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected UNAUTHENTICATED for a token signed with another key, got %v", err)
+	}
+}
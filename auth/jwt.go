@@ -0,0 +1,205 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// jwtLeeway is the allowed clock skew when validating the time based claims.
+const jwtLeeway = time.Second * 30
+
+// JWTConfig configures a [JWTAuthenticator].
+type JWTConfig struct {
+	// Issuers lists the accepted issuers. Any issuer is accepted if empty.
+	Issuers []string `mapstructure:"issuers"`
+
+	// Audiences lists the accepted audiences, the token must contain at least one of them.
+	// Any audience is accepted if empty.
+	Audiences []string `mapstructure:"audiences"`
+
+	// JWKSFile and JWKSURL specify where the signing keys are loaded from, only one of them can be set.
+	JWKSFile string `mapstructure:"jwks_file"`
+	JWKSURL  string `mapstructure:"jwks_url"`
+
+	// JWKSCacheDuration specifies how long the keys are cached before they are loaded again. The default is 5m.
+	// The keys are cached forever if negative, but still loaded again if a token uses an unknown key.
+	JWKSCacheDuration time.Duration `mapstructure:"jwks_cache_duration"`
+
+	// Required specifies if methods not matched by any rule require a token.
+	Required bool `mapstructure:"required"`
+
+	// Rules specify which methods require a token. The first matching rule is used.
+	Rules []JWTRule `mapstructure:"rules"`
+
+	// ForwardClaims specifies claims that are sent to the upstream servers as headers.
+	ForwardClaims []ForwardedClaim `mapstructure:"forward_claims"`
+
+	// HTTPClient is used to fetch the keys, the default is [http.DefaultClient].
+	HTTPClient *http.Client `mapstructure:"-"`
+
+	Logger *zap.Logger `mapstructure:"-"`
+}
+
+// JWTRule specifies whether a set of methods requires a token.
+type JWTRule struct {
+	// Methods lists the methods the rule applies to, see [MatchMethod] for the syntax.
+	Methods  []string `mapstructure:"methods"`
+	Required bool     `mapstructure:"required"`
+}
+
+// ForwardedClaim specifies a claim that is sent to the upstream servers as a header.
+// Strings are sent as they are, arrays as one value per element and other values encoded as JSON.
+type ForwardedClaim struct {
+	Claim  string `mapstructure:"claim"`
+	Header string `mapstructure:"header"`
+}
+
+type jwtClaimsKey struct{}
+
+// JWTClaimsFromContext returns the claims of the validated token of a request.
+func JWTClaimsFromContext(ctx context.Context) (jwt.MapClaims, bool) {
+	claims, ok := ctx.Value(jwtClaimsKey{}).(jwt.MapClaims)
+	return claims, ok
+}
+
+// JWTAuthenticator validates bearer tokens sent in the authorization header.
+//
+// JWTAuthenticator must be created using [NewJWTAuthenticator].
+type JWTAuthenticator struct {
+	config JWTConfig
+	keys   *KeySet
+	parser *jwt.Parser
+	logger *zap.Logger
+}
+
+// NewJWTAuthenticator creates an authenticator and loads the signing keys.
+func NewJWTAuthenticator(config JWTConfig) (*JWTAuthenticator, error) {
+	if config.Logger == nil {
+		config.Logger = zap.NewNop()
+	}
+
+	for _, claim := range config.ForwardClaims {
+		if claim.Claim == "" || claim.Header == "" {
+			return nil, fmt.Errorf("forwarded claims require a claim and a header")
+		}
+	}
+
+	keys, err := NewKeySet(config.JWKSFile, config.JWKSURL, config.JWKSCacheDuration, config.HTTPClient, config.Logger)
+	if err != nil {
+		return nil, err
+	}
+
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}),
+		jwt.WithLeeway(jwtLeeway),
+		jwt.WithExpirationRequired(),
+	}
+	if len(config.Audiences) != 0 {
+		options = append(options, jwt.WithAudience(config.Audiences...))
+	}
+
+	return &JWTAuthenticator{
+		config: config,
+		keys:   keys,
+		parser: jwt.NewParser(options...),
+		logger: config.Logger,
+	}, nil
+}
+
+// Authenticate validates the token of a request to the specified method.
+// Requests with an invalid token are always rejected, requests without a token only if a token is required for the method.
+//
+// On success, the returned request contains the forwarded claims as headers and the claims in its context, see [JWTClaimsFromContext].
+// Otherwise, the returned error is a gRPC status error.
+func (a *JWTAuthenticator) Authenticate(r *http.Request, method string) (*http.Request, error) {
+	// Clients must not be able to set the headers themselves.
+	r = r.Clone(r.Context())
+	for _, claim := range a.config.ForwardClaims {
+		r.Header.Del(claim.Header)
+	}
+
+	token, ok := bearerToken(r)
+	if !ok {
+		if a.required(method) {
+			return nil, status.Error(codes.Unauthenticated, "missing bearer token")
+		}
+		return r, nil
+	}
+
+	claims := jwt.MapClaims{}
+	if _, err := a.parser.ParseWithClaims(token, claims, a.key); err != nil {
+		a.logger.Debug("Rejected invalid token", zap.String("method", method), zap.Error(err))
+		return nil, status.Error(codes.Unauthenticated, "invalid bearer token")
+	}
+
+	if len(a.config.Issuers) != 0 {
+		issuer, _ := claims.GetIssuer()
+		if !slices.Contains(a.config.Issuers, issuer) {
+			a.logger.Debug("Rejected token of unknown issuer", zap.String("method", method), zap.String("issuer", issuer))
+			return nil, status.Error(codes.Unauthenticated, "invalid bearer token")
+		}
+	}
+
+	for _, claim := range a.config.ForwardClaims {
+		for _, value := range claimValues(claims[claim.Claim]) {
+			r.Header.Add(claim.Header, value)
+		}
+	}
+
+	return r.WithContext(context.WithValue(r.Context(), jwtClaimsKey{}, claims)), nil
+}
+
+func (a *JWTAuthenticator) key(token *jwt.Token) (any, error) {
+	id, _ := token.Header["kid"].(string)
+	return a.keys.Key(id)
+}
+
+func (a *JWTAuthenticator) required(method string) bool {
+	for _, rule := range a.config.Rules {
+		if MatchAnyMethod(rule.Methods, method) {
+			return rule.Required
+		}
+	}
+	return a.config.Required
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+func claimValues(value any) []string {
+	switch value := value.(type) {
+	case nil:
+		return nil
+	case string:
+		return []string{value}
+	case []any:
+		var values []string
+		for _, element := range value {
+			values = append(values, claimValues(element)...)
+		}
+		return values
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil
+	}
+	return []string{string(data)}
+}
@@ -0,0 +1,37 @@
+package auth
+
+import (
+	"path"
+	"strings"
+)
+
+// MatchMethod reports whether a method matches a pattern.
+//
+// The method is a full method name like '/package.Service/Method'.
+// The pattern is either '*' for all methods, the name of a service like 'package.Service',
+// or a method name like 'package.Service/Method', which may contain wildcards, e.g. 'package.Service/Get*'.
+func MatchMethod(pattern, method string) bool {
+	pattern = strings.TrimPrefix(pattern, "/")
+	method = strings.TrimPrefix(method, "/")
+	if pattern == "*" {
+		return true
+	}
+
+	if !strings.Contains(pattern, "/") {
+		service, _, _ := strings.Cut(method, "/")
+		return pattern == service
+	}
+
+	matched, _ := path.Match(pattern, method)
+	return matched
+}
+
+// MatchAnyMethod reports whether a method matches any of the patterns, see [MatchMethod].
+func MatchAnyMethod(patterns []string, method string) bool {
+	for _, pattern := range patterns {
+		if MatchMethod(pattern, method) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,351 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gopkg.in/yaml.v3"
+)
+
+// PolicyAction is the decision of a policy rule, or the default decision of a policy file.
+type PolicyAction string
+
+const (
+	PolicyAllow PolicyAction = "allow"
+	PolicyDeny  PolicyAction = "deny"
+)
+
+// PolicyFile is the content of a policy file.
+type PolicyFile struct {
+	// Default is the action for requests that don't match any rule, the default is [PolicyDeny].
+	Default PolicyAction `yaml:"default"`
+
+	// Rules are evaluated in order, the first matching rule decides.
+	Rules []PolicyRule `yaml:"rules"`
+}
+
+// PolicyRule matches requests if all of the specified conditions match.
+// Conditions with multiple values match if any of the values match.
+// Strings can contain '*' as a wildcard that matches any characters.
+type PolicyRule struct {
+	Name   string       `yaml:"name"`
+	Action PolicyAction `yaml:"action"`
+
+	// Methods lists the methods the rule applies to, see [MatchMethod] for the syntax. All methods if empty.
+	Methods []string `yaml:"methods"`
+
+	// Principals matches the identities of the client certificate, i.e. the subject and the SANs.
+	Principals []string `yaml:"principals"`
+
+	// Claims matches claims of the JWT. Arrays match if any element matches.
+	Claims map[string][]string `yaml:"claims"`
+
+	// APIKeyClients matches the client name of the API key.
+	APIKeyClients []string `yaml:"api_key_clients"`
+
+	// SourceCIDRs matches the IP address of the client.
+	SourceCIDRs []string `yaml:"source_cidrs"`
+
+	// Headers matches request headers.
+	Headers map[string][]string `yaml:"headers"`
+}
+
+// PolicyInput contains the attributes of a request that policies are evaluated against.
+type PolicyInput struct {
+	Method       string
+	Principals   []string
+	Claims       map[string]any
+	APIKeyClient string
+	SourceIP     netip.Addr
+	Headers      http.Header
+}
+
+type compiledPolicy struct {
+	defaultAction PolicyAction
+	rules         []compiledRule
+}
+
+type compiledRule struct {
+	name          string
+	action        PolicyAction
+	methods       []string
+	principals    []*regexp.Regexp
+	claims        map[string][]*regexp.Regexp
+	apiKeyClients []*regexp.Regexp
+	sourceCIDRs   []netip.Prefix
+	headers       map[string][]*regexp.Regexp
+}
+
+// PolicyEngine evaluates the policies of a policy file and reloads them when the file changes.
+//
+// PolicyEngine must be created using [NewPolicyEngine].
+type PolicyEngine struct {
+	file   string
+	dryRun bool
+	logger *zap.Logger
+
+	mutex  *sync.RWMutex
+	policy *compiledPolicy
+}
+
+// NewPolicyEngine creates an engine and loads the policy file.
+// In dry run mode, requests are never denied, denials are only logged.
+func NewPolicyEngine(file string, dryRun bool, logger *zap.Logger) (*PolicyEngine, error) {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	e := &PolicyEngine{
+		file:   file,
+		dryRun: dryRun,
+		logger: logger,
+		mutex:  &sync.RWMutex{},
+	}
+
+	if err := e.reload(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Authorize evaluates the policies for a request.
+// If the request is denied, the returned error is a gRPC status error.
+func (e *PolicyEngine) Authorize(input PolicyInput) error {
+	e.mutex.RLock()
+	policy := e.policy
+	e.mutex.RUnlock()
+
+	action, rule := policy.evaluate(input)
+	if action == PolicyAllow {
+		return nil
+	}
+
+	if e.dryRun {
+		e.logger.Info("Request would be denied by policy", zap.String("method", input.Method), zap.String("rule", rule))
+		return nil
+	}
+
+	e.logger.Debug("Request denied by policy", zap.String("method", input.Method), zap.String("rule", rule))
+	return status.Error(codes.PermissionDenied, "denied by policy")
+}
+
+// Run watches the policy file and reloads it when it changes.
+// It will block until an error occurs or the context is cancelled.
+func (e *PolicyEngine) Run(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	// Watch the directory to also catch files that are replaced, see [certs.Manager.Run].
+	if err := watcher.Add(filepath.Dir(e.file)); err != nil {
+		return fmt.Errorf("failed to watch %s, %w", e.file, err)
+	}
+
+	var reloadTimer <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-watcher.Errors:
+			return err
+		case <-watcher.Events:
+			reloadTimer = time.After(time.Millisecond * 500)
+		case <-reloadTimer:
+			if err := e.reload(); err != nil {
+				e.logger.Error("Failed to reload policies, keeping the previous ones", zap.Error(err))
+			}
+		}
+	}
+}
+
+func (e *PolicyEngine) reload() error {
+	data, err := os.ReadFile(e.file)
+	if err != nil {
+		return err
+	}
+
+	var file PolicyFile
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&file); err != nil {
+		return fmt.Errorf("invalid policy file %s, %w", e.file, err)
+	}
+
+	policy, err := compilePolicy(file)
+	if err != nil {
+		return fmt.Errorf("invalid policy file %s, %w", e.file, err)
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.policy = policy
+	e.logger.Info("Loaded policies", zap.String("file", e.file), zap.Int("rules", len(policy.rules)), zap.Bool("dry_run", e.dryRun))
+	return nil
+}
+
+func compilePolicy(file PolicyFile) (*compiledPolicy, error) {
+	policy := &compiledPolicy{defaultAction: file.Default}
+	if policy.defaultAction == "" {
+		policy.defaultAction = PolicyDeny
+	}
+	if err := checkAction(policy.defaultAction); err != nil {
+		return nil, err
+	}
+
+	for i, rule := range file.Rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("#%d", i+1)
+		}
+
+		compiled, err := compileRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("rule %s, %w", rule.Name, err)
+		}
+		policy.rules = append(policy.rules, compiled)
+	}
+
+	return policy, nil
+}
+
+func checkAction(action PolicyAction) error {
+	if action != PolicyAllow && action != PolicyDeny {
+		return fmt.Errorf("invalid action '%s'", action)
+	}
+	return nil
+}
+
+func compileRule(rule PolicyRule) (compiledRule, error) {
+	if err := checkAction(rule.Action); err != nil {
+		return compiledRule{}, err
+	}
+
+	compiled := compiledRule{
+		name:          rule.Name,
+		action:        rule.Action,
+		methods:       rule.Methods,
+		principals:    compileGlobs(rule.Principals),
+		apiKeyClients: compileGlobs(rule.APIKeyClients),
+	}
+
+	if rule.Claims != nil {
+		compiled.claims = make(map[string][]*regexp.Regexp)
+		for claim, values := range rule.Claims {
+			compiled.claims[claim] = compileGlobs(values)
+		}
+	}
+
+	if rule.Headers != nil {
+		compiled.headers = make(map[string][]*regexp.Regexp)
+		for header, values := range rule.Headers {
+			compiled.headers[header] = compileGlobs(values)
+		}
+	}
+
+	for _, cidr := range rule.SourceCIDRs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return compiledRule{}, err
+		}
+		compiled.sourceCIDRs = append(compiled.sourceCIDRs, prefix.Masked())
+	}
+
+	return compiled, nil
+}
+
+func compileGlobs(globs []string) []*regexp.Regexp {
+	var compiled []*regexp.Regexp
+	for _, glob := range globs {
+		pattern := strings.ReplaceAll(regexp.QuoteMeta(glob), `\*`, ".*")
+		compiled = append(compiled, regexp.MustCompile("^"+pattern+"$"))
+	}
+	return compiled
+}
+
+func matchAnyGlob(globs []*regexp.Regexp, values ...string) bool {
+	for _, glob := range globs {
+		for _, value := range values {
+			if glob.MatchString(value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// evaluate returns the action for the request and the name of the rule that decided it.
+func (p *compiledPolicy) evaluate(input PolicyInput) (PolicyAction, string) {
+	for _, rule := range p.rules {
+		if rule.matches(input) {
+			return rule.action, rule.name
+		}
+	}
+	return p.defaultAction, "default"
+}
+
+func (r *compiledRule) matches(input PolicyInput) bool {
+	if len(r.methods) != 0 && !MatchAnyMethod(r.methods, input.Method) {
+		return false
+	}
+
+	if r.principals != nil && !matchAnyGlob(r.principals, input.Principals...) {
+		return false
+	}
+
+	for claim, globs := range r.claims {
+		if !matchAnyGlob(globs, claimValues(input.Claims[claim])...) {
+			return false
+		}
+	}
+
+	if r.apiKeyClients != nil && (input.APIKeyClient == "" || !matchAnyGlob(r.apiKeyClients, input.APIKeyClient)) {
+		return false
+	}
+
+	if r.sourceCIDRs != nil && !containsAddr(r.sourceCIDRs, input.SourceIP) {
+		return false
+	}
+
+	for header, globs := range r.headers {
+		if !matchAnyGlob(globs, input.Headers.Values(header)...) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// RemoteIP returns the IP address of a remote address like [http.Request.RemoteAddr].
+func RemoteIP(remoteAddr string) netip.Addr {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	addr, _ := netip.ParseAddr(host)
+	return addr
+}
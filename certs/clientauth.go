@@ -0,0 +1,66 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// ClientAuthMode controls whether clients have to present a certificate.
+type ClientAuthMode string
+
+const (
+	// ClientAuthNone doesn't request client certificates.
+	ClientAuthNone ClientAuthMode = "none"
+
+	// ClientAuthRequest requests a client certificate, but doesn't require it.
+	// Certificates that are sent are still verified.
+	ClientAuthRequest ClientAuthMode = "request"
+
+	// ClientAuthRequireAndVerify rejects clients without a valid certificate.
+	ClientAuthRequireAndVerify ClientAuthMode = "require_and_verify"
+)
+
+// ConfigureClientAuth configures the verification of client certificates on a server TLS config.
+// Client certificates are verified using the CA certificates in the PEM encoded caFile,
+// which is required unless the mode is [ClientAuthNone].
+func ConfigureClientAuth(config *tls.Config, mode ClientAuthMode, caFile string) error {
+	switch mode {
+	case "", ClientAuthNone:
+		config.ClientAuth = tls.NoClientCert
+		return nil
+	case ClientAuthRequest:
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	case ClientAuthRequireAndVerify:
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return fmt.Errorf("invalid client auth mode '%s'", mode)
+	}
+
+	if caFile == "" {
+		return fmt.Errorf("client auth mode '%s' requires a client CA file", mode)
+	}
+
+	pool, err := LoadCertPool(caFile)
+	if err != nil {
+		return err
+	}
+
+	config.ClientCAs = pool
+	return nil
+}
+
+// LoadCertPool creates a certificate pool containing the certificates in a PEM encoded file.
+func LoadCertPool(file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+	return pool, nil
+}
@@ -0,0 +1,211 @@
+package certs
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+)
+
+// KeyPair specifies the files of a certificate and its private key.
+type KeyPair struct {
+	CertFile string `mapstructure:"cert_file"`
+	KeyFile  string `mapstructure:"key_file"`
+}
+
+// SNIKeyPair is a key pair that is used for connections to specific server names.
+type SNIKeyPair struct {
+	KeyPair `mapstructure:",squash"`
+
+	// ServerNames lists the names the certificate is used for.
+	// Wildcards like '*.example.com' match a single label.
+	ServerNames []string `mapstructure:"server_names"`
+}
+
+// reloadDelay is the time to wait after a file change before reloading,
+// since certificates and keys are usually replaced in multiple steps.
+const reloadDelay = time.Millisecond * 500
+
+// Manager provides TLS certificates through [tls.Config.GetCertificate]
+// and reloads them when the files change, without interrupting existing connections.
+//
+// Manager must be created using [NewManager].
+type Manager struct {
+	defaultPair KeyPair
+	sniPairs    []SNIKeyPair
+	logger      *zap.Logger
+
+	mutex       *sync.RWMutex
+	defaultCert *tls.Certificate
+	sniCerts    map[string]*tls.Certificate
+}
+
+// NewManager creates a manager and loads all certificates.
+// The default key pair is used if no SNI key pair matches the requested server name.
+func NewManager(defaultPair KeyPair, sniPairs []SNIKeyPair, logger *zap.Logger) (*Manager, error) {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	m := &Manager{
+		defaultPair: defaultPair,
+		sniPairs:    sniPairs,
+		logger:      logger,
+		mutex:       &sync.RWMutex{},
+	}
+
+	if err := m.reload(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// GetCertificate can be used as [tls.Config.GetCertificate].
+func (m *Manager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if cert, ok := m.sniCerts[name]; ok {
+		return cert, nil
+	}
+
+	if _, parent, ok := strings.Cut(name, "."); ok {
+		if cert, ok := m.sniCerts["*."+parent]; ok {
+			return cert, nil
+		}
+	}
+
+	return m.defaultCert, nil
+}
+
+// TLSConfig returns a TLS config for servers, that uses the certificates of the manager.
+func (m *Manager) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: m.GetCertificate,
+	}
+}
+
+// Run watches the certificate files and reloads them when they change.
+// It will block until an error occurs or the context is cancelled.
+func (m *Manager) Run(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	// Watching the directories instead of the files also catches files that are replaced,
+	// e.g. by renaming or by updating a symlink, like Kubernetes does for mounted secrets.
+	dirs := make(map[string]bool)
+	for _, pair := range m.allPairs() {
+		dirs[filepath.Dir(pair.CertFile)] = true
+		dirs[filepath.Dir(pair.KeyFile)] = true
+	}
+
+	for dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			return fmt.Errorf("failed to watch %s, %w", dir, err)
+		}
+	}
+
+	var reloadTimer <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-watcher.Errors:
+			return err
+		case <-watcher.Events:
+			reloadTimer = time.After(reloadDelay)
+		case <-reloadTimer:
+			if err := m.reload(); err != nil {
+				m.logger.Error("Failed to reload certificates, keeping the previous ones", zap.Error(err))
+			}
+		}
+	}
+}
+
+func (m *Manager) allPairs() []KeyPair {
+	pairs := []KeyPair{m.defaultPair}
+	for _, pair := range m.sniPairs {
+		pairs = append(pairs, pair.KeyPair)
+	}
+	return pairs
+}
+
+// reload loads all certificates and replaces the current ones, if all of them could be loaded.
+func (m *Manager) reload() error {
+	defaultCert, err := m.load(m.defaultPair, m.currentDefault())
+	if err != nil {
+		return err
+	}
+
+	sniCerts := make(map[string]*tls.Certificate)
+	for _, pair := range m.sniPairs {
+		var previous *tls.Certificate
+		if len(pair.ServerNames) != 0 {
+			previous = m.currentSNI(pair.ServerNames[0])
+		}
+
+		cert, err := m.load(pair.KeyPair, previous)
+		if err != nil {
+			return err
+		}
+
+		for _, name := range pair.ServerNames {
+			sniCerts[strings.ToLower(name)] = cert
+		}
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.defaultCert = defaultCert
+	m.sniCerts = sniCerts
+	return nil
+}
+
+// load loads a key pair and logs the certificate if it's different from the previous one.
+func (m *Manager) load(pair KeyPair, previous *tls.Certificate) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(pair.CertFile, pair.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load key pair %s, %w", pair.CertFile, err)
+	}
+
+	if previous != nil && len(previous.Certificate) != 0 && bytes.Equal(previous.Certificate[0], cert.Certificate[0]) {
+		return previous, nil
+	}
+
+	if cert.Leaf != nil {
+		m.logger.Info("Loaded certificate",
+			zap.String("cert_file", pair.CertFile),
+			zap.String("subject", cert.Leaf.Subject.String()),
+			zap.Strings("dns_names", cert.Leaf.DNSNames),
+			zap.Time("not_after", cert.Leaf.NotAfter))
+
+		if time.Until(cert.Leaf.NotAfter) < 0 {
+			m.logger.Warn("Certificate is expired", zap.String("cert_file", pair.CertFile), zap.Time("not_after", cert.Leaf.NotAfter))
+		}
+	}
+
+	return &cert, nil
+}
+
+func (m *Manager) currentDefault() *tls.Certificate {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.defaultCert
+}
+
+func (m *Manager) currentSNI(name string) *tls.Certificate {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.sniCerts[strings.ToLower(name)]
+}
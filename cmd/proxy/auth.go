@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/natk64/pancake-proxy/auth"
+	"github.com/natk64/pancake-proxy/ratelimit"
+	"github.com/natk64/pancake-proxy/utils"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+// getJWTAuthenticator creates the JWT authenticator, or returns nil if JWT authentication is disabled.
+func getJWTAuthenticator(logger *zap.Logger) *auth.JWTAuthenticator {
+	if !viper.GetBool("jwt.enabled") {
+		return nil
+	}
+
+	var config auth.JWTConfig
+	if err := viper.UnmarshalKey("jwt", &config); err != nil {
+		logger.Fatal("Failed to load JWT config", zap.Error(err))
+	}
+
+	config.Logger = logger
+	authenticator, err := auth.NewJWTAuthenticator(config)
+	if err != nil {
+		logger.Fatal("Failed to create JWT authenticator", zap.Error(err))
+	}
+	return authenticator
+}
+
+// getAPIKeyAuthenticator creates the API key authenticator, or returns nil if API keys are disabled.
+func getAPIKeyAuthenticator(logger *zap.Logger) *auth.APIKeyAuthenticator {
+	if !viper.GetBool("api_keys.enabled") {
+		return nil
+	}
+
+	var config auth.APIKeyConfig
+	if err := viper.UnmarshalKey("api_keys", &config); err != nil {
+		logger.Fatal("Failed to load API key config", zap.Error(err))
+	}
+
+	config.Logger = logger
+	authenticator, err := auth.NewAPIKeyAuthenticator(config)
+	if err != nil {
+		logger.Fatal("Failed to create API key authenticator", zap.Error(err))
+	}
+	return authenticator
+}
+
+// getExtAuthorizer creates the external authorizer, or returns nil if external authorization is disabled.
+func getExtAuthorizer(logger *zap.Logger) *auth.ExtAuthorizer {
+	if !viper.GetBool("ext_authz.enabled") {
+		return nil
+	}
+
+	var config auth.ExtAuthzConfig
+	if err := viper.UnmarshalKey("ext_authz", &config); err != nil {
+		logger.Fatal("Failed to load external authorization config", zap.Error(err))
+	}
+
+	config.Logger = logger
+	authorizer, err := auth.NewExtAuthorizer(config)
+	if err != nil {
+		logger.Fatal("Failed to create external authorizer", zap.Error(err))
+	}
+	return authorizer
+}
+
+// getPolicyEngine creates the policy engine and starts watching the policy file,
+// or returns nil if policies are disabled.
+func getPolicyEngine(ctx context.Context, logger *zap.Logger) *auth.PolicyEngine {
+	if !viper.GetBool("policies.enabled") {
+		return nil
+	}
+
+	engine, err := auth.NewPolicyEngine(viper.GetString("policies.file"), viper.GetBool("policies.dry_run"), logger)
+	if err != nil {
+		logger.Fatal("Failed to load policies", zap.Error(err))
+	}
+
+	go utils.AutoRestarter{
+		Name:   "Policy watcher",
+		Delay:  time.Second * 10,
+		Logger: logger,
+		F:      engine.Run,
+	}.Run(ctx)
+
+	return engine
+}
+
+// getRateLimiter creates the local rate limiter, or returns nil if no rate limits are configured.
+func getRateLimiter(logger *zap.Logger) *ratelimit.Local {
+	var rules []ratelimit.Rule
+	if err := viper.UnmarshalKey("rate_limits", &rules); err != nil {
+		logger.Fatal("Failed to load rate limit config", zap.Error(err))
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+
+	limiter, err := ratelimit.NewLocal(rules)
+	if err != nil {
+		logger.Fatal("Failed to create rate limiter", zap.Error(err))
+	}
+	return limiter
+}
+
+// getGlobalRateLimiter creates the global rate limiter, or returns nil if it's disabled.
+func getGlobalRateLimiter(logger *zap.Logger) *ratelimit.Global {
+	if !viper.GetBool("global_rate_limit.enabled") {
+		return nil
+	}
+
+	var config ratelimit.GlobalConfig
+	if err := viper.UnmarshalKey("global_rate_limit", &config); err != nil {
+		logger.Fatal("Failed to load global rate limit config", zap.Error(err))
+	}
+
+	config.Logger = logger
+	limiter, err := ratelimit.NewGlobal(config)
+	if err != nil {
+		logger.Fatal("Failed to create global rate limiter", zap.Error(err))
+	}
+	return limiter
+}
+
+// getConcurrencyLimits creates the concurrency limits, or returns nil if they aren't configured.
+func getConcurrencyLimits(logger *zap.Logger) *ratelimit.ConcurrencyLimits {
+	if !viper.IsSet("concurrency") {
+		return nil
+	}
+
+	var config ratelimit.ConcurrencyConfig
+	if err := viper.UnmarshalKey("concurrency", &config); err != nil {
+		logger.Fatal("Failed to load concurrency limit config", zap.Error(err))
+	}
+
+	limits, err := ratelimit.NewConcurrencyLimits(config)
+	if err != nil {
+		logger.Fatal("Failed to create concurrency limits", zap.Error(err))
+	}
+	return limits
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-viper/mapstructure/v2"
+	"github.com/natk64/pancake-proxy/certs"
+	"github.com/natk64/pancake-proxy/proxy"
+	"github.com/natk64/pancake-proxy/utils"
+	"github.com/rs/cors"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+type listenerConfig struct {
+	// Address is either a TCP address or the path of a Unix socket prefixed with 'unix:'.
+	Address   string     `mapstructure:"address"`
+	TLS       tlsConfig  `mapstructure:"tls"`
+	CORS      corsConfig `mapstructure:"cors"`
+	Protocols []string   `mapstructure:"protocols"`
+	Services  []string   `mapstructure:"services"`
+}
+
+type tlsConfig struct {
+	Enabled       bool `mapstructure:"enabled"`
+	certs.KeyPair `mapstructure:",squash"`
+
+	// SNI lists additional certificates, which are selected by the server name requested by the client.
+	SNI []certs.SNIKeyPair `mapstructure:"sni"`
+
+	ClientAuth   certs.ClientAuthMode `mapstructure:"client_auth"`
+	ClientCAFile string               `mapstructure:"client_ca_file"`
+}
+
+type corsConfig struct {
+	Enabled        bool     `mapstructure:"enabled"`
+	AllowedOrigins []string `mapstructure:"allowed_origins"`
+	AllowedHeaders []string `mapstructure:"allowed_headers"`
+}
+
+// defaultListenerConfig builds the listener config from the top level options.
+// It is used if no listeners are configured and as the defaults for configured listeners.
+func defaultListenerConfig(logger *zap.Logger) listenerConfig {
+	var protocols []string
+	for _, protocol := range proxy.DefaultProtocols {
+		protocols = append(protocols, string(protocol))
+	}
+	if viper.GetBool("websockets.enabled") {
+		protocols = append(protocols, string(proxy.ProtocolWebsockets))
+	}
+	if viper.GetBool("sse.enabled") {
+		protocols = append(protocols, string(proxy.ProtocolSSE))
+	}
+	if viper.GetBool("rest.enabled") {
+		protocols = append(protocols, string(proxy.ProtocolREST))
+	}
+
+	var sni []certs.SNIKeyPair
+	if err := viper.UnmarshalKey("tls.sni", &sni); err != nil {
+		logger.Fatal("Failed to load SNI certificate config", zap.Error(err))
+	}
+
+	return listenerConfig{
+		Address: viper.GetString("bind_address"),
+		TLS: tlsConfig{
+			Enabled: viper.GetBool("tls.enabled"),
+			KeyPair: certs.KeyPair{
+				CertFile: viper.GetString("tls.cert_file"),
+				KeyFile:  viper.GetString("tls.key_file"),
+			},
+			SNI:          sni,
+			ClientAuth:   certs.ClientAuthMode(viper.GetString("tls.client_auth")),
+			ClientCAFile: viper.GetString("tls.client_ca_file"),
+		},
+		CORS: corsConfig{
+			Enabled:        viper.GetBool("cors.enabled"),
+			AllowedOrigins: viper.GetStringSlice("cors.allowed_origins"),
+			AllowedHeaders: viper.GetStringSlice("cors.allowed_headers"),
+		},
+		Protocols: protocols,
+	}
+}
+
+func getListenerConfigs(logger *zap.Logger) []listenerConfig {
+	raw := viper.Get("listeners")
+	if raw == nil {
+		return []listenerConfig{defaultListenerConfig(logger)}
+	}
+
+	entries, ok := raw.([]any)
+	if !ok {
+		logger.Fatal("Failed to load listener config, listeners must be a list")
+	}
+
+	configs := make([]listenerConfig, len(entries))
+	for i, entry := range entries {
+		configs[i] = defaultListenerConfig(logger)
+		decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+			Result:     &configs[i],
+			ZeroFields: true,
+		})
+		if err == nil {
+			err = decoder.Decode(entry)
+		}
+		if err != nil {
+			logger.Fatal("Failed to load listener config", zap.Int("index", i), zap.Error(err))
+		}
+	}
+
+	return configs
+}
+
+// proxyConfig returns the config of the proxy handler for the listener.
+func (config listenerConfig) proxyConfig() (proxy.ListenerConfig, error) {
+	protocols := make([]proxy.Protocol, len(config.Protocols))
+	for i, protocol := range config.Protocols {
+		protocols[i] = proxy.Protocol(protocol)
+	}
+	if err := proxy.ValidateProtocols(protocols); err != nil {
+		return proxy.ListenerConfig{}, fmt.Errorf("invalid config for listener %s, %w", config.Address, err)
+	}
+
+	return proxy.ListenerConfig{
+		Protocols: protocols,
+		Services:  config.Services,
+	}, nil
+}
+
+// getExplorerListenerConfig returns the config of the listener whose services the explorer exposes.
+// It's the listener with the address explorer.listener, or the first listener.
+func getExplorerListenerConfig(listeners []listenerConfig, logger *zap.Logger) proxy.ListenerConfig {
+	config := listeners[0]
+	if address := viper.GetString("explorer.listener"); address != "" {
+		index := slices.IndexFunc(listeners, func(l listenerConfig) bool { return l.Address == address })
+		if index == -1 {
+			logger.Fatal("The explorer listener doesn't exist", zap.String("address", address))
+		}
+		config = listeners[index]
+	}
+
+	if !slices.Contains(config.Protocols, string(proxy.ProtocolGrpc)) {
+		logger.Fatal("The explorer listener must accept the grpc protocol", zap.String("address", config.Address))
+	}
+
+	listenerConfig, err := config.proxyConfig()
+	if err != nil {
+		logger.Fatal("Failed to load explorer listener config", zap.Error(err))
+	}
+	return listenerConfig
+}
+
+// runListener starts a listener and blocks until it stops.
+func runListener(ctx context.Context, config listenerConfig, srv *proxy.Proxy, logger *zap.Logger) error {
+	listenerConfig, err := config.proxyConfig()
+	if err != nil {
+		return err
+	}
+	protocols := listenerConfig.Protocols
+
+	var corsHandler *cors.Cors
+	if config.CORS.Enabled {
+		allowedMethods := []string{"POST", "OPTIONS"}
+		if slices.Contains(protocols, proxy.ProtocolREST) {
+			allowedMethods = append(allowedMethods, "GET", "PUT", "PATCH", "DELETE")
+		} else if slices.Contains(protocols, proxy.ProtocolSSE) {
+			allowedMethods = append(allowedMethods, "GET")
+		}
+
+		corsHandler = cors.New(cors.Options{
+			AllowedOrigins: config.CORS.AllowedOrigins,
+			AllowedMethods: allowedMethods,
+			AllowedHeaders: config.CORS.AllowedHeaders,
+			ExposedHeaders: []string{"Grpc-Status", "Grpc-Message"},
+		})
+		listenerConfig.WebsocketOriginCheck = corsHandler.OriginAllowed
+	}
+
+	handler := srv.Handler(listenerConfig)
+	if corsHandler != nil {
+		handler = corsHandler.Handler(handler)
+	}
+
+	ln, err := listen(config.Address)
+	if err != nil {
+		return err
+	}
+
+	logger.Info("Starting listener",
+		zap.String("address", config.Address),
+		zap.Bool("tls", config.TLS.Enabled),
+		zap.String("client_auth", string(config.TLS.ClientAuth)),
+		zap.Strings("protocols", config.Protocols),
+		zap.Strings("services", config.Services))
+
+	server := &http.Server{Handler: handler}
+	if config.TLS.Enabled {
+		manager, err := certs.NewManager(config.TLS.KeyPair, config.TLS.SNI, logger.Named("certs"))
+		if err != nil {
+			ln.Close()
+			return err
+		}
+
+		go utils.AutoRestarter{
+			Name:   "Certificate watcher",
+			Delay:  time.Second * 10,
+			Logger: logger,
+			F:      manager.Run,
+		}.Run(ctx)
+
+		server.TLSConfig = manager.TLSConfig()
+		if err := certs.ConfigureClientAuth(server.TLSConfig, config.TLS.ClientAuth, config.TLS.ClientCAFile); err != nil {
+			ln.Close()
+			return err
+		}
+
+		return server.ServeTLS(ln, "", "")
+	}
+
+	// Wrapping the handler with h2c allows gRPC clients using insecure credentials to connect,
+	// while HTTP/1.1 clients (e.g. gRPC-Web) can still use the same port.
+	server.Handler = h2c.NewHandler(handler, &http2.Server{})
+	return server.Serve(ln)
+}
+
+// listen creates a TCP listener or a Unix socket listener, if the address starts with 'unix:'.
+func listen(address string) (net.Listener, error) {
+	path, isUnix := strings.CutPrefix(address, "unix:")
+	if !isUnix {
+		return net.Listen("tcp", address)
+	}
+
+	// Remove the socket left behind by a previous run, but never delete regular files.
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	return net.Listen("unix", path)
+}
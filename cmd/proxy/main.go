@@ -3,21 +3,38 @@ package main
 import (
 	"context"
 	"net/http"
+	"os"
+	"os/signal"
 	"path/filepath"
+	"reflect"
 	"strings"
+	"syscall"
 	"time"
 
+	"github.com/go-viper/mapstructure/v2"
+	"github.com/natk64/pancake-proxy/accesslog"
+	"github.com/natk64/pancake-proxy/certs"
 	"github.com/natk64/pancake-proxy/providers"
 	"github.com/natk64/pancake-proxy/proxy"
+	"github.com/natk64/pancake-proxy/record"
+	"github.com/natk64/pancake-proxy/tap"
+	"github.com/natk64/pancake-proxy/tap/tappb"
+	"github.com/natk64/pancake-proxy/tracing"
 	"github.com/natk64/pancake-proxy/utils"
-	"github.com/rs/cors"
 	"github.com/spf13/viper"
 	"go.uber.org/zap"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
 
 	"net/http/pprof"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(runReplay(os.Args[2:]))
+	}
+
 	// Reset default serve mux to remove default pprof routes
 	http.DefaultServeMux = http.NewServeMux()
 
@@ -54,11 +71,40 @@ func main() {
 	viper.SetDefault("tls.enabled", true)
 	viper.SetDefault("tls.cert_file", filepath.Join(configDir, "server.crt"))
 	viper.SetDefault("tls.key_file", filepath.Join(configDir, "server.key"))
+	viper.SetDefault("tls.client_auth", certs.ClientAuthNone)
 	viper.SetDefault("pprof.enabled", false)
 	viper.SetDefault("pprof.bind_address", "localhost:6060")
 	viper.SetDefault("docker.enabled", false)
 	viper.SetDefault("dashboard.enabled", false)
-	viper.SetDefault("dashboard.bind_address", ":8081")
+	viper.SetDefault("dashboard.bind_address", "localhost:8081")
+	viper.SetDefault("metrics.enabled", false)
+	viper.SetDefault("metrics.bind_address", ":9090")
+	viper.SetDefault("access_log.enabled", false)
+	viper.SetDefault("access_log.format", accesslog.FormatJSON)
+	viper.SetDefault("access_log.output", accesslog.OutputStdout)
+	viper.SetDefault("access_log.max_size", 100)
+	viper.SetDefault("access_log.sample_ratio", 1.0)
+	viper.SetDefault("access_log.exclude", []string{"grpc.health.v1.Health"})
+	viper.SetDefault("explorer.enabled", false)
+	viper.SetDefault("tap.enabled", false)
+	viper.SetDefault("tap.max_duration", time.Minute*10)
+	viper.SetDefault("record.enabled", false)
+	viper.SetDefault("record.max_size", 100)
+	viper.SetDefault("tracing.enabled", false)
+	viper.SetDefault("tracing.protocol", tracing.ProtocolGRPC)
+	viper.SetDefault("tracing.service_name", "pancake")
+	viper.SetDefault("websockets.enabled", false)
+	viper.SetDefault("sse.enabled", false)
+	viper.SetDefault("rest.enabled", false)
+	viper.SetDefault("jwt.enabled", false)
+	viper.SetDefault("api_keys.enabled", false)
+	viper.SetDefault("api_keys.header", "x-api-key")
+	viper.SetDefault("api_keys.client_header", "x-client-name")
+	viper.SetDefault("ext_authz.enabled", false)
+	viper.SetDefault("global_rate_limit.enabled", false)
+	viper.SetDefault("policies.enabled", false)
+	viper.SetDefault("policies.file", filepath.Join(configDir, "policies.yaml"))
+	viper.SetDefault("policies.dry_run", false)
 
 	var logger *zap.Logger
 	if viper.GetBool("logger.development") {
@@ -84,9 +130,25 @@ func main() {
 		Logger:          logger.Named("docker_provider"),
 	}
 
+	tracer := getTracing(ctx, logger.Named("tracing"))
 	srv := proxy.NewServer(proxy.ProxyConfig{
-		DisableReflection: viper.GetBool("disable_reflection"),
-		Logger:            logger.Named("server"),
+		DisableReflection:     viper.GetBool("disable_reflection"),
+		JWTAuthenticator:      getJWTAuthenticator(logger.Named("jwt")),
+		APIKeyAuthenticator:   getAPIKeyAuthenticator(logger.Named("api_keys")),
+		ExtAuthorizer:         getExtAuthorizer(logger.Named("ext_authz")),
+		PolicyEngine:          getPolicyEngine(ctx, logger.Named("policies")),
+		RateLimiter:           getRateLimiter(logger.Named("rate_limits")),
+		GlobalRateLimiter:     getGlobalRateLimiter(logger.Named("global_rate_limit")),
+		ConcurrencyLimits:     getConcurrencyLimits(logger.Named("concurrency")),
+		EnableMetrics:         viper.GetBool("metrics.enabled"),
+		EnableExplorer:        viper.GetBool("explorer.enabled"),
+		AdminToken:            viper.GetString("dashboard.admin_token"),
+		ConnectMaxMessageSize: viper.GetInt("connect.max_message_size"),
+		Tracing:               tracer,
+		AccessLog:             getAccessLog(logger.Named("access_log")),
+		Tap:                   getTap(logger.Named("tap")),
+		Recorder:              getRecorder(logger.Named("record")),
+		Logger:                logger.Named("server"),
 	})
 
 	go utils.AutoRestarter{
@@ -113,33 +175,51 @@ func main() {
 		go runPprofListener(logger.Named("pprof_server"))
 	}
 
+	listeners := getListenerConfigs(logger)
+
 	if viper.GetBool("dashboard.enabled") {
-		go runDashboardListener(srv, logger, viper.GetString("dashboard.bind_address"))
-	}
-
-	var handler http.Handler
-	if viper.GetBool("cors.enabled") {
-		cors := cors.New(cors.Options{
-			AllowedOrigins: viper.GetStringSlice("cors.allowed_origins"),
-			AllowedMethods: []string{"POST", "OPTIONS"},
-			AllowedHeaders: viper.GetStringSlice("cors.allowed_headers"),
-			ExposedHeaders: []string{"Grpc-Status", "Grpc-Message"},
-		})
-		handler = cors.Handler(srv)
-	} else {
-		handler = srv
+		var explorerListener proxy.ListenerConfig
+		if viper.GetBool("explorer.enabled") {
+			explorerListener = getExplorerListenerConfig(listeners, logger.Named("explorer"))
+		}
+		go runDashboardListener(srv, explorerListener, logger, viper.GetString("dashboard.bind_address"))
 	}
 
-	addr := viper.GetString("bind_address")
-	logger.Info("Starting proxy", zap.String("address", addr))
+	if viper.GetBool("metrics.enabled") {
+		go runMetricsListener(srv, logger, viper.GetString("metrics.bind_address"))
+	}
 
-	var err error
-	if viper.GetBool("tls.enabled") {
-		err = http.ListenAndServeTLS(addr, viper.GetString("tls.cert_file"), viper.GetString("tls.key_file"), handler)
-	} else {
-		err = http.ListenAndServe(addr, handler)
+	errs := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		go func() {
+			errs <- runListener(ctx, listener, srv, logger.Named("listener"))
+		}()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	select {
+	case err := <-errs:
+		shutdownTracing(tracer, logger)
+		logger.Fatal("Server stopped", zap.Error(err))
+	case sig := <-signals:
+		logger.Info("Shutting down", zap.Stringer("signal", sig))
+		shutdownTracing(tracer, logger)
+	}
+}
+
+// shutdownTracing exports the spans that haven't been sent to the collector yet.
+func shutdownTracing(t *tracing.Tracing, logger *zap.Logger) {
+	if t == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if err := t.Shutdown(ctx); err != nil {
+		logger.Error("Failed to export remaining spans", zap.Error(err))
 	}
-	logger.Fatal("Server stopped", zap.Error(err))
 }
 
 func runPprofListener(logger *zap.Logger) {
@@ -160,12 +240,30 @@ func runPprofListener(logger *zap.Logger) {
 	logger.Error("pprof server stopped", zap.Error(err))
 }
 
-func runDashboardListener(p *proxy.Proxy, logger *zap.Logger, addr string) {
+func runDashboardListener(p *proxy.Proxy, explorerListener proxy.ListenerConfig, logger *zap.Logger, addr string) {
 	dashboardServeMux := http.NewServeMux()
 	dashboardServeMux.HandleFunc("/{$}", p.DashboardHandler)
+	dashboardServeMux.HandleFunc("/live", p.DashboardLiveHandler)
+	dashboardServeMux.Handle("/api/", p.AdminHandler())
+	explorerHandler := p.ExplorerHandler(explorerListener)
+	dashboardServeMux.Handle("/explorer", explorerHandler)
+	dashboardServeMux.Handle("/explorer/", explorerHandler)
+
+	var handler http.Handler = dashboardServeMux
+	if tapServer := p.TapServer(); tapServer != nil {
+		grpcServer := grpc.NewServer()
+		tappb.RegisterTapServer(grpcServer, tapServer)
+
+		dashboardServeMux.HandleFunc("/tap", p.TapPageHandler)
+		dashboardServeMux.HandleFunc("/tap/events", tapServer.ServeEvents)
+		dashboardServeMux.Handle("POST /"+tappb.Tap_ServiceDesc.ServiceName+"/", grpcServer)
+
+		// gRPC clients connect using HTTP/2 without TLS.
+		handler = h2c.NewHandler(dashboardServeMux, &http2.Server{})
+	}
 
 	srv := &http.Server{
-		Handler: dashboardServeMux,
+		Handler: handler,
 		Addr:    addr,
 	}
 
@@ -174,14 +272,136 @@ func runDashboardListener(p *proxy.Proxy, logger *zap.Logger, addr string) {
 	logger.Error("Dashboard server stopped", zap.Error(err))
 }
 
+func runMetricsListener(p *proxy.Proxy, logger *zap.Logger, addr string) {
+	metricsServeMux := http.NewServeMux()
+	metricsServeMux.Handle("/metrics", p.MetricsHandler())
+
+	srv := &http.Server{
+		Handler: metricsServeMux,
+		Addr:    addr,
+	}
+
+	logger.Info("Starting metrics server", zap.String("address", srv.Addr))
+	err := srv.ListenAndServe()
+	logger.Error("Metrics server stopped", zap.Error(err))
+}
+
+// getTracing creates the tracer, or returns nil if tracing is disabled.
+func getTracing(ctx context.Context, logger *zap.Logger) *tracing.Tracing {
+	if !viper.GetBool("tracing.enabled") {
+		return nil
+	}
+
+	var config tracing.Config
+	if err := viper.UnmarshalKey("tracing", &config); err != nil {
+		logger.Fatal("Failed to load tracing config", zap.Error(err))
+	}
+	config.Logger = logger
+
+	t, err := tracing.New(ctx, config)
+	if err != nil {
+		logger.Fatal("Failed to set up tracing", zap.Error(err))
+	}
+	return t
+}
+
+// getAccessLog creates the access logger, or returns nil if access logs are disabled.
+func getAccessLog(logger *zap.Logger) *accesslog.Logger {
+	if !viper.GetBool("access_log.enabled") {
+		return nil
+	}
+
+	var config accesslog.Config
+	if err := viper.UnmarshalKey("access_log", &config); err != nil {
+		logger.Fatal("Failed to load access log config", zap.Error(err))
+	}
+	config.Logger = logger
+
+	l, err := accesslog.New(config)
+	if err != nil {
+		logger.Fatal("Failed to create access log", zap.Error(err))
+	}
+	return l
+}
+
+// getTap creates the tap, or returns nil if it's disabled.
+func getTap(logger *zap.Logger) *tap.Tap {
+	if !viper.GetBool("tap.enabled") {
+		return nil
+	}
+
+	var config tap.Config
+	if err := viper.UnmarshalKey("tap", &config); err != nil {
+		logger.Fatal("Failed to load tap config", zap.Error(err))
+	}
+	config.Logger = logger
+
+	t, err := tap.New(config)
+	if err != nil {
+		logger.Fatal("Failed to create tap", zap.Error(err))
+	}
+	return t
+}
+
+// getRecorder creates the recorder, or returns nil if recording is disabled.
+func getRecorder(logger *zap.Logger) *record.Recorder {
+	if !viper.GetBool("record.enabled") {
+		return nil
+	}
+
+	var config record.Config
+	if err := viper.UnmarshalKey("record", &config); err != nil {
+		logger.Fatal("Failed to load record config", zap.Error(err))
+	}
+	config.Logger = logger
+
+	r, err := record.New(config)
+	if err != nil {
+		logger.Fatal("Failed to create recorder", zap.Error(err))
+	}
+	return r
+}
+
 func getStaticServers(logger *zap.Logger) []proxy.UpstreamConfig {
 	type config struct {
 		Servers []proxy.UpstreamConfig `mapstructure:"servers"`
 	}
 
+	hook := mapstructure.ComposeDecodeHookFunc(
+		mapstructure.StringToTimeDurationHookFunc(),
+		mapstructure.StringToSliceHookFunc(","),
+		upstreamAliasHook,
+	)
+
 	var conf config
-	if err := viper.Unmarshal(&conf); err != nil {
+	if err := viper.Unmarshal(&conf, viper.DecodeHook(hook)); err != nil {
 		logger.Fatal("Failed to load static server config", zap.Error(err))
 	}
 	return conf.Servers
 }
+
+// upstreamAliases maps old option names of static servers to their current names, in lower case like viper keys.
+var upstreamAliases = map[string]string{
+	"insecureskipverify": "insecure_skip_verify",
+	"insecure":           "insecure_skip_verify",
+}
+
+// upstreamAliasHook renames the old options of static servers, like the aliases of the top level options.
+func upstreamAliasHook(from reflect.Type, to reflect.Type, data any) (any, error) {
+	fields, ok := data.(map[string]any)
+	if !ok || to != reflect.TypeOf(proxy.UpstreamConfig{}) {
+		return data, nil
+	}
+
+	renamed := make(map[string]any, len(fields))
+	for key, value := range fields {
+		if new, ok := upstreamAliases[strings.ToLower(key)]; ok {
+			if _, ok := fields[new]; ok {
+				continue
+			}
+			key = new
+		}
+		renamed[key] = value
+	}
+	return renamed, nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/natk64/pancake-proxy/auth"
+	"github.com/natk64/pancake-proxy/record"
+	"go.uber.org/zap"
+)
+
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// runReplay implements the replay command, which sends recorded calls to a server and compares the responses.
+// It returns the exit code.
+func runReplay(args []string) int {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: pancake replay -target <address> [options] <recording>...")
+		flags.PrintDefaults()
+	}
+
+	var headers, ignore, methods stringList
+	target := flags.String("target", "", "address of the proxy or upstream server the calls are sent to")
+	plaintext := flags.Bool("plaintext", false, "connect without TLS")
+	insecure := flags.Bool("insecure", false, "skip the verification of the server certificate")
+	timing := flags.Bool("timing", false, "send the request messages with the recorded delays")
+	timeout := flags.Duration("timeout", time.Second*30, "timeout of a single call")
+	verbose := flags.Bool("verbose", false, "print matching calls and debug logs")
+	flags.Var(&headers, "H", "request header 'name: value' replacing the recorded one, may be repeated")
+	flags.Var(&ignore, "ignore", "pattern of full field names that aren't compared like '*.created_at', may be repeated")
+	flags.Var(&methods, "method", "only replay calls of the method, see the method patterns of the config, may be repeated")
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *target == "" || flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	header := make(http.Header)
+	for _, h := range headers {
+		name, value, ok := strings.Cut(h, ":")
+		if !ok {
+			fmt.Fprintf(os.Stderr, "invalid header '%s', expected 'name: value'\n", h)
+			return 2
+		}
+		header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+
+	logger := zap.NewNop()
+	if *verbose {
+		logger = zap.Must(zap.NewDevelopment())
+	}
+
+	replayer, err := record.NewReplayer(record.ReplayConfig{
+		Target:             *target,
+		Plaintext:          *plaintext,
+		InsecureSkipVerify: *insecure,
+		Header:             header,
+		Ignore:             ignore,
+		Timing:             *timing,
+		Logger:             logger,
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	defer replayer.Close()
+
+	var matched, differed, failed, skipped int
+	for _, path := range flags.Args() {
+		file, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+
+		reader := record.NewReader(file)
+		for {
+			call, err := reader.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				file.Close()
+				fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+				return 2
+			}
+
+			if len(methods) != 0 && !auth.MatchAnyMethod(methods, call.Method) {
+				continue
+			}
+			if call.Incomplete {
+				skipped++
+				if *verbose {
+					fmt.Printf("SKIP %s %s, the recording is incomplete\n", call.Time.Format(time.RFC3339), call.Method)
+				}
+				continue
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+			result, err := replayer.Replay(ctx, call)
+			cancel()
+
+			switch {
+			case err != nil:
+				failed++
+				fmt.Printf("ERROR %s %s: %v\n", call.Time.Format(time.RFC3339), call.Method, err)
+			case len(result.Differences) != 0:
+				differed++
+				fmt.Printf("DIFF %s %s\n", call.Time.Format(time.RFC3339), call.Method)
+				for _, difference := range result.Differences {
+					fmt.Printf("    %s\n", difference)
+				}
+			default:
+				matched++
+				if *verbose {
+					fmt.Printf("OK %s %s\n", call.Time.Format(time.RFC3339), call.Method)
+				}
+			}
+		}
+		file.Close()
+	}
+
+	fmt.Printf("%d calls matched, %d differed, %d failed, %d skipped\n", matched, differed, failed, skipped)
+	if differed != 0 || failed != 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,87 @@
+package connect
+
+import (
+	"fmt"
+
+	"github.com/natk64/pancake-proxy/reflection"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// codec converts messages between the format used by the client and the binary protobuf format used by the upstream.
+type codec interface {
+	name() string
+	// toProto converts a request message to the binary protobuf format.
+	toProto(data []byte) ([]byte, error)
+	// fromProto converts a response message from the binary protobuf format.
+	fromProto(data []byte) ([]byte, error)
+}
+
+// newCodec returns the codec with the specified name.
+// The path of the request is used to find the message descriptors for codecs that need them.
+func newCodec(name string, path string, resolver reflection.FileExtensionResolver) (codec, error) {
+	switch name {
+	case "proto":
+		return protoCodec{}, nil
+	case "json":
+		method, err := reflection.FindMethod(resolver, path)
+		if err != nil {
+			return nil, status.Errorf(codes.Unimplemented, "no descriptor found for method %s, required for JSON", path)
+		}
+
+		return jsonCodec{method: method, types: reflection.TypeResolver{Files: resolver}}, nil
+	default:
+		return nil, status.Errorf(codes.Unimplemented, "unsupported codec '%s'", name)
+	}
+}
+
+type protoCodec struct{}
+
+func (protoCodec) name() string {
+	return "proto"
+}
+
+func (protoCodec) toProto(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+func (protoCodec) fromProto(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+type jsonCodec struct {
+	method protoreflect.MethodDescriptor
+	types  reflection.TypeResolver
+}
+
+func (jsonCodec) name() string {
+	return "json"
+}
+
+func (c jsonCodec) toProto(data []byte) ([]byte, error) {
+	msg := dynamicpb.NewMessage(c.method.Input())
+	if len(data) != 0 {
+		if err := (protojson.UnmarshalOptions{Resolver: c.types}).Unmarshal(data, msg); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "failed to decode JSON message: %v", err)
+		}
+	}
+
+	return proto.Marshal(msg)
+}
+
+func (c jsonCodec) fromProto(data []byte) ([]byte, error) {
+	msg := dynamicpb.NewMessage(c.method.Output())
+	if err := (proto.UnmarshalOptions{Resolver: c.types}).Unmarshal(data, msg); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to decode response message: %v", err)
+	}
+
+	data, err := (protojson.MarshalOptions{Resolver: c.types}).Marshal(msg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode JSON message: %w", err)
+	}
+	return data, nil
+}
@@ -0,0 +1,159 @@
+package connect
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	spb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+var codeNames = map[codes.Code]string{
+	codes.Canceled:           "canceled",
+	codes.Unknown:            "unknown",
+	codes.InvalidArgument:    "invalid_argument",
+	codes.DeadlineExceeded:   "deadline_exceeded",
+	codes.NotFound:           "not_found",
+	codes.AlreadyExists:      "already_exists",
+	codes.PermissionDenied:   "permission_denied",
+	codes.ResourceExhausted:  "resource_exhausted",
+	codes.FailedPrecondition: "failed_precondition",
+	codes.Aborted:            "aborted",
+	codes.OutOfRange:         "out_of_range",
+	codes.Unimplemented:      "unimplemented",
+	codes.Internal:           "internal",
+	codes.Unavailable:        "unavailable",
+	codes.DataLoss:           "data_loss",
+	codes.Unauthenticated:    "unauthenticated",
+}
+
+var codeHTTPStatus = map[codes.Code]int{
+	codes.Canceled:           499,
+	codes.Unknown:            http.StatusInternalServerError,
+	codes.InvalidArgument:    http.StatusBadRequest,
+	codes.DeadlineExceeded:   http.StatusGatewayTimeout,
+	codes.NotFound:           http.StatusNotFound,
+	codes.AlreadyExists:      http.StatusConflict,
+	codes.PermissionDenied:   http.StatusForbidden,
+	codes.ResourceExhausted:  http.StatusTooManyRequests,
+	codes.FailedPrecondition: http.StatusBadRequest,
+	codes.Aborted:            http.StatusConflict,
+	codes.OutOfRange:         http.StatusBadRequest,
+	codes.Unimplemented:      http.StatusNotImplemented,
+	codes.Internal:           http.StatusInternalServerError,
+	codes.Unavailable:        http.StatusServiceUnavailable,
+	codes.DataLoss:           http.StatusInternalServerError,
+	codes.Unauthenticated:    http.StatusUnauthorized,
+}
+
+// codeToHTTPStatus returns the HTTP status code used for unary Connect responses with the specified gRPC code.
+func codeToHTTPStatus(code codes.Code) int {
+	if status, ok := codeHTTPStatus[code]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+// httpStatusToCode maps the HTTP status of a gRPC response without a grpc-status to a gRPC code,
+// as specified in https://github.com/grpc/grpc/blob/master/doc/http-grpc-status-mapping.md
+func httpStatusToCode(httpStatus int) codes.Code {
+	switch httpStatus {
+	case http.StatusBadRequest:
+		return codes.Internal
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound:
+		return codes.Unimplemented
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return codes.Unavailable
+	default:
+		return codes.Unknown
+	}
+}
+
+// wireError is the JSON representation of an error in the Connect protocol.
+type wireError struct {
+	Code    string       `json:"code"`
+	Message string       `json:"message,omitempty"`
+	Details []wireDetail `json:"details,omitempty"`
+}
+
+type wireDetail struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+func newWireError(st *status.Status) *wireError {
+	name, ok := codeNames[st.Code()]
+	if !ok {
+		name = codeNames[codes.Unknown]
+	}
+
+	e := &wireError{
+		Code:    name,
+		Message: st.Message(),
+	}
+
+	for _, detail := range st.Proto().GetDetails() {
+		typeName := detail.GetTypeUrl()
+		if i := strings.LastIndexByte(typeName, '/'); i >= 0 {
+			typeName = typeName[i+1:]
+		}
+
+		e.Details = append(e.Details, wireDetail{
+			Type:  typeName,
+			Value: base64.RawStdEncoding.EncodeToString(detail.GetValue()),
+		})
+	}
+
+	return e
+}
+
+// statusFromHeaders reads the gRPC status from the headers written by the handler.
+// The bool result is false if no grpc-status was found.
+func statusFromHeaders(get func(key string) string) (*status.Status, bool) {
+	rawCode := get("Grpc-Status")
+	if rawCode == "" {
+		return nil, false
+	}
+
+	code, err := strconv.ParseUint(rawCode, 10, 32)
+	if err != nil {
+		return status.Newf(codes.Internal, "invalid grpc-status '%s'", rawCode), true
+	}
+
+	st := &spb.Status{
+		Code:    int32(code),
+		Message: decodeGrpcMessage(get("Grpc-Message")),
+	}
+
+	if rawDetails := get("Grpc-Status-Details-Bin"); rawDetails != "" {
+		data, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(rawDetails, "="))
+		var details spb.Status
+		if err == nil && proto.Unmarshal(data, &details) == nil {
+			st.Details = details.Details
+		}
+	}
+
+	return status.FromProto(st), true
+}
+
+// decodeGrpcMessage decodes the percent encoding used in the grpc-message header.
+func decodeGrpcMessage(msg string) string {
+	if !strings.Contains(msg, "%") {
+		return msg
+	}
+
+	decoded, err := url.PathUnescape(msg)
+	if err != nil {
+		return msg
+	}
+	return decoded
+}
@@ -0,0 +1,640 @@
+package connect
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/natk64/pancake-proxy/reflection"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	ContentTypeProto        = "application/proto"
+	ContentTypeJSON         = "application/json"
+	ContentTypeStreamPrefix = "application/connect+"
+	ContentTypeStreamProto  = "application/connect+proto"
+	ContentTypeStreamJSON   = "application/connect+json"
+
+	contentTypeGrpc = "application/grpc"
+)
+
+// DefaultMaxMessageSize is the default maximum size of a request message in bytes, after decompression.
+const DefaultMaxMessageSize = 4 << 20
+
+const (
+	flagCompressed = 0b00000001
+	flagEndStream  = 0b00000010
+)
+
+// Headers that are only meaningful for the Connect protocol and must not be forwarded upstream.
+var connectRequestHeaders = []string{
+	"Connect-Protocol-Version",
+	"Connect-Timeout-Ms",
+	"Connect-Content-Encoding",
+	"Connect-Accept-Encoding",
+	"Content-Encoding",
+	"Accept-Encoding",
+	"Content-Length",
+}
+
+// IsConnectRequest returns true if the content type of the request belongs to the Connect protocol.
+func IsConnectRequest(r *http.Request) bool {
+	_, _, ok := parseContentType(r.Header.Get("Content-Type"))
+	return ok
+}
+
+// parseContentType returns the codec name of a Connect content type and whether it is used for streaming.
+func parseContentType(contentType string) (codecName string, streaming bool, ok bool) {
+	contentType, _, _ = strings.Cut(contentType, ";")
+	contentType = strings.ToLower(strings.TrimSpace(contentType))
+
+	switch {
+	case contentType == ContentTypeProto:
+		return "proto", false, true
+	case contentType == ContentTypeJSON:
+		return "json", false, true
+	case strings.HasPrefix(contentType, ContentTypeStreamPrefix):
+		return strings.TrimPrefix(contentType, ContentTypeStreamPrefix), true, true
+	default:
+		return "", false, false
+	}
+}
+
+// WrapRequest wraps an incoming Connect request and its ResponseWriter,
+// so that it looks like a regular gRPC request to a handler function.
+//
+// Messages using the JSON codec are converted to and from the binary format,
+// using the descriptors in the resolver.
+//
+// Request messages larger than maxMessageSize are rejected with RESOURCE_EXHAUSTED,
+// [DefaultMaxMessageSize] is used if it's 0.
+//
+// Like with gRPC-Web, the handler has to call Finish on the wrapped ResponseWriter,
+// once the request is completed.
+//
+// If the request can't be translated, an error containing a gRPC status is returned.
+// The returned ResponseWriter is valid in any case and should be used to report the error to the client.
+func WrapRequest(w http.ResponseWriter, r *http.Request, resolver reflection.FileExtensionResolver, maxMessageSize int) (http.ResponseWriter, *http.Request, error) {
+	if maxMessageSize <= 0 {
+		maxMessageSize = DefaultMaxMessageSize
+	}
+
+	codecName, streaming, _ := parseContentType(r.Header.Get("Content-Type"))
+	c, codecErr := newCodec(codecName, r.URL.Path, resolver)
+	if codecErr != nil {
+		c = protoCodec{}
+	}
+
+	base := responseWriter{
+		inner:    w,
+		headers:  make(http.Header),
+		codec:    c,
+		errMutex: &sync.Mutex{},
+	}
+
+	var requestEncoding string
+	if streaming {
+		requestEncoding = r.Header.Get("Connect-Content-Encoding")
+		base.gzip = acceptsGzip(r.Header.Get("Connect-Accept-Encoding"))
+	} else {
+		requestEncoding = r.Header.Get("Content-Encoding")
+		base.gzip = acceptsGzip(r.Header.Get("Accept-Encoding"))
+	}
+
+	var rw interface {
+		http.ResponseWriter
+		setRequestError(err error)
+	}
+	if streaming {
+		rw = &streamResponseWriter{responseWriter: base}
+	} else {
+		rw = &unaryResponseWriter{responseWriter: base}
+	}
+
+	if codecErr != nil {
+		return rw, r, codecErr
+	}
+
+	if requestEncoding != "" && requestEncoding != "identity" && requestEncoding != "gzip" {
+		return rw, r, status.Errorf(codes.Unimplemented, "unsupported compression '%s'", requestEncoding)
+	}
+
+	var grpcTimeout string
+	if timeout := r.Header.Get("Connect-Timeout-Ms"); timeout != "" {
+		ms, err := strconv.ParseUint(timeout, 10, 64)
+		if err != nil || len(timeout) > 10 {
+			return rw, r, status.Errorf(codes.InvalidArgument, "invalid timeout '%s'", timeout)
+		}
+		grpcTimeout = formatGrpcTimeout(ms)
+	}
+
+	for _, key := range connectRequestHeaders {
+		r.Header.Del(key)
+	}
+
+	r.Header.Set("Content-Type", contentTypeGrpc)
+	r.Header.Set("Te", "trailers")
+	if grpcTimeout != "" {
+		r.Header.Set("Grpc-Timeout", grpcTimeout)
+	}
+
+	r.ContentLength = -1
+	r.ProtoMajor = 2
+	r.ProtoMinor = 0
+
+	if streaming {
+		r.Body = &envelopeReader{
+			source:         r.Body,
+			codec:          c,
+			gzip:           requestEncoding == "gzip",
+			maxMessageSize: maxMessageSize,
+			onError:        rw.setRequestError,
+		}
+		return rw, r, nil
+	}
+
+	// Reading one byte more than the limit tells oversized messages apart from messages of exactly the maximum size.
+	var body io.Reader = io.LimitReader(r.Body, int64(maxMessageSize)+1)
+	if requestEncoding == "gzip" {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return rw, r, status.Errorf(codes.InvalidArgument, "invalid gzip body: %v", err)
+		}
+		body = io.LimitReader(gz, int64(maxMessageSize)+1)
+	}
+
+	data, err := io.ReadAll(body)
+	r.Body.Close()
+	if err != nil {
+		return rw, r, status.Errorf(codes.InvalidArgument, "failed to read request: %v", err)
+	}
+	if len(data) > maxMessageSize {
+		return rw, r, messageTooLarge(maxMessageSize)
+	}
+
+	msg, err := c.toProto(data)
+	if err != nil {
+		return rw, r, err
+	}
+
+	r.Body = io.NopCloser(bytes.NewReader(appendEnvelope(nil, 0, msg)))
+	return rw, r, nil
+}
+
+// formatGrpcTimeout formats a timeout in milliseconds as a grpc-timeout header value,
+// which is limited to 8 digits.
+func formatGrpcTimeout(ms uint64) string {
+	if ms < 100_000_000 {
+		return fmt.Sprintf("%dm", ms)
+	}
+	return fmt.Sprintf("%dS", ms/1000)
+}
+
+func acceptsGzip(acceptEncoding string) bool {
+	for _, encoding := range strings.Split(acceptEncoding, ",") {
+		encoding, _, _ = strings.Cut(encoding, ";")
+		if strings.TrimSpace(encoding) == "gzip" {
+			return true
+		}
+	}
+	return false
+}
+
+// appendEnvelope appends a message with the 5 byte prefix used by both gRPC and Connect.
+func appendEnvelope(dst []byte, flags byte, msg []byte) []byte {
+	dst = append(dst, flags)
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(msg)))
+	return append(dst, msg...)
+}
+
+func compressGzip(data []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	if _, err := gz.Write(data); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// errMessageTooLarge is returned by decompressGzip if the decompressed message exceeds the maximum size.
+var errMessageTooLarge = errors.New("message too large")
+
+func decompressGzip(data []byte, maxSize int) ([]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := io.ReadAll(io.LimitReader(gz, int64(maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(msg) > maxSize {
+		return nil, errMessageTooLarge
+	}
+	return msg, nil
+}
+
+func messageTooLarge(maxSize int) error {
+	return status.Errorf(codes.ResourceExhausted, "message is larger than the maximum of %d bytes", maxSize)
+}
+
+// envelopeReader translates a stream of Connect envelopes to gRPC messages.
+type envelopeReader struct {
+	source  io.ReadCloser
+	codec   codec
+	gzip    bool
+	onError func(err error)
+
+	maxMessageSize int
+	pending        bytes.Buffer
+}
+
+func (e *envelopeReader) Read(p []byte) (int, error) {
+	if e.pending.Len() == 0 {
+		if err := e.readEnvelope(); err != nil {
+			return 0, err
+		}
+	}
+	return e.pending.Read(p)
+}
+
+func (e *envelopeReader) Close() error {
+	return e.source.Close()
+}
+
+func (e *envelopeReader) readEnvelope() error {
+	prefix := make([]byte, 5)
+	if _, err := io.ReadFull(e.source, prefix); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return e.fail(status.Error(codes.InvalidArgument, "incomplete envelope"))
+		}
+		return err
+	}
+
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if uint64(size) > uint64(e.maxMessageSize) {
+		return e.fail(messageTooLarge(e.maxMessageSize))
+	}
+
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(e.source, msg); err != nil {
+		return e.fail(status.Error(codes.InvalidArgument, "incomplete envelope"))
+	}
+
+	if prefix[0]&flagCompressed != 0 {
+		if !e.gzip {
+			return e.fail(status.Error(codes.InvalidArgument, "received compressed message without compression"))
+		}
+
+		var err error
+		if msg, err = decompressGzip(msg, e.maxMessageSize); err == errMessageTooLarge {
+			return e.fail(messageTooLarge(e.maxMessageSize))
+		} else if err != nil {
+			return e.fail(status.Errorf(codes.InvalidArgument, "failed to decompress message: %v", err))
+		}
+	}
+
+	msg, err := e.codec.toProto(msg)
+	if err != nil {
+		return e.fail(err)
+	}
+
+	e.pending.Write(appendEnvelope(nil, 0, msg))
+	return nil
+}
+
+func (e *envelopeReader) fail(err error) error {
+	e.onError(err)
+	return err
+}
+
+// responseWriter contains the parts shared by the unary and streaming response writers.
+type responseWriter struct {
+	inner      http.ResponseWriter
+	headers    http.Header
+	codec      codec
+	gzip       bool
+	statusCode int
+
+	// sentHeaders contains the keys that were present when WriteHeader was called.
+	// All keys added after that are trailers.
+	sentHeaders map[string]bool
+
+	errMutex   *sync.Mutex
+	requestErr error
+}
+
+// Header implements http.ResponseWriter.
+func (rw *responseWriter) Header() http.Header {
+	return rw.headers
+}
+
+func (rw *responseWriter) setRequestError(err error) {
+	rw.errMutex.Lock()
+	defer rw.errMutex.Unlock()
+	if rw.requestErr == nil {
+		rw.requestErr = err
+	}
+}
+
+func (rw *responseWriter) requestError() error {
+	rw.errMutex.Lock()
+	defer rw.errMutex.Unlock()
+	return rw.requestErr
+}
+
+// recordHeader remembers the status code and which headers belong to the response headers.
+// It returns false if it was already called before.
+func (rw *responseWriter) recordHeader(statusCode int) bool {
+	if rw.statusCode != 0 {
+		return false
+	}
+
+	rw.statusCode = statusCode
+	rw.sentHeaders = make(map[string]bool)
+	for key := range rw.headers {
+		rw.sentHeaders[key] = true
+	}
+	return true
+}
+
+// metadata splits the headers written by the handler into response headers and trailers
+// and extracts the gRPC status. Headers that are specific to gRPC are removed.
+func (rw *responseWriter) metadata() (headers http.Header, trailers http.Header, st *status.Status) {
+	headers = make(http.Header)
+	trailers = make(http.Header)
+
+	for key, values := range rw.headers {
+		canonical := http.CanonicalHeaderKey(strings.TrimPrefix(key, http.TrailerPrefix))
+		switch canonical {
+		case "Trailer", "Content-Type", "Content-Length", "Content-Encoding",
+			"Grpc-Encoding", "Grpc-Accept-Encoding",
+			"Grpc-Status", "Grpc-Message", "Grpc-Status-Details-Bin":
+			continue
+		}
+
+		if rw.sentHeaders[key] {
+			headers[canonical] = append(headers[canonical], values...)
+		} else {
+			trailers[canonical] = append(trailers[canonical], values...)
+		}
+	}
+
+	if err := rw.requestError(); err != nil {
+		return headers, trailers, status.Convert(err)
+	}
+
+	st, ok := statusFromHeaders(rw.getHeader)
+	if !ok {
+		if rw.statusCode != 0 && rw.statusCode != http.StatusOK {
+			st = status.Newf(httpStatusToCode(rw.statusCode), "upstream responded with HTTP status %d", rw.statusCode)
+		} else {
+			st = status.New(codes.Unknown, "upstream did not send a gRPC status")
+		}
+	}
+
+	return headers, trailers, st
+}
+
+// getHeader returns a header value, regardless of whether it was set as a header or a trailer.
+func (rw *responseWriter) getHeader(key string) string {
+	if value := rw.headers.Get(key); value != "" {
+		return value
+	}
+	if values := rw.headers[http.TrailerPrefix+key]; len(values) != 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// decodeFrame returns the message in a gRPC frame, decompressing it if necessary.
+func (rw *responseWriter) decodeFrame(flags byte, msg []byte) ([]byte, error) {
+	if flags&flagCompressed == 0 {
+		return msg, nil
+	}
+
+	if encoding := rw.getHeader("Grpc-Encoding"); encoding != "gzip" {
+		return nil, status.Errorf(codes.Internal, "unsupported response compression '%s'", encoding)
+	}
+
+	// The upstream servers are trusted, so responses are only limited to the largest int of 32-bit platforms.
+	msg, err := decompressGzip(msg, math.MaxInt32)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to decompress response: %v", err)
+	}
+	return msg, nil
+}
+
+// unaryResponseWriter buffers the whole response, because unary Connect responses
+// contain the status as the HTTP status code and the trailers as headers.
+type unaryResponseWriter struct {
+	responseWriter
+	body bytes.Buffer
+}
+
+// WriteHeader implements http.ResponseWriter.
+func (u *unaryResponseWriter) WriteHeader(statusCode int) {
+	u.recordHeader(statusCode)
+}
+
+// Write implements http.ResponseWriter.
+func (u *unaryResponseWriter) Write(data []byte) (int, error) {
+	u.recordHeader(http.StatusOK)
+	return u.body.Write(data)
+}
+
+// Finish writes the buffered response to the client.
+func (u *unaryResponseWriter) Finish() {
+	headers, trailers, st := u.metadata()
+
+	target := u.inner.Header()
+	for key, values := range headers {
+		target[key] = values
+	}
+	for key, values := range trailers {
+		target["Trailer-"+key] = values
+	}
+
+	if st.Code() == codes.OK {
+		msg, err := u.responseMessage()
+		if err == nil {
+			u.writeMessage(msg)
+			return
+		}
+		st = status.Convert(err)
+	}
+
+	target.Set("Content-Type", ContentTypeJSON)
+	u.inner.WriteHeader(codeToHTTPStatus(st.Code()))
+	json.NewEncoder(u.inner).Encode(newWireError(st))
+}
+
+// responseMessage extracts the single response message from the buffered gRPC frames.
+func (u *unaryResponseWriter) responseMessage() ([]byte, error) {
+	data := u.body.Bytes()
+	if len(data) < 5 {
+		return nil, status.Error(codes.Unimplemented, "upstream did not send a response message")
+	}
+
+	length := binary.BigEndian.Uint32(data[1:5])
+	if uint64(len(data)) != 5+uint64(length) {
+		return nil, status.Error(codes.Unimplemented, "upstream did not send exactly one response message")
+	}
+
+	msg, err := u.decodeFrame(data[0], data[5:])
+	if err != nil {
+		return nil, err
+	}
+
+	return u.codec.fromProto(msg)
+}
+
+func (u *unaryResponseWriter) writeMessage(msg []byte) {
+	target := u.inner.Header()
+	target.Set("Content-Type", "application/"+u.codec.name())
+
+	if u.gzip && len(msg) != 0 {
+		if compressed, err := compressGzip(msg); err == nil {
+			target.Set("Content-Encoding", "gzip")
+			msg = compressed
+		}
+	}
+
+	target.Set("Content-Length", strconv.Itoa(len(msg)))
+	u.inner.WriteHeader(http.StatusOK)
+	u.inner.Write(msg)
+}
+
+// streamResponseWriter translates gRPC frames to Connect envelopes as they are written.
+type streamResponseWriter struct {
+	responseWriter
+	pending     bytes.Buffer
+	responseErr error
+}
+
+type endStreamMessage struct {
+	Error    *wireError          `json:"error,omitempty"`
+	Metadata map[string][]string `json:"metadata,omitempty"`
+}
+
+// WriteHeader implements http.ResponseWriter.
+func (s *streamResponseWriter) WriteHeader(statusCode int) {
+	if !s.recordHeader(statusCode) {
+		return
+	}
+
+	headers, _, _ := s.metadata()
+	target := s.inner.Header()
+	for key, values := range headers {
+		target[key] = values
+	}
+
+	target.Set("Content-Type", ContentTypeStreamPrefix+s.codec.name())
+	if s.gzip {
+		target.Set("Connect-Content-Encoding", "gzip")
+	}
+
+	// Streaming responses always use status 200, errors are sent in the end of stream message.
+	s.inner.WriteHeader(http.StatusOK)
+}
+
+// Write implements http.ResponseWriter.
+func (s *streamResponseWriter) Write(data []byte) (int, error) {
+	s.WriteHeader(http.StatusOK)
+	s.pending.Write(data)
+
+	for s.pending.Len() >= 5 {
+		length := binary.BigEndian.Uint32(s.pending.Bytes()[1:5])
+		if uint64(s.pending.Len()) < 5+uint64(length) {
+			break
+		}
+
+		frame := s.pending.Next(5 + int(length))
+		if s.responseErr != nil {
+			// The stream is already broken, discard all remaining messages.
+			continue
+		}
+
+		if err := s.writeFrame(frame[0], frame[5:]); err != nil {
+			return len(data), err
+		}
+	}
+
+	return len(data), nil
+}
+
+func (s *streamResponseWriter) writeFrame(flags byte, msg []byte) error {
+	msg, err := s.decodeFrame(flags, msg)
+	if err == nil {
+		msg, err = s.codec.fromProto(msg)
+	}
+	if err != nil {
+		s.responseErr = err
+		return nil
+	}
+
+	flags = 0
+	if s.gzip && len(msg) != 0 {
+		if compressed, err := compressGzip(msg); err == nil {
+			flags |= flagCompressed
+			msg = compressed
+		}
+	}
+
+	_, err = s.inner.Write(appendEnvelope(nil, flags, msg))
+	return err
+}
+
+// Flush implements http.Flusher.
+func (s *streamResponseWriter) Flush() {
+	if f, ok := s.inner.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Finish finishes the stream by writing the end of stream message, containing the status and trailers.
+func (s *streamResponseWriter) Finish() {
+	s.WriteHeader(http.StatusOK)
+
+	_, trailers, st := s.metadata()
+	if st.Code() == codes.OK && s.responseErr != nil {
+		st = status.Convert(s.responseErr)
+	}
+	if st.Code() == codes.OK && s.pending.Len() != 0 {
+		st = status.New(codes.Internal, "upstream sent an incomplete message")
+	}
+
+	end := endStreamMessage{}
+	if st.Code() != codes.OK {
+		end.Error = newWireError(st)
+	}
+	if len(trailers) != 0 {
+		end.Metadata = make(map[string][]string, len(trailers))
+		for key, values := range trailers {
+			end.Metadata[strings.ToLower(key)] = values
+		}
+	}
+
+	data, err := json.Marshal(end)
+	if err != nil {
+		data = []byte("{}")
+	}
+
+	s.inner.Write(appendEnvelope(nil, flagEndStream, data))
+	s.Flush()
+}
@@ -134,7 +134,7 @@ func (g *grpcWebResponseWriter) Finish() {
 			continue
 		}
 
-		key = strings.TrimPrefix(key, http.TrailerPrefix)
+		key = strings.TrimPrefix(key, strings.ToLower(http.TrailerPrefix))
 		trailers[key] = value
 	}
 
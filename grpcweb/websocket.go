@@ -0,0 +1,212 @@
+package grpcweb
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"slices"
+	"strings"
+
+	"golang.org/x/net/websocket"
+)
+
+// WebsocketProtocol is the WebSocket subprotocol used by the websocket transport of improbable-eng's gRPC-Web client.
+const WebsocketProtocol = "grpc-websockets"
+
+// IsWebsocketRequest returns true if the request is a WebSocket upgrade request using [WebsocketProtocol].
+func IsWebsocketRequest(r *http.Request) bool {
+	if r.Method != http.MethodGet || !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+
+	for _, value := range r.Header.Values("Sec-Websocket-Protocol") {
+		for _, protocol := range strings.Split(value, ",") {
+			if strings.TrimSpace(protocol) == WebsocketProtocol {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// ServeWebsocket accepts a WebSocket connection using [WebsocketProtocol] and bridges it to a gRPC-Web request,
+// which is passed to the handler. This allows browser clients to use client and bidirectional streaming.
+//
+// The protocol works as follows:
+//   - The first message sent by the client contains the request headers in HTTP/1 format.
+//   - Every following client message starts with a flag byte. A message consisting of only
+//     the byte 1 marks the end of the client stream, otherwise the rest of the message is a gRPC frame.
+//   - The server sends the response headers and trailers as gRPC-Web trailer frames and the messages as regular frames.
+//
+// checkOrigin decides whether the origin of the upgrade request is accepted.
+// If it's nil, only requests without an origin or from the same origin are accepted.
+func ServeWebsocket(w http.ResponseWriter, r *http.Request, checkOrigin func(r *http.Request) bool, handler http.Handler) {
+	if _, ok := w.(http.Hijacker); !ok || r.ProtoMajor != 1 {
+		w.WriteHeader(http.StatusHTTPVersionNotSupported)
+		fmt.Fprint(w, "WebSockets require HTTP/1.1")
+		return
+	}
+
+	if checkOrigin == nil {
+		checkOrigin = isSameOrigin
+	}
+
+	server := websocket.Server{
+		Handshake: func(config *websocket.Config, req *http.Request) error {
+			if !slices.Contains(config.Protocol, WebsocketProtocol) {
+				return fmt.Errorf("unsupported subprotocol")
+			}
+			if !checkOrigin(req) {
+				return fmt.Errorf("origin not allowed")
+			}
+
+			config.Protocol = []string{WebsocketProtocol}
+			return nil
+		},
+		Handler: func(conn *websocket.Conn) {
+			serveWebsocketConn(conn, r, handler)
+		},
+	}
+
+	server.ServeHTTP(w, r)
+}
+
+func isSameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+func serveWebsocketConn(conn *websocket.Conn, upgrade *http.Request, handler http.Handler) {
+	defer conn.Close()
+	conn.PayloadType = websocket.BinaryFrame
+
+	var headerMessage []byte
+	if err := websocket.Message.Receive(conn, &headerMessage); err != nil {
+		return
+	}
+
+	header, err := parseHeaderMessage(headerMessage)
+	if err != nil {
+		return
+	}
+
+	if header.Get("Content-Type") == "" {
+		header.Set("Content-Type", ContentTypeGrpcWeb+"+proto")
+	}
+
+	ctx, cancel := context.WithCancel(upgrade.Context())
+	defer cancel()
+
+	r := upgrade.Clone(ctx)
+	r.Method = http.MethodPost
+	r.Header = header
+	r.Body = &websocketReader{conn: conn, onError: cancel}
+
+	handler.ServeHTTP(&websocketResponseWriter{conn: conn, headers: make(http.Header)}, r)
+}
+
+func parseHeaderMessage(data []byte) (http.Header, error) {
+	// The message doesn't contain the empty line that ends a header block.
+	reader := textproto.NewReader(bufio.NewReader(io.MultiReader(bytes.NewReader(data), strings.NewReader("\r\n\r\n"))))
+	header, err := reader.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	return http.Header(header), nil
+}
+
+// websocketReader reads the gRPC frames sent by the client.
+type websocketReader struct {
+	conn    *websocket.Conn
+	onError func()
+	pending []byte
+	done    bool
+}
+
+func (w *websocketReader) Read(p []byte) (int, error) {
+	for len(w.pending) == 0 {
+		if w.done {
+			return 0, io.EOF
+		}
+
+		var msg []byte
+		if err := websocket.Message.Receive(w.conn, &msg); err != nil {
+			w.onError()
+			return 0, err
+		}
+
+		if len(msg) == 1 && msg[0] == 1 {
+			w.done = true
+			return 0, io.EOF
+		}
+
+		if len(msg) != 0 {
+			w.pending = msg[1:]
+		}
+	}
+
+	n := copy(p, w.pending)
+	w.pending = w.pending[n:]
+	return n, nil
+}
+
+func (w *websocketReader) Close() error {
+	return nil
+}
+
+var _ http.ResponseWriter = (*websocketResponseWriter)(nil)
+
+// websocketResponseWriter sends the headers and body of a gRPC-Web response as WebSocket messages.
+type websocketResponseWriter struct {
+	conn          *websocket.Conn
+	headers       http.Header
+	headerWritten bool
+}
+
+// Header implements http.ResponseWriter.
+func (w *websocketResponseWriter) Header() http.Header {
+	return w.headers
+}
+
+// Write implements http.ResponseWriter.
+func (w *websocketResponseWriter) Write(data []byte) (int, error) {
+	if !w.headerWritten {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if err := websocket.Message.Send(w.conn, data); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// WriteHeader implements http.ResponseWriter.
+// The status code can't be sent using this protocol, only the headers are sent.
+func (w *websocketResponseWriter) WriteHeader(statusCode int) {
+	if w.headerWritten {
+		return
+	}
+	w.headerWritten = true
+
+	buf := &bytes.Buffer{}
+	w.headers.Write(buf)
+	frame := make([]byte, 5, 5+buf.Len())
+	frame[0] = 0b10000000
+	binary.BigEndian.PutUint32(frame[1:], uint32(buf.Len()))
+	websocket.Message.Send(w.conn, append(frame, buf.Bytes()...))
+}
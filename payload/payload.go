@@ -0,0 +1,180 @@
+package payload
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/natk64/pancake-proxy/reflection"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+const redactedValue = "REDACTED"
+
+// Config configures a [Decoder].
+type Config struct {
+	// Redact lists fields whose values are replaced, as patterns of their full names like '*.password' or 'package.User.email'.
+	Redact []string `mapstructure:"redact"`
+
+	// RedactOption is the full name of a bool field option, e.g. 'mycompany.sensitive'.
+	// Fields with the option set to true are redacted.
+	RedactOption string `mapstructure:"redact_option"`
+
+	// MaxSize is the maximum length of a decoded message in bytes, longer messages are truncated. The default is 4096.
+	MaxSize int `mapstructure:"max_size"`
+}
+
+// Decoder converts binary messages to redacted JSON.
+//
+// Decoder must be created using [NewDecoder].
+type Decoder struct {
+	config Config
+}
+
+// NewDecoder validates the config and creates a decoder.
+func NewDecoder(config Config) (*Decoder, error) {
+	if config.MaxSize <= 0 {
+		config.MaxSize = 4096
+	}
+	for _, pattern := range config.Redact {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid redact pattern '%s'", pattern)
+		}
+	}
+	return &Decoder{config: config}, nil
+}
+
+// Decode converts a binary message of a method to redacted JSON, using the descriptors in the resolver.
+// If request is false, the message is decoded as a response. Errors are returned as a placeholder text.
+func (d *Decoder) Decode(resolver reflection.FileExtensionResolver, method string, request bool, data []byte) string {
+	descriptor, err := reflection.FindMethod(resolver, method)
+	if err != nil {
+		return fmt.Sprintf("<no descriptor, %d bytes>", len(data))
+	}
+
+	messageType := descriptor.Output()
+	if request {
+		messageType = descriptor.Input()
+	}
+
+	types := reflection.TypeResolver{Files: resolver}
+	msg := dynamicpb.NewMessage(messageType)
+	if err := (proto.UnmarshalOptions{Resolver: types}).Unmarshal(data, msg); err != nil {
+		return fmt.Sprintf("<invalid message, %v>", err)
+	}
+
+	d.redact(resolver, msg)
+
+	encoded, err := (protojson.MarshalOptions{Resolver: types}).Marshal(msg)
+	if err != nil {
+		return fmt.Sprintf("<failed to encode message, %v>", err)
+	}
+
+	if len(encoded) > d.config.MaxSize {
+		return fmt.Sprintf("%s...<truncated %d bytes>", encoded[:d.config.MaxSize], len(encoded)-d.config.MaxSize)
+	}
+	return string(encoded)
+}
+
+// redact replaces the values of redacted fields in the message and its nested messages.
+func (d *Decoder) redact(resolver reflection.FileExtensionResolver, msg protoreflect.Message) {
+	// The message must not be changed while iterating over its fields.
+	var redacted []protoreflect.FieldDescriptor
+	msg.Range(func(field protoreflect.FieldDescriptor, value protoreflect.Value) bool {
+		if d.isRedacted(resolver, field) {
+			redacted = append(redacted, field)
+			return true
+		}
+
+		switch {
+		case field.IsList() && field.Message() != nil:
+			list := value.List()
+			for i := 0; i < list.Len(); i++ {
+				d.redact(resolver, list.Get(i).Message())
+			}
+		case field.IsMap() && field.MapValue().Message() != nil:
+			value.Map().Range(func(_ protoreflect.MapKey, value protoreflect.Value) bool {
+				d.redact(resolver, value.Message())
+				return true
+			})
+		case !field.IsList() && !field.IsMap() && field.Message() != nil:
+			d.redact(resolver, value.Message())
+		}
+		return true
+	})
+
+	for _, field := range redacted {
+		switch {
+		case field.IsList() || field.IsMap():
+			msg.Clear(field)
+		case field.Kind() == protoreflect.StringKind:
+			msg.Set(field, protoreflect.ValueOfString(redactedValue))
+		case field.Kind() == protoreflect.BytesKind:
+			msg.Set(field, protoreflect.ValueOfBytes([]byte(redactedValue)))
+		default:
+			msg.Clear(field)
+		}
+	}
+}
+
+func (d *Decoder) isRedacted(resolver reflection.FileExtensionResolver, field protoreflect.FieldDescriptor) bool {
+	for _, pattern := range d.config.Redact {
+		if matched, _ := path.Match(pattern, string(field.FullName())); matched {
+			return true
+		}
+	}
+
+	if d.config.RedactOption == "" {
+		return false
+	}
+
+	return hasBoolOption(resolver, field, protoreflect.FullName(d.config.RedactOption))
+}
+
+// hasBoolOption reports whether a bool extension of the field options is set to true.
+// Options of descriptors received through reflection are unknown fields, since the extension isn't in the global registry.
+func hasBoolOption(resolver reflection.FileExtensionResolver, field protoreflect.FieldDescriptor, option protoreflect.FullName) bool {
+	options, ok := field.Options().(proto.Message)
+	if !ok || options == nil {
+		return false
+	}
+
+	d, err := resolver.FindDescriptorByName(option)
+	if err != nil {
+		return false
+	}
+	extension, ok := d.(protoreflect.ExtensionDescriptor)
+	if !ok {
+		return false
+	}
+
+	set := false
+	data := options.ProtoReflect().GetUnknown()
+	for len(data) > 0 {
+		number, wireType, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return false
+		}
+		data = data[n:]
+
+		if number == extension.Number() && wireType == protowire.VarintType {
+			value, n := protowire.ConsumeVarint(data)
+			if n < 0 {
+				return false
+			}
+			set = value != 0
+			data = data[n:]
+			continue
+		}
+
+		n = protowire.ConsumeFieldValue(number, wireType, data)
+		if n < 0 {
+			return false
+		}
+		data = data[n:]
+	}
+	return set
+}
@@ -83,6 +83,10 @@ type knownLabels struct {
 	skipVerify string
 	port       string
 	network    string
+	caFile     string
+	certFile   string
+	keyFile    string
+	serverName string
 }
 
 // Run starts the provider.
@@ -111,6 +115,10 @@ func (prov Docker) Run(ctx context.Context, target *proxy.Proxy) error {
 		skipVerify: fmt.Sprintf("%s.skip_verify", prov.Label),
 		port:       fmt.Sprintf("%s.port", prov.Label),
 		network:    fmt.Sprintf("%s.network", prov.Label),
+		caFile:     fmt.Sprintf("%s.ca_file", prov.Label),
+		certFile:   fmt.Sprintf("%s.cert_file", prov.Label),
+		keyFile:    fmt.Sprintf("%s.key_file", prov.Label),
+		serverName: fmt.Sprintf("%s.server_name", prov.Label),
 	}
 
 	prov.ExposeMode = mode
@@ -237,6 +245,10 @@ func (prov *Docker) configFromContainer(container *types.Container) (proxy.Upstr
 	return proxy.UpstreamConfig{
 		Plaintext:          container.Labels[prov.labels.plaintext] == "true",
 		InsecureSkipVerify: container.Labels[prov.labels.skipVerify] == "true",
+		CAFile:             container.Labels[prov.labels.caFile],
+		CertFile:           container.Labels[prov.labels.certFile],
+		KeyFile:            container.Labels[prov.labels.keyFile],
+		ServerName:         container.Labels[prov.labels.serverName],
 		Address:            net.JoinHostPort(ip, port),
 	}, nil
 }
@@ -0,0 +1,345 @@
+package proxy
+
+import (
+	"cmp"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// The number of errors kept for the admin API.
+const maxRecentErrors = 100
+
+// AdminState is the state of the proxy returned by the admin API.
+type AdminState struct {
+	Providers    []AdminProvider `json:"providers"`
+	Servers      []AdminServer   `json:"servers"`
+	Services     []AdminService  `json:"services"`
+	RecentErrors []AdminError    `json:"recent_errors"`
+}
+
+type AdminProvider struct {
+	Name    string `json:"name"`
+	Servers int    `json:"servers"`
+}
+
+type AdminServer struct {
+	Address  string         `json:"address"`
+	Provider string         `json:"provider"`
+	Config   UpstreamConfig `json:"config"`
+
+	// ConnectionState is the state of the gRPC connection used for reflection, e.g. 'READY' or 'TRANSIENT_FAILURE'.
+	ConnectionState string `json:"connection_state"`
+
+	// ReflectionFailures is the number of consecutive failures to get the services of the server.
+	ReflectionFailures uint32 `json:"reflection_failures"`
+
+	// LastRefresh is the time the services were last received, if they were received.
+	LastRefresh *time.Time `json:"last_refresh,omitempty"`
+
+	// State is set using the admin API, StateSince is the time it was set unless the server is enabled.
+	State      ServerState `json:"state"`
+	StateSince *time.Time  `json:"state_since,omitempty"`
+
+	// InFlight is the number of calls currently forwarded to the server.
+	InFlight int64 `json:"in_flight"`
+
+	// Healthy is set if the server is enabled, its connection isn't failing and the last reflection request succeeded.
+	Healthy bool `json:"healthy"`
+
+	// Stats summarizes the calls of the last minute, for all servers with the address.
+	Stats CallStats `json:"stats"`
+
+	Services []string `json:"services"`
+}
+
+type AdminService struct {
+	Name string `json:"name"`
+
+	// Servers lists the addresses of the servers providing the service, in the order used for load balancing.
+	Servers []string `json:"servers"`
+
+	// Balancer is the load balancing strategy, NextServer the server that receives the next call.
+	Balancer   string `json:"balancer"`
+	NextServer string `json:"next_server,omitempty"`
+
+	// HealthyServers is the number of healthy servers providing the service, see [AdminServer].
+	HealthyServers int `json:"healthy_servers"`
+
+	// Stats summarizes the calls of the last minute, including calls that weren't forwarded.
+	Stats CallStats `json:"stats"`
+}
+
+type AdminError struct {
+	Time     time.Time `json:"time"`
+	Upstream string    `json:"upstream"`
+	Message  string    `json:"message"`
+}
+
+// errorLog keeps the most recent errors of upstream servers.
+type errorLog struct {
+	mutex  *sync.Mutex
+	max    int
+	errors []AdminError
+}
+
+func newErrorLog(max int) *errorLog {
+	return &errorLog{mutex: &sync.Mutex{}, max: max}
+}
+
+// add records an error, removing the oldest one if the log is full.
+func (l *errorLog) add(upstream, message string, err error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if len(l.errors) == l.max {
+		l.errors = slices.Delete(l.errors, 0, 1)
+	}
+	l.errors = append(l.errors, AdminError{Time: time.Now(), Upstream: upstream, Message: message + ": " + err.Error()})
+}
+
+// get returns the errors, newest first.
+func (l *errorLog) get() []AdminError {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	recent := make([]AdminError, 0, len(l.errors))
+	for i := len(l.errors) - 1; i >= 0; i-- {
+		recent = append(recent, l.errors[i])
+	}
+	return recent
+}
+
+// AdminState returns the current state of the proxy, sorted by provider, address and service name.
+func (p *Proxy) AdminState() AdminState {
+	p.serverMutex.RLock()
+	defer p.serverMutex.RUnlock()
+	p.servicesMutex.RLock()
+	defer p.servicesMutex.RUnlock()
+
+	servicesOfServer := make(map[*upstreamServer][]string)
+	services := make([]AdminService, 0, len(p.services))
+	for _, kv := range sortedKVs(p.services) {
+		service := AdminService{Name: kv.key, Servers: []string{}, Balancer: "round_robin", Stats: p.stats.service(kv.key)}
+		for _, server := range kv.value.servers {
+			service.Servers = append(service.Servers, server.config.Address)
+			servicesOfServer[server] = append(servicesOfServer[server], kv.key)
+			if p.serverHealthy(server) {
+				service.HealthyServers++
+			}
+		}
+		if len(kv.value.servers) != 0 {
+			// findServer increments the counter before selecting a server.
+			next := int(kv.value.next.Load() + 1)
+			service.NextServer = kv.value.servers[next%len(kv.value.servers)].config.Address
+		}
+		services = append(services, service)
+	}
+
+	providers := make([]AdminProvider, 0, len(p.servers))
+	servers := []AdminServer{}
+	for _, kv := range sortedKVs(p.servers) {
+		providers = append(providers, AdminProvider{Name: kv.key, Servers: len(kv.value)})
+
+		sorted := slices.Clone(kv.value)
+		slices.SortFunc(sorted, func(a, b *upstreamServer) int {
+			return cmp.Compare(a.config.Address, b.config.Address)
+		})
+		for _, server := range sorted {
+			servers = append(servers, p.serverAdminState(server, servicesOfServer[server]))
+		}
+	}
+
+	return AdminState{
+		Providers:    providers,
+		Servers:      servers,
+		Services:     services,
+		RecentErrors: p.recentErrors.get(),
+	}
+}
+
+func (p *Proxy) serverAdminState(server *upstreamServer, services []string) AdminServer {
+	state := AdminServer{
+		Address:            server.config.Address,
+		Provider:           server.provider,
+		Config:             server.config,
+		ConnectionState:    "IDLE",
+		ReflectionFailures: server.reflectionFailures.Load(),
+		InFlight:           server.inFlight.Load(),
+		Healthy:            p.serverHealthy(server),
+		Stats:              p.stats.upstream(server.config.Address),
+		Services:           services,
+	}
+	state.Stats.InFlight = state.InFlight
+	var since time.Time
+	if state.State, since = p.overrides.get(server.config.Address); !since.IsZero() {
+		state.StateSince = &since
+	}
+	if state.Services == nil {
+		state.Services = []string{}
+	}
+	if conn := server.conn.Load(); conn != nil {
+		state.ConnectionState = conn.GetState().String()
+	}
+	if lastRefresh := server.lastRefresh.Load(); lastRefresh != 0 {
+		t := time.Unix(0, lastRefresh)
+		state.LastRefresh = &t
+	}
+	return state
+}
+
+// AdminHandler serves the admin API, which returns the state of the proxy as JSON.
+//
+// The endpoints are /api/v1/state with the complete [AdminState],
+// and /api/v1/providers, /api/v1/servers, /api/v1/services and /api/v1/errors with its parts.
+// Servers are changed by POST requests to /api/v1/servers/{address}/drain with an optional timeout like '?timeout=30s',
+// /api/v1/servers/{address}/disable, /api/v1/servers/{address}/enable and /api/v1/servers/{address}/refresh,
+// which require the [ProxyConfig.AdminToken] as a bearer token, or a loopback client if it isn't set.
+func (p *Proxy) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/state", func(w http.ResponseWriter, r *http.Request) {
+		p.writeJSON(w, p.AdminState())
+	})
+	mux.HandleFunc("GET /api/v1/providers", func(w http.ResponseWriter, r *http.Request) {
+		p.writeJSON(w, p.AdminState().Providers)
+	})
+	mux.HandleFunc("GET /api/v1/servers", func(w http.ResponseWriter, r *http.Request) {
+		p.writeJSON(w, p.AdminState().Servers)
+	})
+	mux.HandleFunc("GET /api/v1/services", func(w http.ResponseWriter, r *http.Request) {
+		p.writeJSON(w, p.AdminState().Services)
+	})
+	mux.HandleFunc("GET /api/v1/errors", func(w http.ResponseWriter, r *http.Request) {
+		p.writeJSON(w, p.recentErrors.get())
+	})
+	mux.HandleFunc("POST /api/v1/servers/{address}/drain", p.adminOperation(func(address string, r *http.Request) error {
+		timeout := defaultDrainTimeout
+		if rawTimeout := r.URL.Query().Get("timeout"); rawTimeout != "" {
+			var err error
+			if timeout, err = time.ParseDuration(rawTimeout); err != nil || timeout < 0 {
+				return adminError{status: http.StatusBadRequest, message: "invalid timeout"}
+			}
+		}
+		return p.DrainServer(address, timeout)
+	}))
+	mux.HandleFunc("POST /api/v1/servers/{address}/disable", p.adminOperation(func(address string, r *http.Request) error {
+		return p.DisableServer(address)
+	}))
+	mux.HandleFunc("POST /api/v1/servers/{address}/enable", p.adminOperation(func(address string, r *http.Request) error {
+		return p.EnableServer(address)
+	}))
+	mux.HandleFunc("POST /api/v1/servers/{address}/refresh", p.adminOperation(func(address string, r *http.Request) error {
+		return p.RefreshServer(address)
+	}))
+	return mux
+}
+
+// The time in-flight calls of a drained server may take, if the request doesn't specify it.
+const defaultDrainTimeout = 30 * time.Second
+
+type adminError struct {
+	status  int
+	message string
+}
+
+func (e adminError) Error() string {
+	return e.message
+}
+
+// adminOperation creates the handler of an operation changing the server in the path.
+// The new state of the server is returned.
+func (p *Proxy) adminOperation(operation func(address string, r *http.Request) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !sameOrigin(r) {
+			p.writeAdminError(w, adminError{status: http.StatusForbidden, message: "cross-origin requests aren't allowed"})
+			return
+		}
+		if err := p.authorizeAdmin(w, r); err != nil {
+			p.writeAdminError(w, err)
+			return
+		}
+
+		address := r.PathValue("address")
+		if err := operation(address, r); err != nil {
+			p.writeAdminError(w, err)
+			return
+		}
+
+		for _, server := range p.AdminState().Servers {
+			if server.Address == address {
+				p.writeJSON(w, server)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// sameOrigin reports whether a request wasn't sent by a different website.
+// Browsers send the origin of cross-site requests, which must not change the state.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+// authorizeAdmin checks that a request may change the state of the servers.
+func (p *Proxy) authorizeAdmin(w http.ResponseWriter, r *http.Request) error {
+	if p.adminToken == "" {
+		if !isLoopback(r.RemoteAddr) {
+			return adminError{status: http.StatusForbidden, message: "server operations are only allowed from loopback addresses without an admin token"}
+		}
+		return nil
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(p.adminToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		return adminError{status: http.StatusUnauthorized, message: "invalid admin token"}
+	}
+	return nil
+}
+
+// isLoopback reports whether the host of an address is a loopback IP.
+func isLoopback(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (p *Proxy) writeAdminError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	var adminErr adminError
+	switch {
+	case errors.As(err, &adminErr):
+		status = adminErr.status
+	case errors.Is(err, errUnknownServer):
+		status = http.StatusNotFound
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
+
+func (p *Proxy) writeJSON(w http.ResponseWriter, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		p.logger.Debug("Failed to write admin response", zap.Error(err))
+	}
+}
@@ -0,0 +1,296 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/natk64/pancake-proxy/accesslog"
+	"github.com/natk64/pancake-proxy/record"
+	"github.com/natk64/pancake-proxy/tap"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/codes"
+)
+
+// Messages larger than this aren't captured for the access log, tap and recording.
+const maxCapturedMessageSize = 1 << 20
+
+// call records a single call handled by the proxy, for metrics and access logs.
+type call struct {
+	start    time.Time
+	protocol Protocol
+	service  string
+	method   string
+
+	// server is the upstream server the call was forwarded to, if any.
+	server *upstreamServer
+
+	// metricService and metricMethod are the labels of the call in the metrics, see [proxyMetrics.labels].
+	metricService string
+	metricMethod  string
+
+	// tap publishes the events of the call, if it's watched.
+	tap *tap.Call
+
+	// recording collects the call, if its method is recorded.
+	recording *record.Recording
+
+	// received counts the data received from the client, sent the data sent to the client.
+	received messageStats
+	sent     messageStats
+}
+
+type messageStats struct {
+	messages *atomic.Int64
+	bytes    *atomic.Int64
+
+	// payloads captures the first messages, if they are logged.
+	payloads *payloadCapture
+
+	// tap and recording receive every message, if the call is watched or recorded.
+	tap       *tap.Call
+	recording *record.Recording
+	request   bool
+}
+
+func newMessageStats(request bool) messageStats {
+	return messageStats{messages: &atomic.Int64{}, bytes: &atomic.Int64{}, request: request}
+}
+
+// capturing reports whether the next message of the size should be captured.
+// Compressed messages are only recorded, since they can't be decoded.
+func (s messageStats) capturing(compressed bool, size uint32) bool {
+	if size > maxCapturedMessageSize {
+		s.recording.Skipped()
+		return false
+	}
+	return s.recording.Accepts(int(size)) || (!compressed && (s.tap != nil || !s.payloads.full()))
+}
+
+// captured passes a complete message to the recording, access log and tap.
+func (s messageStats) captured(compressed bool, message []byte) {
+	s.recording.Message(s.request, compressed, message)
+	if compressed {
+		return
+	}
+
+	if !s.payloads.full() {
+		s.payloads.add(message)
+	}
+	s.tap.Message(s.request, message)
+}
+
+// payloadCapture keeps the first messages of one direction of a call.
+type payloadCapture struct {
+	mutex    *sync.Mutex
+	max      int
+	messages [][]byte
+}
+
+func newPayloadCapture(max int) *payloadCapture {
+	return &payloadCapture{mutex: &sync.Mutex{}, max: max}
+}
+
+// full reports whether no further messages are captured. It's safe to call on a nil capture.
+func (c *payloadCapture) full() bool {
+	if c == nil {
+		return true
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.messages) >= c.max
+}
+
+func (c *payloadCapture) add(message []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(c.messages) < c.max {
+		c.messages = append(c.messages, message)
+	}
+}
+
+func (c *payloadCapture) get() [][]byte {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return slices.Clone(c.messages)
+}
+
+func (p *Proxy) newCall(r *http.Request, service, method string) *call {
+	c := &call{
+		start:    time.Now(),
+		protocol: requestProtocol(r),
+		service:  service,
+		method:   method,
+		received: newMessageStats(true),
+		sent:     newMessageStats(false),
+	}
+
+	if p.accessLog != nil && p.accessLog.CapturesPayloads(c.fullMethod()) {
+		c.received.payloads = newPayloadCapture(p.accessLog.MaxPayloadMessages())
+		c.sent.payloads = newPayloadCapture(p.accessLog.MaxPayloadMessages())
+	}
+
+	if p.tap != nil {
+		c.tap = p.tap.Start(tap.CallInfo{
+			Method:    c.fullMethod(),
+			Protocol:  string(c.protocol),
+			Peer:      r.RemoteAddr,
+			UserAgent: r.UserAgent(),
+			Header:    r.Header,
+		})
+		c.received.tap = c.tap
+		c.sent.tap = c.tap
+	}
+
+	if p.recorder != nil {
+		c.recording = p.recorder.Start(c.fullMethod())
+		c.received.recording = c.recording
+		c.sent.recording = c.recording
+	}
+	return c
+}
+
+// fullMethod returns the full method name like '/package.Service/Method'.
+func (c *call) fullMethod() string {
+	return "/" + c.service + "/" + c.method
+}
+
+// upstream returns the address of the server the call was forwarded to, or an empty string.
+func (c *call) upstream() string {
+	if c.server == nil {
+		return ""
+	}
+	return c.server.config.Address
+}
+
+// finishCall records the end of a call in the metrics, statistics, access log, tap and recording.
+// r is the final request, after authentication.
+func (p *Proxy) finishCall(c *call, r *http.Request, code codes.Code) {
+	p.metrics.finish(c, code)
+	p.recordStats(c, code)
+	c.tap.Finish(c.upstream(), clientName(r), code, time.Since(c.start))
+	c.recording.Finish(code)
+
+	if p.accessLog == nil {
+		return
+	}
+
+	entry := accesslog.Entry{
+		Time:             c.start,
+		Peer:             r.RemoteAddr,
+		Client:           clientName(r),
+		Protocol:         string(c.protocol),
+		Method:           c.fullMethod(),
+		Upstream:         c.upstream(),
+		Code:             code,
+		Duration:         time.Since(c.start),
+		BytesReceived:    c.received.bytes.Load(),
+		MessagesReceived: c.received.messages.Load(),
+		BytesSent:        c.sent.bytes.Load(),
+		MessagesSent:     c.sent.messages.Load(),
+		UserAgent:        r.UserAgent(),
+	}
+	if c.server != nil {
+		entry.Provider = c.server.provider
+	}
+	if c.received.payloads != nil {
+		entry.Requests = p.decodePayloads(c, true, c.received.payloads.get())
+		entry.Responses = p.decodePayloads(c, false, c.sent.payloads.get())
+	}
+	p.accessLog.Log(entry)
+}
+
+func (p *Proxy) decodePayloads(c *call, request bool, messages [][]byte) []string {
+	decoded := make([]string, 0, len(messages))
+	for _, message := range messages {
+		decoded = append(decoded, p.accessLog.DecodePayload(p.reflectionResolver, c.fullMethod(), request, message))
+	}
+	return decoded
+}
+
+// responseCode returns the gRPC status code written to the response headers, or Unknown if there is none.
+func responseCode(header http.Header) codes.Code {
+	rawCode := header.Get("Grpc-Status")
+	if rawCode == "" {
+		rawCode = header.Get(http.TrailerPrefix + "Grpc-Status")
+	}
+	if code, err := strconv.Atoi(rawCode); err == nil {
+		return codes.Code(code)
+	}
+	return codes.Unknown
+}
+
+// messageCounter counts the bytes and length prefixed gRPC messages read from a body.
+type messageCounter struct {
+	io.ReadCloser
+	stats messageStats
+
+	// counter is incremented for every message, if set.
+	counter prometheus.Counter
+
+	header    [5]byte
+	headerLen int
+
+	// remaining is the number of bytes left of the current message.
+	remaining uint32
+
+	// current is the content of the current message, if it's captured.
+	current    []byte
+	compressed bool
+}
+
+func (c *messageCounter) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.stats.bytes.Add(int64(n))
+
+	data := p[:n]
+	for len(data) != 0 {
+		if c.remaining > 0 {
+			skip := min(c.remaining, uint32(len(data)))
+			if c.current != nil {
+				c.current = append(c.current, data[:skip]...)
+			}
+			c.remaining -= skip
+			data = data[skip:]
+			if c.remaining == 0 {
+				c.captured()
+			}
+			continue
+		}
+
+		copied := copy(c.header[c.headerLen:], data)
+		c.headerLen += copied
+		data = data[copied:]
+		if c.headerLen == len(c.header) {
+			c.stats.messages.Add(1)
+			if c.counter != nil {
+				c.counter.Inc()
+			}
+			c.remaining = binary.BigEndian.Uint32(c.header[1:])
+			c.headerLen = 0
+
+			compressed := c.header[0]&1 != 0
+			if c.stats.capturing(compressed, c.remaining) {
+				c.current = make([]byte, 0, c.remaining)
+				c.compressed = compressed
+				if c.remaining == 0 {
+					c.captured()
+				}
+			}
+		}
+	}
+	return n, err
+}
+
+// captured is called once the current message was read completely.
+func (c *messageCounter) captured() {
+	if c.current != nil {
+		c.stats.captured(c.compressed, c.current)
+		c.current = nil
+	}
+}
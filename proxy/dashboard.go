@@ -6,30 +6,51 @@ import (
 	"html/template"
 	"net/http"
 	"slices"
+	"strconv"
+	"time"
 
+	"github.com/natk64/pancake-proxy/ratelimit"
 	"go.uber.org/zap"
 )
 
 //go:embed dashboard/index.html
 var dashboardTemplateContent string
-var dashboardTemplate = template.Must(template.New("index.html").Parse(dashboardTemplateContent))
+var dashboardTemplate = template.Must(template.New("index.html").Funcs(template.FuncMap{
+	"percent": func(fraction float64) string { return strconv.FormatFloat(fraction*100, 'f', 1, 64) + "%" },
+}).Parse(dashboardTemplateContent))
+
+//go:embed dashboard/tap.html
+var tapPageContent []byte
 
 type DashboardServerInfo struct {
-	Config   UpstreamConfig
-	Provider string
-	Services []*DashboardServiceInfo
+	Config          UpstreamConfig
+	Provider        string
+	State           ServerState
+	InFlight        int64
+	Healthy         bool
+	ConnectionState string
+	LastRefresh     time.Time
+	Stats           CallStats
+	Services        []*DashboardServiceInfo
 }
 
 type DashboardServiceInfo struct {
-	Name    string
-	Servers []*DashboardServerInfo
+	Name           string
+	Servers        []*DashboardServerInfo
+	HealthyServers int
+	Stats          CallStats
 }
 
 type DashboardContext struct {
 	ReflectionDisabled bool
+	TapEnabled         bool
+	ExplorerEnabled    bool
 	Services           []*DashboardServiceInfo
 	Servers            []*DashboardServerInfo
 	UnknownServer      *DashboardServerInfo
+	RateLimits         []ratelimit.RuleStats
+	UpstreamLimits     []ratelimit.ConcurrencyStats
+	ServiceLimits      []ratelimit.ConcurrencyStats
 }
 
 var unknownServer = &DashboardServerInfo{Config: UpstreamConfig{Address: "INVALID SERVER"}}
@@ -44,9 +65,22 @@ func (p *Proxy) DashboardContext() DashboardContext {
 
 	for _, servers := range p.servers {
 		for _, server := range servers {
+			state, _ := p.overrides.get(server.config.Address)
 			info := &DashboardServerInfo{
-				Config:   server.config,
-				Provider: server.provider,
+				Config:          server.config,
+				Provider:        server.provider,
+				State:           state,
+				InFlight:        server.inFlight.Load(),
+				Healthy:         p.serverHealthy(server),
+				ConnectionState: "IDLE",
+				Stats:           p.stats.upstream(server.config.Address),
+			}
+			info.Stats.InFlight = info.InFlight
+			if conn := server.conn.Load(); conn != nil {
+				info.ConnectionState = conn.GetState().String()
+			}
+			if lastRefresh := server.lastRefresh.Load(); lastRefresh != 0 {
+				info.LastRefresh = time.Unix(0, lastRefresh)
 			}
 
 			serverMap[server] = info
@@ -67,6 +101,7 @@ func (p *Proxy) DashboardContext() DashboardContext {
 		serviceInfo := &DashboardServiceInfo{
 			Name:    serviceName,
 			Servers: make([]*DashboardServerInfo, len(service.servers)),
+			Stats:   p.stats.service(serviceName),
 		}
 
 		for i, server := range service.servers {
@@ -80,16 +115,34 @@ func (p *Proxy) DashboardContext() DashboardContext {
 
 			serviceInfo.Servers[i] = serverInfo
 			serverInfo.Services = append(serverInfo.Services, serviceInfo)
+			if serverInfo.Healthy {
+				serviceInfo.HealthyServers++
+			}
 		}
 
 		serviceList = append(serviceList, serviceInfo)
 	}
 
+	var rateLimits []ratelimit.RuleStats
+	if p.rateLimiter != nil {
+		rateLimits = p.rateLimiter.Stats()
+	}
+
+	var upstreamLimits, serviceLimits []ratelimit.ConcurrencyStats
+	if p.concurrencyLimits != nil {
+		upstreamLimits, serviceLimits = p.concurrencyLimits.Stats()
+	}
+
 	return DashboardContext{
 		ReflectionDisabled: p.disableReflectionService,
+		TapEnabled:         p.tap != nil,
+		ExplorerEnabled:    p.enableExplorer,
 		Services:           serviceList,
 		Servers:            serverList,
 		UnknownServer:      unknownServer,
+		RateLimits:         rateLimits,
+		UpstreamLimits:     upstreamLimits,
+		ServiceLimits:      serviceLimits,
 	}
 }
 
@@ -101,6 +154,25 @@ func (p *Proxy) DashboardHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// DashboardLiveHandler serves the part of the dashboard that is updated periodically by the page.
+func (p *Proxy) DashboardLiveHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	if err := dashboardTemplate.ExecuteTemplate(w, "live", p.DashboardContext()); err != nil {
+		p.logger.Error("Failed to execute dashboard template", zap.Error(err))
+		w.WriteHeader(500)
+	}
+}
+
+// TapPageHandler serves the page watching live calls using the tap, see [Proxy.TapServer].
+func (p *Proxy) TapPageHandler(w http.ResponseWriter, r *http.Request) {
+	if p.tap == nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(tapPageContent)
+}
+
 type kv[K, V any] struct {
 	key   K
 	value V
@@ -0,0 +1,404 @@
+package proxy
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/natk64/pancake-proxy/reflection"
+	"go.uber.org/zap"
+	"golang.org/x/net/http2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+//go:embed dashboard/explorer.html
+var explorerPageContent []byte
+
+// ExplorerService is a service listed by the method explorer.
+type ExplorerService struct {
+	Name    string           `json:"name"`
+	Methods []ExplorerMethod `json:"methods"`
+}
+
+type ExplorerMethod struct {
+	Name string `json:"name"`
+
+	// Path is the full method name like '/package.Service/Method'.
+	Path string `json:"path"`
+
+	// Input and Output are the full names of the message types, see [ExplorerMessage].
+	Input           string `json:"input"`
+	Output          string `json:"output"`
+	ClientStreaming bool   `json:"client_streaming"`
+	ServerStreaming bool   `json:"server_streaming"`
+}
+
+// ExplorerMessage describes the fields of a message type, so the explorer can build a form for it.
+type ExplorerMessage struct {
+	Name   string          `json:"name"`
+	Fields []ExplorerField `json:"fields"`
+}
+
+type ExplorerField struct {
+	// Name is the JSON name of the field.
+	Name string `json:"name"`
+
+	// Type is the protobuf type like 'string', 'int64', 'enum' or 'message', or 'map'.
+	// Well-known types like google.protobuf.Timestamp have the type 'json', since their JSON isn't an object of their fields.
+	Type     string `json:"type"`
+	Repeated bool   `json:"repeated,omitempty"`
+
+	// Oneof is the name of the oneof containing the field, if any.
+	Oneof string `json:"oneof,omitempty"`
+
+	// Message is the full name of the message type, Enum the names of the enum values.
+	Message string   `json:"message,omitempty"`
+	Enum    []string `json:"enum,omitempty"`
+
+	// Key and Value describe the entries of map fields.
+	Key   string         `json:"key,omitempty"`
+	Value *ExplorerField `json:"value,omitempty"`
+}
+
+// ExplorerServices is the response listing the services of the explorer.
+type ExplorerServices struct {
+	Services []ExplorerService `json:"services"`
+
+	// Messages contains the input messages of all methods and the messages used by their fields.
+	Messages map[string]ExplorerMessage `json:"messages"`
+}
+
+// ExplorerRequest invokes a method using the explorer.
+type ExplorerRequest struct {
+	Method   string              `json:"method"`
+	Metadata map[string][]string `json:"metadata"`
+
+	// Messages are the request messages as JSON. Methods without client streaming require exactly one.
+	Messages []json.RawMessage `json:"messages"`
+}
+
+// ExplorerEvent is a line of the response to an [ExplorerRequest], which is streamed as newline delimited JSON.
+// Exactly one field is set.
+type ExplorerEvent struct {
+	Header  map[string][]string `json:"header,omitempty"`
+	Message json.RawMessage     `json:"message,omitempty"`
+	Status  *ExplorerStatus     `json:"status,omitempty"`
+}
+
+type ExplorerStatus struct {
+	Code    string              `json:"code"`
+	Message string              `json:"message,omitempty"`
+	Details []json.RawMessage   `json:"details,omitempty"`
+	Trailer map[string][]string `json:"trailer,omitempty"`
+}
+
+// explorerAddr is the peer address of calls made by the explorer, which is the address of the dashboard client.
+// Policies, rate limits and access logs see the client that used the explorer.
+type explorerAddr string
+
+func (explorerAddr) Network() string  { return "pipe" }
+func (a explorerAddr) String() string { return string(a) }
+
+type explorerConn struct {
+	net.Conn
+	remoteAddr explorerAddr
+}
+
+func (c explorerConn) RemoteAddr() net.Addr { return c.remoteAddr }
+
+// explorerClientConn creates a connection that sends calls to the listener in memory,
+// with the address of the dashboard client as the peer address.
+func explorerClientConn(listener http.Handler, remoteAddr string) (*grpc.ClientConn, error) {
+	server := &http2.Server{}
+	dial := func(ctx context.Context, _ string) (net.Conn, error) {
+		client, proxySide := net.Pipe()
+		conn := explorerConn{Conn: proxySide, remoteAddr: explorerAddr(remoteAddr)}
+		go server.ServeConn(conn, &http2.ServeConnOpts{Context: context.Background(), Handler: listener})
+		return client, nil
+	}
+	return grpc.NewClient("passthrough:///pancake", grpc.WithContextDialer(dial), grpc.WithTransportCredentials(insecure.NewCredentials()))
+}
+
+// ExplorerHandler serves the method explorer, which calls methods through the proxy like grpcui.
+// It responds with 404 if the explorer is disabled.
+//
+// Calls are handled like gRPC calls received by a listener with the specified config,
+// so the explorer only lists and calls the services exposed by the listener.
+//
+// The page is served at /explorer, the services and their messages at /explorer/services,
+// and methods are invoked by POST requests to /explorer/invoke with an [ExplorerRequest].
+func (p *Proxy) ExplorerHandler(config ListenerConfig) http.Handler {
+	if !p.enableExplorer {
+		return http.NotFoundHandler()
+	}
+
+	listener := p.Handler(config).(*listenerHandler)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /explorer", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(explorerPageContent)
+	})
+	mux.HandleFunc("GET /explorer/services", func(w http.ResponseWriter, r *http.Request) {
+		p.writeJSON(w, p.explorerServices(listener))
+	})
+	mux.HandleFunc("POST /explorer/invoke", func(w http.ResponseWriter, r *http.Request) {
+		p.invokeExplorerRequest(listener, w, r)
+	})
+	return mux
+}
+
+// explorerServices lists the services provided by the upstream servers and exposed by the listener,
+// with the descriptors received through reflection.
+func (p *Proxy) explorerServices(listener *listenerHandler) ExplorerServices {
+	p.servicesMutex.RLock()
+	names := make([]string, 0, len(p.services))
+	for _, kv := range sortedKVs(p.services) {
+		if listener.exposesService(kv.key) {
+			names = append(names, kv.key)
+		}
+	}
+	p.servicesMutex.RUnlock()
+
+	result := ExplorerServices{Services: []ExplorerService{}, Messages: make(map[string]ExplorerMessage)}
+	for _, name := range names {
+		d, err := p.reflectionResolver.FindDescriptorByName(protoreflect.FullName(name))
+		if err != nil {
+			continue
+		}
+		serviceDescriptor, ok := d.(protoreflect.ServiceDescriptor)
+		if !ok {
+			continue
+		}
+
+		service := ExplorerService{Name: name, Methods: []ExplorerMethod{}}
+		methods := serviceDescriptor.Methods()
+		for i := range methods.Len() {
+			method := methods.Get(i)
+			service.Methods = append(service.Methods, ExplorerMethod{
+				Name:            string(method.Name()),
+				Path:            "/" + name + "/" + string(method.Name()),
+				Input:           string(method.Input().FullName()),
+				Output:          string(method.Output().FullName()),
+				ClientStreaming: method.IsStreamingClient(),
+				ServerStreaming: method.IsStreamingServer(),
+			})
+			addExplorerMessage(result.Messages, method.Input())
+		}
+		result.Services = append(result.Services, service)
+	}
+	return result
+}
+
+// addExplorerMessage adds a message and the messages of its fields.
+func addExplorerMessage(messages map[string]ExplorerMessage, descriptor protoreflect.MessageDescriptor) {
+	name := string(descriptor.FullName())
+	if _, ok := messages[name]; ok || isWellKnownType(descriptor) {
+		return
+	}
+
+	message := ExplorerMessage{Name: name, Fields: []ExplorerField{}}
+	// Recursive messages are only added once.
+	messages[name] = message
+
+	fields := descriptor.Fields()
+	for i := range fields.Len() {
+		field := fields.Get(i)
+		explorerField := newExplorerField(messages, field)
+		explorerField.Repeated = field.IsList()
+		if oneof := field.ContainingOneof(); oneof != nil && !oneof.IsSynthetic() {
+			explorerField.Oneof = string(oneof.Name())
+		}
+		if field.IsMap() {
+			value := newExplorerField(messages, field.MapValue())
+			explorerField.Type = "map"
+			explorerField.Message = ""
+			explorerField.Enum = nil
+			explorerField.Key = field.MapKey().Kind().String()
+			explorerField.Value = &value
+		}
+		message.Fields = append(message.Fields, explorerField)
+	}
+	messages[name] = message
+}
+
+func newExplorerField(messages map[string]ExplorerMessage, field protoreflect.FieldDescriptor) ExplorerField {
+	explorerField := ExplorerField{Name: field.JSONName(), Type: field.Kind().String()}
+	switch field.Kind() {
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		explorerField.Type = "message"
+		explorerField.Message = string(field.Message().FullName())
+		if isWellKnownType(field.Message()) {
+			explorerField.Type = "json"
+		} else if !field.IsMap() {
+			addExplorerMessage(messages, field.Message())
+		}
+	case protoreflect.EnumKind:
+		values := field.Enum().Values()
+		for i := range values.Len() {
+			explorerField.Enum = append(explorerField.Enum, string(values.Get(i).Name()))
+		}
+	}
+	return explorerField
+}
+
+// isWellKnownType reports whether a message has a special JSON encoding, like google.protobuf.Timestamp.
+func isWellKnownType(descriptor protoreflect.MessageDescriptor) bool {
+	return descriptor.ParentFile().Package() == "google.protobuf" && descriptor.Name() != "Empty"
+}
+
+func (p *Proxy) invokeExplorerRequest(listener *listenerHandler, w http.ResponseWriter, r *http.Request) {
+	if !sameOrigin(r) {
+		p.writeAdminError(w, adminError{status: http.StatusForbidden, message: "cross-origin requests aren't allowed"})
+		return
+	}
+
+	var request ExplorerRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		p.writeAdminError(w, adminError{status: http.StatusBadRequest, message: "invalid request: " + err.Error()})
+		return
+	}
+
+	method, messages, err := p.explorerMessages(request)
+	if err != nil {
+		p.writeAdminError(w, adminError{status: http.StatusBadRequest, message: err.Error()})
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	conn, err := explorerClientConn(listener, r.RemoteAddr)
+	if err != nil {
+		p.logger.Error("Failed to create explorer connection", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	encoder := json.NewEncoder(w)
+	send := func(event ExplorerEvent) error {
+		if err := encoder.Encode(event); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+
+	trailer, err := p.invokeExplorerMethod(r.Context(), conn, method, request.Metadata, messages, send)
+	st := status.Convert(err)
+	result := ExplorerStatus{Code: st.Code().String(), Message: st.Message(), Trailer: trailer}
+	marshal := protojson.MarshalOptions{Resolver: reflection.TypeResolver{Files: p.reflectionResolver}}
+	for _, detail := range st.Proto().GetDetails() {
+		encoded, err := marshal.Marshal(detail)
+		if err != nil {
+			// The type of the detail is unknown.
+			encoded, _ = json.Marshal(map[string]string{"@type": detail.GetTypeUrl()})
+		}
+		result.Details = append(result.Details, encoded)
+	}
+	send(ExplorerEvent{Status: &result})
+}
+
+// explorerMessages decodes the request messages of an [ExplorerRequest].
+func (p *Proxy) explorerMessages(request ExplorerRequest) (protoreflect.MethodDescriptor, []*dynamicpb.Message, error) {
+	method, err := reflection.FindMethod(p.reflectionResolver, request.Method)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unknown method '%s'", request.Method)
+	}
+	if !method.IsStreamingClient() && len(request.Messages) != 1 {
+		return nil, nil, fmt.Errorf("the method requires exactly one request message, got %d", len(request.Messages))
+	}
+
+	unmarshal := protojson.UnmarshalOptions{Resolver: reflection.TypeResolver{Files: p.reflectionResolver}}
+	messages := make([]*dynamicpb.Message, 0, len(request.Messages))
+	for i, raw := range request.Messages {
+		message := dynamicpb.NewMessage(method.Input())
+		if err := unmarshal.Unmarshal(raw, message); err != nil {
+			return nil, nil, fmt.Errorf("invalid request message %d: %w", i+1, err)
+		}
+		messages = append(messages, message)
+	}
+	return method, messages, nil
+}
+
+// invokeExplorerMethod calls a method through the proxy and sends the response header and messages as events.
+// It returns the response trailer and the status of the call as error.
+func (p *Proxy) invokeExplorerMethod(
+	ctx context.Context,
+	conn *grpc.ClientConn,
+	method protoreflect.MethodDescriptor,
+	md map[string][]string,
+	messages []*dynamicpb.Message,
+	send func(ExplorerEvent) error,
+) (metadata.MD, error) {
+	outgoing := metadata.MD{}
+	for name, values := range md {
+		outgoing.Append(strings.ToLower(name), values...)
+	}
+	ctx, cancel := context.WithCancel(metadata.NewOutgoingContext(ctx, outgoing))
+	defer cancel()
+
+	path := "/" + string(method.Parent().FullName()) + "/" + string(method.Name())
+	stream, err := conn.NewStream(ctx, &grpc.StreamDesc{
+		ClientStreams: method.IsStreamingClient(),
+		ServerStreams: method.IsStreamingServer(),
+	}, path)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, message := range messages {
+		if err := stream.SendMsg(message); err != nil {
+			// The status is returned by RecvMsg.
+			break
+		}
+	}
+	if err := stream.CloseSend(); err != nil {
+		return nil, err
+	}
+
+	if header, err := stream.Header(); err == nil && len(header) != 0 {
+		if err := send(ExplorerEvent{Header: header}); err != nil {
+			return nil, err
+		}
+	}
+
+	marshal := protojson.MarshalOptions{Resolver: reflection.TypeResolver{Files: p.reflectionResolver}}
+	for {
+		response := dynamicpb.NewMessage(method.Output())
+		err := stream.RecvMsg(response)
+		if errors.Is(err, io.EOF) {
+			return stream.Trailer(), nil
+		}
+		if err != nil {
+			return stream.Trailer(), err
+		}
+
+		encoded, err := marshal.Marshal(response)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to encode response: %v", err)
+		}
+		if err := send(ExplorerEvent{Message: encoded}); err != nil {
+			return nil, err
+		}
+	}
+}
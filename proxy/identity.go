@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"github.com/natk64/pancake-proxy/auth"
+	"github.com/natk64/pancake-proxy/ratelimit"
+)
+
+// ClientIdentity describes the verified certificate a client presented when connecting to the proxy.
+type ClientIdentity struct {
+	Subject        string
+	DNSNames       []string
+	URIs           []string
+	EmailAddresses []string
+
+	// SPIFFEID is the first URI SAN using the spiffe scheme, if any.
+	SPIFFEID string
+
+	// Hash is the hex encoded SHA-256 hash of the DER encoded certificate.
+	Hash string
+}
+
+const headerForwardedClientCert = "X-Forwarded-Client-Cert"
+
+type clientIdentityContextKey struct{}
+
+// ClientIdentityFromContext returns the identity of the client that sent the request the context belongs to.
+// It returns nil if the client didn't present a verified certificate.
+func ClientIdentityFromContext(ctx context.Context) *ClientIdentity {
+	identity, _ := ctx.Value(clientIdentityContextKey{}).(*ClientIdentity)
+	return identity
+}
+
+// clientIdentityFromTLS returns the identity of the client, if it presented a certificate that has been verified.
+func clientIdentityFromTLS(state *tls.ConnectionState) *ClientIdentity {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+
+	cert := state.VerifiedChains[0][0]
+	hash := sha256.Sum256(cert.Raw)
+	identity := &ClientIdentity{
+		Subject:        cert.Subject.String(),
+		DNSNames:       cert.DNSNames,
+		EmailAddresses: cert.EmailAddresses,
+		Hash:           hex.EncodeToString(hash[:]),
+	}
+
+	for _, uri := range cert.URIs {
+		identity.URIs = append(identity.URIs, uri.String())
+		if uri.Scheme == "spiffe" && identity.SPIFFEID == "" {
+			identity.SPIFFEID = uri.String()
+		}
+	}
+
+	return identity
+}
+
+// forwardedClientCert formats the identity like Envoy's x-forwarded-client-cert header.
+func (identity *ClientIdentity) forwardedClientCert() string {
+	parts := []string{"Hash=" + identity.Hash}
+	if identity.Subject != "" {
+		parts = append(parts, `Subject="`+strings.ReplaceAll(identity.Subject, `"`, `\"`)+`"`)
+	}
+	for _, uri := range identity.URIs {
+		parts = append(parts, "URI="+uri)
+	}
+	for _, name := range identity.DNSNames {
+		parts = append(parts, "DNS="+name)
+	}
+	return strings.Join(parts, ";")
+}
+
+// withClientIdentity adds the identity of the client to the request context
+// and replaces the x-forwarded-client-cert header, which must never be trusted when sent by the client.
+func withClientIdentity(r *http.Request) *http.Request {
+	r.Header.Del(headerForwardedClientCert)
+
+	identity := clientIdentityFromTLS(r.TLS)
+	if identity == nil {
+		return r
+	}
+
+	r.Header.Set(headerForwardedClientCert, identity.forwardedClientCert())
+	return r.WithContext(context.WithValue(r.Context(), clientIdentityContextKey{}, identity))
+}
+
+// requestPeer describes the client of a request for authorization services.
+func requestPeer(r *http.Request) auth.Peer {
+	peer := auth.Peer{Address: r.RemoteAddr}
+	if identity := ClientIdentityFromContext(r.Context()); identity != nil {
+		peer.Principal = identity.SPIFFEID
+		if peer.Principal == "" {
+			peer.Principal = identity.Subject
+		}
+	}
+	return peer
+}
+
+// policyInput returns the attributes of a request that policies are evaluated against.
+func policyInput(r *http.Request) auth.PolicyInput {
+	input := auth.PolicyInput{
+		Method:   r.URL.Path,
+		SourceIP: auth.RemoteIP(r.RemoteAddr),
+		Headers:  r.Header,
+	}
+
+	if identity := ClientIdentityFromContext(r.Context()); identity != nil {
+		input.Principals = append(input.Principals, identity.Subject)
+		input.Principals = append(input.Principals, identity.URIs...)
+		input.Principals = append(input.Principals, identity.DNSNames...)
+		input.Principals = append(input.Principals, identity.EmailAddresses...)
+	}
+
+	if claims, ok := auth.JWTClaimsFromContext(r.Context()); ok {
+		input.Claims = claims
+	}
+
+	if client, ok := auth.APIKeyClientFromContext(r.Context()); ok {
+		input.APIKeyClient = client
+	}
+
+	return input
+}
+
+// clientName identifies the client of a request using the API key, the JWT subject or the client certificate, in this order.
+// It returns an empty string if the client didn't authenticate.
+func clientName(r *http.Request) string {
+	if client, ok := auth.APIKeyClientFromContext(r.Context()); ok {
+		return client
+	}
+
+	if claims, ok := auth.JWTClaimsFromContext(r.Context()); ok {
+		if subject, _ := claims.GetSubject(); subject != "" {
+			return subject
+		}
+	}
+
+	if identity := ClientIdentityFromContext(r.Context()); identity != nil {
+		if identity.SPIFFEID != "" {
+			return identity.SPIFFEID
+		}
+		return identity.Subject
+	}
+
+	return ""
+}
+
+// rateLimitRequest describes a request for rate limiters.
+func rateLimitRequest(r *http.Request) ratelimit.Request {
+	return ratelimit.Request{
+		Method: r.URL.Path,
+		Client: clientName(r),
+		IP:     auth.RemoteIP(r.RemoteAddr).String(),
+		Header: r.Header,
+	}
+}
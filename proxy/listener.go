@@ -0,0 +1,302 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"github.com/natk64/pancake-proxy/connect"
+	"github.com/natk64/pancake-proxy/grpcweb"
+	"github.com/natk64/pancake-proxy/sse"
+	"google.golang.org/grpc/codes"
+)
+
+// Protocol is a protocol that clients can use to call services through the proxy.
+type Protocol string
+
+const (
+	ProtocolGrpc    Protocol = "grpc"
+	ProtocolGrpcWeb Protocol = "grpc_web"
+	ProtocolConnect Protocol = "connect"
+
+	// ProtocolWebsockets is gRPC-Web over WebSockets, see [grpcweb.ServeWebsocket].
+	ProtocolWebsockets Protocol = "websockets"
+
+	// ProtocolSSE allows invoking server streaming methods using Server-Sent Events,
+	// with GET requests to /sse/<service>/<method>, see [sse.Serve].
+	ProtocolSSE Protocol = "sse"
+
+	// ProtocolREST translates requests to methods with google.api.http annotations, see [rest.Serve].
+	ProtocolREST Protocol = "rest"
+)
+
+// DefaultProtocols are the protocols accepted by a listener that doesn't specify any.
+var DefaultProtocols = []Protocol{ProtocolGrpc, ProtocolGrpcWeb, ProtocolConnect}
+
+// AllProtocols contains every protocol supported by the proxy.
+var AllProtocols = []Protocol{ProtocolGrpc, ProtocolGrpcWeb, ProtocolConnect, ProtocolWebsockets, ProtocolSSE, ProtocolREST}
+
+const ssePathPrefix = "/sse/"
+
+// ListenerConfig controls which requests are accepted by the handler of a single listener.
+type ListenerConfig struct {
+	// Protocols lists the accepted protocols.
+	// The default is [DefaultProtocols].
+	Protocols []Protocol
+
+	// Services restricts which services can be called through the listener.
+	// The reflection service only lists these services.
+	// If it's empty, all services are exposed.
+	Services []string
+
+	// WebsocketOriginCheck decides which origins are allowed to open WebSocket connections.
+	// If it's nil, only requests from the same origin are accepted.
+	WebsocketOriginCheck func(r *http.Request) bool
+}
+
+type listenerHandler struct {
+	proxy     *Proxy
+	config    ListenerConfig
+	protocols map[Protocol]bool
+	services  map[string]bool
+
+	restRoutes *atomic.Pointer[restRoutes]
+}
+
+type listenerContextKey struct{}
+
+// Handler returns the http.Handler for a listener using the specified config.
+// Multiple handlers with different configs can be used with the same proxy.
+func (p *Proxy) Handler(config ListenerConfig) http.Handler {
+	if config.Protocols == nil {
+		config.Protocols = DefaultProtocols
+	}
+
+	l := &listenerHandler{
+		proxy:     p,
+		config:    config,
+		protocols: make(map[Protocol]bool),
+
+		restRoutes: &atomic.Pointer[restRoutes]{},
+	}
+
+	for _, protocol := range config.Protocols {
+		l.protocols[protocol] = true
+	}
+
+	if len(config.Services) != 0 {
+		l.services = make(map[string]bool)
+		for _, service := range config.Services {
+			l.services[service] = true
+		}
+	}
+
+	return l
+}
+
+// listenerFromContext returns the listener that accepted the request the context belongs to.
+func listenerFromContext(ctx context.Context) *listenerHandler {
+	l, _ := ctx.Value(listenerContextKey{}).(*listenerHandler)
+	return l
+}
+
+// exposesService returns true if the service can be called through this listener.
+func (l *listenerHandler) exposesService(name string) bool {
+	return l == nil || l.services == nil || l.services[name]
+}
+
+// ServeHTTP implements the http.Handler interface.
+// This method is the entrypoint for all requests into the proxy.
+func (l *listenerHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r = r.WithContext(context.WithValue(r.Context(), listenerContextKey{}, l))
+
+	if grpcweb.IsWebsocketRequest(r) && l.protocols[ProtocolWebsockets] {
+		// The bridged request is a regular gRPC-Web request.
+		grpcweb.ServeWebsocket(w, r, l.config.WebsocketOriginCheck, http.HandlerFunc(l.serveCall))
+		return
+	}
+
+	if r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, ssePathPrefix) && l.protocols[ProtocolSSE] {
+		sse.Serve(w, r, strings.TrimPrefix(r.URL.Path, ssePathPrefix), l.proxy.reflectionResolver, http.HandlerFunc(l.serveCall))
+		return
+	}
+
+	if l.protocols[ProtocolREST] && l.serveREST(w, r) {
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if protocol := requestProtocol(r); !l.protocols[protocol] {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		fmt.Fprintf(w, "protocol %s is not enabled", protocol)
+		return
+	}
+
+	l.serveCall(w, r)
+}
+
+// requestProtocol determines the protocol of a POST request by its content type.
+func requestProtocol(r *http.Request) Protocol {
+	switch {
+	case strings.HasPrefix(r.Header.Get("Content-Type"), grpcweb.ContentTypeGrpcWeb):
+		return ProtocolGrpcWeb
+	case connect.IsConnectRequest(r):
+		return ProtocolConnect
+	default:
+		return ProtocolGrpc
+	}
+}
+
+// serveCall handles a gRPC call using any of the POST based protocols.
+// Bridged protocols call this directly with the translated request.
+func (l *listenerHandler) serveCall(w http.ResponseWriter, r *http.Request) {
+	p := l.proxy
+	r = withClientIdentity(r)
+
+	serviceName, ok := getTargetService(r)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "malformed request url")
+		return
+	}
+
+	// forwarded is set once the upstream server responded, since its status may not be in the headers.
+	var forwarded *forwardResult
+	methodName := getTargetMethod(r)
+	c := p.newCall(r, serviceName, methodName)
+	r, span := p.startServerSpan(r, serviceName, methodName)
+	defer func() {
+		code := responseCode(w.Header())
+		if forwarded != nil {
+			code = forwarded.code
+		}
+		p.finishCall(c, r, code)
+		endSpan(span, code)
+	}()
+
+	var wrapErr error
+	switch requestProtocol(r) {
+	case ProtocolGrpcWeb:
+		w, r = grpcweb.WrapRequest(w, r)
+	case ProtocolConnect:
+		w, r, wrapErr = connect.WrapRequest(w, r, p.reflectionResolver, p.connectMaxMessageSize)
+	}
+
+	if f, ok := w.(grpcweb.Finisher); ok {
+		defer f.Finish()
+	}
+
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message, Grpc-Status-Details-Bin")
+
+	if wrapErr != nil {
+		writeGrpcError(w, wrapErr)
+		return
+	}
+
+	if p.jwtAuthenticator != nil {
+		authenticated, err := p.jwtAuthenticator.Authenticate(r, r.URL.Path)
+		if err != nil {
+			writeGrpcError(w, err)
+			return
+		}
+		r = authenticated
+	}
+
+	if p.apiKeyAuthenticator != nil {
+		authenticated, err := p.apiKeyAuthenticator.Authenticate(r, r.URL.Path)
+		if err != nil {
+			writeGrpcError(w, err)
+			return
+		}
+		r = authenticated
+	}
+
+	// The reflection service is subject to the policies like any other service.
+	if p.policyEngine != nil {
+		if err := p.policyEngine.Authorize(policyInput(r)); err != nil {
+			writeGrpcError(w, err)
+			return
+		}
+	}
+
+	if p.handleReflection(w, r, serviceName) {
+		return
+	}
+
+	if !l.exposesService(serviceName) {
+		writeGrpcStatus(w, codes.Unimplemented, "no server provides the service")
+		return
+	}
+
+	if p.rateLimiter != nil {
+		if retryAfter, ok := p.rateLimiter.Allow(rateLimitRequest(r)); !ok {
+			setRetryAfter(w, retryAfter)
+			writeGrpcStatus(w, codes.ResourceExhausted, "rate limit exceeded")
+			return
+		}
+	}
+
+	if p.globalRateLimiter != nil {
+		if retryAfter, err := p.globalRateLimiter.Allow(r.Context(), rateLimitRequest(r)); err != nil {
+			if retryAfter > 0 {
+				setRetryAfter(w, retryAfter)
+			}
+			writeGrpcError(w, err)
+			return
+		}
+	}
+
+	server, ok, available := p.findServer(serviceName)
+	if !available {
+		writeGrpcStatus(w, codes.Unavailable, "all servers providing the service are disabled")
+		return
+	}
+	if !ok {
+		writeGrpcStatus(w, codes.Unimplemented, "no server provides the service")
+		return
+	}
+
+	if p.extAuthorizer != nil {
+		if err := p.extAuthorizer.Authorize(r, r.URL.Path, requestPeer(r)); err != nil {
+			writeGrpcError(w, err)
+			return
+		}
+	}
+
+	if p.concurrencyLimits != nil {
+		release, err := p.concurrencyLimits.Acquire(r.Context(), serviceName, server.config.Address)
+		if err != nil {
+			writeGrpcError(w, err)
+			return
+		}
+
+		// The slot is released even if forwarding panics, e.g. with http.ErrAbortHandler.
+		defer func() {
+			if forwarded != nil {
+				release(forwarded.code, forwarded.headerLatency)
+			} else {
+				release(codes.Canceled, 0)
+			}
+		}()
+	}
+
+	result := p.forwardRequest(r, w, server, c)
+	forwarded = &result
+}
+
+// ValidateProtocols returns an error if any of the protocols is unknown.
+func ValidateProtocols(protocols []Protocol) error {
+	for _, protocol := range protocols {
+		if !slices.Contains(AllProtocols, protocol) {
+			return fmt.Errorf("unknown protocol '%s'", protocol)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+package proxy
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/natk64/pancake-proxy/ratelimit"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+const metricsNamespace = "pancake"
+
+// proxyMetrics contains the Prometheus metrics of a proxy.
+type proxyMetrics struct {
+	proxy    *Proxy
+	registry *prometheus.Registry
+
+	requests         *prometheus.CounterVec
+	requestDuration  *prometheus.HistogramVec
+	messagesReceived *prometheus.CounterVec
+	messagesSent     *prometheus.CounterVec
+	inFlight         *prometheus.GaugeVec
+}
+
+func newProxyMetrics(p *Proxy) *proxyMetrics {
+	requestLabels := []string{"service", "method", "code", "upstream"}
+	messageLabels := []string{"service", "method", "upstream"}
+
+	m := &proxyMetrics{
+		proxy:    p,
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "requests_total",
+			Help:      "Number of finished requests.",
+		}, requestLabels),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "request_duration_seconds",
+			Help:      "Duration of finished requests.",
+			Buckets:   prometheus.DefBuckets,
+		}, requestLabels),
+		messagesReceived: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "messages_received_total",
+			Help:      "Number of messages received from clients and forwarded to upstream servers.",
+		}, messageLabels),
+		messagesSent: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "messages_sent_total",
+			Help:      "Number of messages received from upstream servers and sent to clients.",
+		}, messageLabels),
+		inFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "in_flight_streams",
+			Help:      "Number of requests that are currently forwarded to upstream servers.",
+		}, []string{"service", "method"}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.requests,
+		m.requestDuration,
+		m.messagesReceived,
+		m.messagesSent,
+		m.inFlight,
+		stateCollector{proxy: p},
+	)
+
+	return m
+}
+
+// MetricsHandler serves the Prometheus metrics of the proxy.
+// It responds with 404 if metrics are disabled.
+func (p *Proxy) MetricsHandler() http.Handler {
+	if p.metrics == nil {
+		return http.NotFoundHandler()
+	}
+	return promhttp.HandlerFor(p.metrics.registry, promhttp.HandlerOpts{})
+}
+
+// labels returns the service and method labels of a call.
+// Services and methods that aren't known through reflection are labeled 'unknown',
+// so clients can't create series for made up names. The labels are kept once they were determined.
+func (m *proxyMetrics) labels(c *call) (string, string) {
+	if c.metricService != "" {
+		return c.metricService, c.metricMethod
+	}
+
+	c.metricService, c.metricMethod = "unknown", "unknown"
+	m.proxy.servicesMutex.RLock()
+	_, known := m.proxy.services[c.service]
+	m.proxy.servicesMutex.RUnlock()
+	if !known {
+		return c.metricService, c.metricMethod
+	}
+
+	c.metricService = c.service
+	d, err := m.proxy.reflectionResolver.FindDescriptorByName(protoreflect.FullName(c.service))
+	if err != nil {
+		return c.metricService, c.metricMethod
+	}
+	if service, ok := d.(protoreflect.ServiceDescriptor); ok && service.Methods().ByName(protoreflect.Name(c.method)) != nil {
+		c.metricMethod = c.method
+	}
+	return c.metricService, c.metricMethod
+}
+
+// forwarded records that a call is forwarded to its upstream server.
+func (m *proxyMetrics) forwarded(c *call) {
+	if m == nil {
+		return
+	}
+	m.inFlight.WithLabelValues(m.labels(c)).Inc()
+}
+
+// messageCounters returns the counters of the messages received and sent by a forwarded call.
+// They are nil if metrics are disabled.
+func (m *proxyMetrics) messageCounters(c *call) (received, sent prometheus.Counter) {
+	if m == nil {
+		return nil, nil
+	}
+	service, method := m.labels(c)
+	received = m.messagesReceived.WithLabelValues(service, method, c.upstream())
+	sent = m.messagesSent.WithLabelValues(service, method, c.upstream())
+	return received, sent
+}
+
+// finish records the end of a call.
+func (m *proxyMetrics) finish(c *call, code codes.Code) {
+	if m == nil {
+		return
+	}
+
+	service, method := m.labels(c)
+	if c.server != nil {
+		m.inFlight.WithLabelValues(service, method).Dec()
+	}
+
+	labels := []string{service, method, code.String(), c.upstream()}
+	m.requests.WithLabelValues(labels...).Inc()
+	m.requestDuration.WithLabelValues(labels...).Observe(time.Since(c.start).Seconds())
+}
+
+// stateCollector exports the state of the proxy when metrics are collected.
+type stateCollector struct {
+	proxy *Proxy
+}
+
+var (
+	upstreamsDesc = prometheus.NewDesc(metricsNamespace+"_upstreams",
+		"Number of upstream servers per provider.", []string{"provider"}, nil)
+	upstreamServicesDesc = prometheus.NewDesc(metricsNamespace+"_upstream_services",
+		"Number of services provided by an upstream server.", []string{"upstream"}, nil)
+	reflectionFailuresDesc = prometheus.NewDesc(metricsNamespace+"_upstream_reflection_failures",
+		"Number of consecutive failures to refresh the services of an upstream server using reflection.", []string{"upstream"}, nil)
+
+	rateLimitAllowedDesc = prometheus.NewDesc(metricsNamespace+"_rate_limit_allowed_total",
+		"Number of requests allowed by a rate limit rule.", []string{"rule"}, nil)
+	rateLimitLimitedDesc = prometheus.NewDesc(metricsNamespace+"_rate_limit_limited_total",
+		"Number of requests rejected by a rate limit rule.", []string{"rule"}, nil)
+	rateLimitKeysDesc = prometheus.NewDesc(metricsNamespace+"_rate_limit_keys",
+		"Number of keys that currently have a limiter.", []string{"rule"}, nil)
+
+	concurrencyInFlightDesc = prometheus.NewDesc(metricsNamespace+"_concurrency_in_flight",
+		"Number of requests holding a slot of a concurrency limit.", []string{"scope", "key"}, nil)
+	concurrencyQueuedDesc = prometheus.NewDesc(metricsNamespace+"_concurrency_queued",
+		"Number of requests waiting for a slot of a concurrency limit.", []string{"scope", "key"}, nil)
+	concurrencyLimitDesc = prometheus.NewDesc(metricsNamespace+"_concurrency_limit",
+		"Current concurrency limit, -1 if unlimited.", []string{"scope", "key"}, nil)
+)
+
+func (c stateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- upstreamsDesc
+	ch <- upstreamServicesDesc
+	ch <- reflectionFailuresDesc
+	ch <- rateLimitAllowedDesc
+	ch <- rateLimitLimitedDesc
+	ch <- rateLimitKeysDesc
+	ch <- concurrencyInFlightDesc
+	ch <- concurrencyQueuedDesc
+	ch <- concurrencyLimitDesc
+}
+
+func (c stateCollector) Collect(ch chan<- prometheus.Metric) {
+	p := c.proxy
+
+	p.serverMutex.RLock()
+	serviceCounts := make(map[*upstreamServer]int)
+	for provider, servers := range p.servers {
+		ch <- prometheus.MustNewConstMetric(upstreamsDesc, prometheus.GaugeValue, float64(len(servers)), provider)
+		for _, server := range servers {
+			serviceCounts[server] = 0
+		}
+	}
+	p.serverMutex.RUnlock()
+
+	p.servicesMutex.RLock()
+	for _, service := range p.services {
+		for _, server := range service.servers {
+			if _, ok := serviceCounts[server]; ok {
+				serviceCounts[server]++
+			}
+		}
+	}
+	p.servicesMutex.RUnlock()
+
+	// Multiple providers can list the same address, so the values are summed up.
+	services := make(map[string]int)
+	failures := make(map[string]uint32)
+	for server, count := range serviceCounts {
+		services[server.config.Address] += count
+		failures[server.config.Address] += server.reflectionFailures.Load()
+	}
+	for address, count := range services {
+		ch <- prometheus.MustNewConstMetric(upstreamServicesDesc, prometheus.GaugeValue, float64(count), address)
+		ch <- prometheus.MustNewConstMetric(reflectionFailuresDesc, prometheus.GaugeValue, float64(failures[address]), address)
+	}
+
+	if p.rateLimiter != nil {
+		for _, rule := range p.rateLimiter.Stats() {
+			ch <- prometheus.MustNewConstMetric(rateLimitAllowedDesc, prometheus.CounterValue, float64(rule.Allowed), rule.Name)
+			ch <- prometheus.MustNewConstMetric(rateLimitLimitedDesc, prometheus.CounterValue, float64(rule.Limited), rule.Name)
+			ch <- prometheus.MustNewConstMetric(rateLimitKeysDesc, prometheus.GaugeValue, float64(rule.Keys), rule.Name)
+		}
+	}
+
+	if p.concurrencyLimits != nil {
+		upstreams, services := p.concurrencyLimits.Stats()
+		for scope, stats := range map[string][]ratelimit.ConcurrencyStats{"upstream": upstreams, "service": services} {
+			for _, limit := range stats {
+				ch <- prometheus.MustNewConstMetric(concurrencyInFlightDesc, prometheus.GaugeValue, float64(limit.InFlight), scope, limit.Key)
+				ch <- prometheus.MustNewConstMetric(concurrencyQueuedDesc, prometheus.GaugeValue, float64(limit.Queued), scope, limit.Key)
+				ch <- prometheus.MustNewConstMetric(concurrencyLimitDesc, prometheus.GaugeValue, float64(limit.Limit), scope, limit.Key)
+			}
+		}
+	}
+}
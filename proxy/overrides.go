@@ -0,0 +1,218 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ServerState controls whether new calls are forwarded to an upstream server.
+type ServerState string
+
+const (
+	// ServerEnabled is the default state, the server receives calls.
+	ServerEnabled ServerState = "enabled"
+
+	// ServerDraining servers don't receive new calls, but their in-flight calls may finish.
+	// Once the in-flight calls finished or the drain timeout passed, the server is disabled.
+	ServerDraining ServerState = "draining"
+
+	// ServerDisabled servers don't receive calls.
+	ServerDisabled ServerState = "disabled"
+)
+
+var (
+	errUnknownServer  = errors.New("unknown server")
+	errServerDisabled = errors.New("the upstream server was disabled")
+)
+
+// How often a draining server is checked for in-flight calls.
+const drainCheckInterval = 100 * time.Millisecond
+
+// serverOverrides contains the states set using the admin API, by server address.
+// They are kept if the provider replaces the server.
+type serverOverrides struct {
+	mutex  *sync.RWMutex
+	states map[string]*serverOverride
+}
+
+type serverOverride struct {
+	state ServerState
+	since time.Time
+}
+
+func newServerOverrides() *serverOverrides {
+	return &serverOverrides{mutex: &sync.RWMutex{}, states: make(map[string]*serverOverride)}
+}
+
+// get returns the state of a server and when it was set. The time is zero for enabled servers.
+func (o *serverOverrides) get(address string) (ServerState, time.Time) {
+	o.mutex.RLock()
+	defer o.mutex.RUnlock()
+
+	override, ok := o.states[address]
+	if !ok {
+		return ServerEnabled, time.Time{}
+	}
+	return override.state, override.since
+}
+
+// accepts reports whether new calls can be forwarded to the server.
+func (o *serverOverrides) accepts(address string) bool {
+	state, _ := o.get(address)
+	return state == ServerEnabled
+}
+
+// set changes the state of a server and returns the new override, or nil if the server is enabled.
+func (o *serverOverrides) set(address string, state ServerState) *serverOverride {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if state == ServerEnabled {
+		delete(o.states, address)
+		return nil
+	}
+
+	override := &serverOverride{state: state, since: time.Now()}
+	o.states[address] = override
+	return override
+}
+
+// replace changes the state of a server, if its override is still current.
+func (o *serverOverrides) replace(address string, current *serverOverride, state ServerState) bool {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if o.states[address] != current {
+		return false
+	}
+	o.states[address] = &serverOverride{state: state, since: time.Now()}
+	return true
+}
+
+// serversByAddress returns the servers of all providers with the address.
+func (p *Proxy) serversByAddress(address string) []*upstreamServer {
+	p.serverMutex.RLock()
+	defer p.serverMutex.RUnlock()
+
+	var servers []*upstreamServer
+	for _, providerServers := range p.servers {
+		for _, server := range providerServers {
+			if server.config.Address == address {
+				servers = append(servers, server)
+			}
+		}
+	}
+	return servers
+}
+
+// DrainServer stops forwarding new calls to the server with the address.
+// In-flight calls are cancelled after the timeout, then the server is disabled.
+func (p *Proxy) DrainServer(address string, timeout time.Duration) error {
+	if len(p.serversByAddress(address)) == 0 {
+		return fmt.Errorf("%w '%s'", errUnknownServer, address)
+	}
+
+	override := p.overrides.set(address, ServerDraining)
+	p.logger.Info("Draining server", zap.String("address", address), zap.Duration("timeout", timeout))
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		ticker := time.NewTicker(drainCheckInterval)
+		defer ticker.Stop()
+
+		for p.inFlight(address) != 0 {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				if p.overrides.replace(address, override, ServerDisabled) {
+					p.logger.Info("Drain timeout passed, cancelling in-flight calls", zap.String("address", address))
+					p.abortCalls(address)
+				}
+				return
+			}
+		}
+
+		if p.overrides.replace(address, override, ServerDisabled) {
+			p.logger.Info("Server drained", zap.String("address", address))
+		}
+	}()
+	return nil
+}
+
+// DisableServer stops forwarding calls to the server with the address and cancels its in-flight calls.
+func (p *Proxy) DisableServer(address string) error {
+	if len(p.serversByAddress(address)) == 0 {
+		return fmt.Errorf("%w '%s'", errUnknownServer, address)
+	}
+
+	p.overrides.set(address, ServerDisabled)
+	p.logger.Info("Disabled server", zap.String("address", address))
+	p.abortCalls(address)
+	return nil
+}
+
+// EnableServer forwards calls to the server with the address again, after it was drained or disabled.
+func (p *Proxy) EnableServer(address string) error {
+	if len(p.serversByAddress(address)) == 0 {
+		return fmt.Errorf("%w '%s'", errUnknownServer, address)
+	}
+
+	p.overrides.set(address, ServerEnabled)
+	p.logger.Info("Enabled server", zap.String("address", address))
+	return nil
+}
+
+// RefreshServer requests the services of the server with the address using reflection, without waiting for a reconnect.
+func (p *Proxy) RefreshServer(address string) error {
+	servers := p.serversByAddress(address)
+	if len(servers) == 0 {
+		return fmt.Errorf("%w '%s'", errUnknownServer, address)
+	}
+
+	for _, server := range servers {
+		select {
+		case server.refresh <- struct{}{}:
+		default:
+			// A refresh is already pending.
+		}
+	}
+	return nil
+}
+
+// inFlight returns the number of calls forwarded to the servers with the address.
+func (p *Proxy) inFlight(address string) int64 {
+	var inFlight int64
+	for _, server := range p.serversByAddress(address) {
+		inFlight += server.inFlight.Load()
+	}
+	return inFlight
+}
+
+func (p *Proxy) abortCalls(address string) {
+	for _, server := range p.serversByAddress(address) {
+		server.abortCalls()
+	}
+}
+
+// callContext returns the context that is cancelled to abort the calls forwarded to the server.
+func (server *upstreamServer) callContext() context.Context {
+	server.callsMutex.Lock()
+	defer server.callsMutex.Unlock()
+	return server.calls
+}
+
+// abortCalls cancels the in-flight calls of the server. Calls started later aren't affected.
+func (server *upstreamServer) abortCalls() {
+	server.callsMutex.Lock()
+	defer server.callsMutex.Unlock()
+
+	server.cancelCalls(errServerDisabled)
+	server.calls, server.cancelCalls = context.WithCancelCause(context.Background())
+}
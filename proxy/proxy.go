@@ -1,27 +1,84 @@
 package proxy
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/natk64/pancake-proxy/grpcweb"
+	"github.com/natk64/pancake-proxy/accesslog"
+	"github.com/natk64/pancake-proxy/auth"
+	"github.com/natk64/pancake-proxy/ratelimit"
+	"github.com/natk64/pancake-proxy/record"
 	"github.com/natk64/pancake-proxy/reflection"
+	"github.com/natk64/pancake-proxy/tap"
+	"github.com/natk64/pancake-proxy/tracing"
 	"github.com/natk64/pancake-proxy/utils"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/reflection/grpc_reflection_v1"
 	"google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc/status"
 )
 
 type ProxyConfig struct {
 	// DisableReflection will not expose the reflection service
 	DisableReflection bool `mapstructure:"disableReflection"`
 
+	// JWTAuthenticator validates the bearer tokens of requests, if set.
+	JWTAuthenticator *auth.JWTAuthenticator
+
+	// APIKeyAuthenticator checks the API keys of requests, if set.
+	APIKeyAuthenticator *auth.APIKeyAuthenticator
+
+	// ExtAuthorizer checks requests with an external authorization service before they are forwarded, if set.
+	ExtAuthorizer *auth.ExtAuthorizer
+
+	// ConcurrencyLimits limits the concurrent requests to upstream servers and services, if set.
+	ConcurrencyLimits *ratelimit.ConcurrencyLimits
+
+	// PolicyEngine decides which requests are allowed, if set.
+	PolicyEngine *auth.PolicyEngine
+
+	// RateLimiter limits the requests of clients, if set.
+	RateLimiter *ratelimit.Local
+
+	// GlobalRateLimiter limits requests using an external rate limit service, if set.
+	GlobalRateLimiter *ratelimit.Global
+
+	// Tracing creates spans for calls and forwards the trace context to the upstream servers, if set.
+	Tracing *tracing.Tracing
+
+	// AccessLog logs every call, if set.
+	AccessLog *accesslog.Logger
+
+	// Tap streams calls to operators, if set. It's served by [Proxy.TapServer].
+	Tap *tap.Tap
+
+	// Recorder records forwarded calls, if set.
+	Recorder *record.Recorder
+
+	// ConnectMaxMessageSize is the maximum size of Connect request messages in bytes.
+	// The default is [connect.DefaultMaxMessageSize].
+	ConnectMaxMessageSize int
+
+	// EnableMetrics collects Prometheus metrics, which are served by [Proxy.MetricsHandler].
+	EnableMetrics bool
+
+	// EnableExplorer serves the method explorer using [Proxy.ExplorerHandler].
+	EnableExplorer bool
+
+	// AdminToken is the bearer token required for the server operations of [Proxy.AdminHandler].
+	// If it's empty, the operations are only allowed from loopback addresses.
+	AdminToken string
+
 	Logger *zap.Logger
 }
 
@@ -34,11 +91,32 @@ type Proxy struct {
 
 	services      map[string]*upstreamService
 	servicesMutex *sync.RWMutex
+	// servicesGeneration is incremented whenever the services change.
+	servicesGeneration *atomic.Uint64
 
 	internalServer *grpc.Server
 	logger         *zap.Logger
 
 	disableReflectionService bool
+	jwtAuthenticator         *auth.JWTAuthenticator
+	apiKeyAuthenticator      *auth.APIKeyAuthenticator
+	extAuthorizer            *auth.ExtAuthorizer
+	policyEngine             *auth.PolicyEngine
+	rateLimiter              *ratelimit.Local
+	globalRateLimiter        *ratelimit.Global
+	concurrencyLimits        *ratelimit.ConcurrencyLimits
+	metrics                  *proxyMetrics
+	tracing                  *tracing.Tracing
+	accessLog                *accesslog.Logger
+	recentErrors             *errorLog
+	stats                    *callStatistics
+	overrides                *serverOverrides
+	tap                      *tap.Tap
+	recorder                 *record.Recorder
+	enableExplorer           bool
+	adminToken               string
+	connectMaxMessageSize    int
+	defaultListener          http.Handler
 }
 
 func NewServer(config ProxyConfig) *Proxy {
@@ -46,79 +124,85 @@ func NewServer(config ProxyConfig) *Proxy {
 		reflectionResolver:       &reflection.SimpleResolver{},
 		services:                 make(map[string]*upstreamService),
 		servicesMutex:            &sync.RWMutex{},
+		servicesGeneration:       &atomic.Uint64{},
 		servers:                  make(map[string][]*upstreamServer),
 		serverMutex:              &sync.RWMutex{},
 		internalServer:           grpc.NewServer(),
 		logger:                   config.Logger,
 		disableReflectionService: config.DisableReflection,
+		jwtAuthenticator:         config.JWTAuthenticator,
+		apiKeyAuthenticator:      config.APIKeyAuthenticator,
+		extAuthorizer:            config.ExtAuthorizer,
+		policyEngine:             config.PolicyEngine,
+		rateLimiter:              config.RateLimiter,
+		globalRateLimiter:        config.GlobalRateLimiter,
+		concurrencyLimits:        config.ConcurrencyLimits,
+		tracing:                  config.Tracing,
+		accessLog:                config.AccessLog,
+		tap:                      config.Tap,
+		recorder:                 config.Recorder,
+		enableExplorer:           config.EnableExplorer,
+		adminToken:               config.AdminToken,
+		connectMaxMessageSize:    config.ConnectMaxMessageSize,
+		recentErrors:             newErrorLog(maxRecentErrors),
+		stats:                    newCallStatistics(),
+		overrides:                newServerOverrides(),
 	}
 
+	p.defaultListener = p.Handler(ListenerConfig{})
+
 	if p.logger == nil {
 		p.logger = zap.NewNop()
 	}
 
+	if config.EnableMetrics {
+		p.metrics = newProxyMetrics(p)
+	}
+
 	grpc_reflection_v1.RegisterServerReflectionServer(p.internalServer, p)
 	grpc_reflection_v1alpha.RegisterServerReflectionServer(p.internalServer, reflection.AlphaConverter{Inner: p})
 
 	return p
 }
 
-// ServeHTTP implements the http.Handler interface.
-// This method is the entrypoint for all requests into the proxy.
-func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		return
-	}
-
-	serviceName, ok := p.getTargetService(r)
-	if !ok {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(w, "malformed request url")
-		return
-	}
-
-	contentType := r.Header.Get("Content-Type")
-	if strings.HasPrefix(contentType, grpcweb.ContentTypeGrpcWeb) {
-		w, r = grpcweb.WrapRequest(w, r)
-	}
-
-	if f, ok := w.(grpcweb.Finisher); ok {
-		defer f.Finish()
-	}
-
-	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
-
-	if p.handleReflection(w, r, serviceName) {
-		return
-	}
-
-	server, ok := p.findServer(serviceName)
-	if !ok {
-		writeGrpcStatus(w, codes.Unimplemented, "no server provides the service")
-		return
+// TapServer returns the server of the tap, or nil if it's disabled.
+// Messages are decoded using the descriptors received through reflection.
+func (p *Proxy) TapServer() *tap.Server {
+	if p.tap == nil {
+		return nil
 	}
+	return tap.NewServer(p.tap, p.reflectionResolver)
+}
 
-	p.forwardRequest(r, w, server)
+// ServeHTTP implements the http.Handler interface.
+// It handles requests like a listener using the default [ListenerConfig].
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.defaultListener.ServeHTTP(w, r)
 }
 
 // findServer finds a server implementing the specified service using round robin load balancing.
-func (p *Proxy) findServer(serviceName string) (*upstreamServer, bool) {
+// Drained and disabled servers are skipped, available is false if the service has servers, but all of them are skipped.
+func (p *Proxy) findServer(serviceName string) (server *upstreamServer, ok bool, available bool) {
 	p.servicesMutex.RLock()
 	defer p.servicesMutex.RUnlock()
 
 	service, ok := p.services[serviceName]
 	if !ok || len(service.servers) == 0 {
-		return nil, false
+		return nil, false, true
 	}
 
 	next := int(service.next.Add(1))
-	server := service.servers[next%len(service.servers)]
-	return server, true
+	for i := range len(service.servers) {
+		server := service.servers[(next+i)%len(service.servers)]
+		if p.overrides.accepts(server.config.Address) {
+			return server, true, true
+		}
+	}
+	return nil, false, false
 }
 
 // getTargetService returns the name of the service this request is targeting.
-func (p *Proxy) getTargetService(r *http.Request) (name string, ok bool) {
+func getTargetService(r *http.Request) (name string, ok bool) {
 	path := strings.TrimPrefix(r.URL.Path, "/")
 	split := strings.SplitN(path, "/", 2)
 	if len(split) != 2 {
@@ -128,8 +212,41 @@ func (p *Proxy) getTargetService(r *http.Request) (name string, ok bool) {
 	return split[0], true
 }
 
+// getTargetMethod returns the name of the method this request is targeting, without the service name.
+func getTargetMethod(r *http.Request) string {
+	_, method, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	return method
+}
+
+// forwardResult describes the outcome of a forwarded request.
+type forwardResult struct {
+	code codes.Code
+
+	// headerLatency is the time until the response headers were received.
+	headerLatency time.Duration
+}
+
 // forwardRequest forwards an incoming gRPC request to the specified server.
-func (p *Proxy) forwardRequest(req *http.Request, w http.ResponseWriter, server *upstreamServer) {
+func (p *Proxy) forwardRequest(req *http.Request, w http.ResponseWriter, server *upstreamServer, c *call) (result forwardResult) {
+	c.server = server
+	p.metrics.forwarded(c)
+	p.stats.forwarded(c.service)
+	server.inFlight.Add(1)
+	defer server.inFlight.Add(-1)
+
+	// The call is cancelled if the server is disabled.
+	ctx, cancel := context.WithCancelCause(req.Context())
+	defer cancel(nil)
+	stop := context.AfterFunc(server.callContext(), func() { cancel(errServerDisabled) })
+	defer stop()
+	req = req.WithContext(ctx)
+	receivedCounter, sentCounter := p.metrics.messageCounters(c)
+	req.Body = &messageCounter{ReadCloser: req.Body, stats: c.received, counter: receivedCounter}
+
+	span := p.startClientSpan(req, server)
+	defer func() { endSpan(span, result.code) }()
+	c.recording.Request(server.config.Address, req.Header)
+
 	req.URL.Host = server.config.Address
 	req.Host = server.config.Address
 	req.RequestURI = ""
@@ -140,12 +257,23 @@ func (p *Proxy) forwardRequest(req *http.Request, w http.ResponseWriter, server
 		req.URL.Scheme = "https"
 	}
 
+	start := time.Now()
 	response, err := server.httpClient.Do(req)
 	if err != nil {
 		p.logger.Debug("Failed to start request", zap.Error(err))
-		return
+		if context.Cause(req.Context()) == errServerDisabled {
+			writeGrpcStatus(w, codes.Unavailable, errServerDisabled.Error())
+			return forwardResult{code: codes.Unavailable}
+		}
+		if ctxErr := req.Context().Err(); ctxErr != nil {
+			return forwardResult{code: status.FromContextError(ctxErr).Code()}
+		}
+		p.recentErrors.add(server.config.Address, "failed to start request", err)
+		writeGrpcStatus(w, codes.Unavailable, "upstream server unavailable")
+		return forwardResult{code: codes.Unavailable}
 	}
 
+	result = forwardResult{code: codes.Unknown, headerLatency: time.Since(start)}
 	for key, values := range response.Header {
 		for _, value := range values {
 			w.Header().Add(key, value)
@@ -155,19 +283,46 @@ func (p *Proxy) forwardRequest(req *http.Request, w http.ResponseWriter, server
 	w.WriteHeader(response.StatusCode)
 	if response.StatusCode != 200 {
 		p.logger.Debug("received bad status", zap.Int("status_code", response.StatusCode))
-		return
+		p.recentErrors.add(server.config.Address, "received bad status", fmt.Errorf("HTTP status %d", response.StatusCode))
+		return result
 	}
 
-	if _, err := io.Copy(utils.HttpAutoFlusher(w), response.Body); err != nil {
+	if _, err := io.Copy(utils.HttpAutoFlusher(w), &messageCounter{ReadCloser: response.Body, stats: c.sent, counter: sentCounter}); err != nil {
 		p.logger.Debug("Request cancelled", zap.Error(err))
-		return
+		if context.Cause(req.Context()) == errServerDisabled {
+			// The headers were sent already, the status is sent as a trailer.
+			w.Header().Set("Grpc-Status", strconv.Itoa(int(codes.Unavailable)))
+			w.Header().Set("Grpc-Message", errServerDisabled.Error())
+			result.code = codes.Unavailable
+			return result
+		}
+		result.code = codes.Canceled
+		return result
 	}
 
 	for key, values := range response.Trailer {
+		// Trailers that weren't declared by serveCall are only sent with the prefix.
+		switch key {
+		case "Grpc-Status", "Grpc-Message", "Grpc-Status-Details-Bin":
+		default:
+			key = http.TrailerPrefix + key
+		}
 		for _, value := range values {
 			w.Header().Add(key, value)
 		}
 	}
+	c.recording.Response(response.Header, response.Trailer)
+
+	// Trailers-only responses contain the status in the headers.
+	rawCode := response.Trailer.Get("Grpc-Status")
+	if rawCode == "" {
+		rawCode = response.Header.Get("Grpc-Status")
+	}
+	if code, err := strconv.Atoi(rawCode); err == nil {
+		result.code = codes.Code(code)
+	}
+
+	return result
 }
 
 func writeGrpcStatus(w http.ResponseWriter, code codes.Code, msg string) {
@@ -176,3 +331,14 @@ func writeGrpcStatus(w http.ResponseWriter, code codes.Code, msg string) {
 	w.Header().Add("Grpc-Status", strconv.Itoa(int(code)))
 	w.Header().Add("Grpc-Message", msg)
 }
+
+// setRetryAfter tells the client when to retry a request that was rejected because of a limit.
+func setRetryAfter(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+}
+
+// writeGrpcError writes the status of an error, see [status.Convert].
+func writeGrpcError(w http.ResponseWriter, err error) {
+	s := status.Convert(err)
+	writeGrpcStatus(w, s.Code(), s.Message())
+}
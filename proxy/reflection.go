@@ -39,7 +39,7 @@ func (p *Proxy) handleReflection(w http.ResponseWriter, r *http.Request, service
 
 // ServerReflectionInfo implements grpc_reflection_v1.ServerReflectionServer.
 func (p *Proxy) ServerReflectionInfo(stream grpc_reflection_v1.ServerReflection_ServerReflectionInfoServer) error {
-	handler := newReflectionHandler(p)
+	handler := newReflectionHandler(p, listenerFromContext(stream.Context()))
 
 	for {
 		msg, err := stream.Recv()
@@ -142,13 +142,15 @@ func (p *Proxy) ServerReflectionInfo(stream grpc_reflection_v1.ServerReflection_
 type reflectionHandler struct {
 	sentFileDescriptors map[string]bool
 	proxy               *Proxy
+	listener            *listenerHandler
 	resolver            reflection.FileExtensionResolver
 }
 
-func newReflectionHandler(proxy *Proxy) *reflectionHandler {
+func newReflectionHandler(proxy *Proxy, listener *listenerHandler) *reflectionHandler {
 	return &reflectionHandler{
 		sentFileDescriptors: make(map[string]bool),
 		proxy:               proxy,
+		listener:            listener,
 		resolver:            proxy.reflectionResolver,
 	}
 }
@@ -159,7 +161,7 @@ func (h *reflectionHandler) reflectionListServices() *grpc_reflection_v1.ListSer
 
 	response := &grpc_reflection_v1.ListServiceResponse{}
 	for name := range h.proxy.services {
-		if name == reflectionV1Service || name == reflectionV1alphaService {
+		if name == reflectionV1Service || name == reflectionV1alphaService || !h.listener.exposesService(name) {
 			continue
 		}
 
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/natk64/pancake-proxy/connect"
+	"github.com/natk64/pancake-proxy/rest"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// restRoutes is the REST router of a listener, built for a generation of the services.
+type restRoutes struct {
+	generation uint64
+	router     *rest.Router
+}
+
+// serveREST handles requests to the REST routes of the listener.
+// It returns false if the request should be handled by the other protocols.
+func (l *listenerHandler) serveREST(w http.ResponseWriter, r *http.Request) bool {
+	if isGrpcRequest(r) {
+		return false
+	}
+
+	if match, ok := l.restRouter().Match(r); ok {
+		rest.Serve(w, r, match, l.proxy.reflectionResolver, http.HandlerFunc(l.serveCall))
+		return true
+	}
+
+	// Unary Connect requests can't be told apart from REST requests by their content type, only by their path.
+	if connect.IsConnectRequest(r) && l.proxy.knowsTargetService(r) {
+		return false
+	}
+
+	rest.NotFound(w, r)
+	return true
+}
+
+// restRouter returns the REST routes of the services exposed through the listener.
+func (l *listenerHandler) restRouter() *rest.Router {
+	p := l.proxy
+	if routes := l.restRoutes.Load(); routes != nil && routes.generation == p.servicesGeneration.Load() {
+		return routes.router
+	}
+
+	// The lock keeps replaceServices from changing the services while the routes are built.
+	p.servicesMutex.RLock()
+	defer p.servicesMutex.RUnlock()
+
+	var services []protoreflect.ServiceDescriptor
+	for name := range p.services {
+		if !l.exposesService(name) {
+			continue
+		}
+		if descriptor, err := p.reflectionResolver.FindDescriptorByName(protoreflect.FullName(name)); err == nil {
+			if service, ok := descriptor.(protoreflect.ServiceDescriptor); ok {
+				services = append(services, service)
+			}
+		}
+	}
+
+	router := rest.NewRouter(services, p.logger.Named("rest"))
+	l.restRoutes.Store(&restRoutes{generation: p.servicesGeneration.Load(), router: router})
+	return router
+}
+
+// knowsTargetService returns true if the service in the path of a gRPC style request is known.
+func (p *Proxy) knowsTargetService(r *http.Request) bool {
+	serviceName, ok := getTargetService(r)
+	if !ok {
+		return false
+	}
+
+	p.servicesMutex.RLock()
+	defer p.servicesMutex.RUnlock()
+	_, ok = p.services[serviceName]
+	return ok
+}
+
+// isGrpcRequest returns true for gRPC, gRPC-Web and streaming Connect requests, which are never REST requests.
+func isGrpcRequest(r *http.Request) bool {
+	contentType := r.Header.Get("Content-Type")
+	return strings.HasPrefix(contentType, "application/grpc") || strings.HasPrefix(contentType, connect.ContentTypeStreamPrefix)
+}
@@ -3,10 +3,14 @@ package proxy
 import (
 	"context"
 	"crypto/tls"
+	"fmt"
 	"net"
 	"net/http"
 	"slices"
+	"sync"
+	"sync/atomic"
 
+	"github.com/natk64/pancake-proxy/certs"
 	"github.com/natk64/pancake-proxy/reflection"
 	"go.uber.org/zap"
 	"golang.org/x/net/http2"
@@ -16,9 +20,45 @@ import (
 )
 
 type UpstreamConfig struct {
-	Address            string `mapstructure:"address"`
-	Plaintext          bool   `mapstructure:"plaintext"`
-	InsecureSkipVerify bool   `mapstructure:"insecureSkipVerify"`
+	Address            string `mapstructure:"address" json:"address"`
+	Plaintext          bool   `mapstructure:"plaintext" json:"plaintext"`
+	InsecureSkipVerify bool   `mapstructure:"insecure_skip_verify" json:"insecure_skip_verify"`
+
+	// CAFile contains the CA certificates used to verify the server, instead of the system roots.
+	CAFile string `mapstructure:"ca_file" json:"ca_file,omitempty"`
+
+	// CertFile and KeyFile specify the client certificate presented to the server.
+	CertFile string `mapstructure:"cert_file" json:"cert_file,omitempty"`
+	KeyFile  string `mapstructure:"key_file" json:"key_file,omitempty"`
+
+	// ServerName overrides the name used to verify the server certificate, the default is the host of the address.
+	ServerName string `mapstructure:"server_name" json:"server_name,omitempty"`
+}
+
+// tlsConfig creates the TLS config used for connections to the server.
+func (config UpstreamConfig) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: config.InsecureSkipVerify,
+		ServerName:         config.ServerName,
+	}
+
+	if config.CAFile != "" {
+		pool, err := certs.LoadCertPool(config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load CA certificates, %w", err)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.CertFile != "" || config.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate, %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
 }
 
 // upstreamServer should only be created using [newUpstream]
@@ -26,14 +66,38 @@ type upstreamServer struct {
 	config   UpstreamConfig
 	provider string
 
+	tlsConfig *tls.Config
+
 	stopServiceWatcher func()
 	reflectionClient   *reflection.ReflectionClient
-	httpClient         *http.Client
-	logger             *zap.Logger
+
+	// reflectionFailures is the number of consecutive failures to get the service info.
+	reflectionFailures *atomic.Uint32
+
+	// conn is the connection used for reflection, once it's created.
+	conn *atomic.Pointer[grpc.ClientConn]
+
+	// lastRefresh is the time the services were last received, in Unix nanoseconds.
+	lastRefresh *atomic.Int64
+
+	// refresh requests the services again, see [Proxy.RefreshServer].
+	refresh chan struct{}
+
+	// inFlight is the number of calls currently forwarded to the server.
+	inFlight *atomic.Int64
+
+	// calls is the parent context of the forwarded calls, it's cancelled and replaced to abort them.
+	calls       context.Context
+	cancelCalls context.CancelCauseFunc
+	callsMutex  *sync.Mutex
+
+	httpClient *http.Client
+	logger     *zap.Logger
 }
 
-func newUpstream(provider string, config UpstreamConfig, logger *zap.Logger) *upstreamServer {
+func newUpstream(provider string, config UpstreamConfig, logger *zap.Logger) (*upstreamServer, error) {
 	var transport http.RoundTripper
+	var tlsConfig *tls.Config
 	if config.Plaintext {
 		transport = &http2.Transport{
 			AllowHTTP: true,
@@ -43,21 +107,34 @@ func newUpstream(provider string, config UpstreamConfig, logger *zap.Logger) *up
 			},
 		}
 	} else {
+		var err error
+		if tlsConfig, err = config.tlsConfig(); err != nil {
+			return nil, err
+		}
+
 		transport = &http2.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: config.InsecureSkipVerify,
-			},
+			TLSClientConfig: tlsConfig.Clone(),
 		}
 	}
 
+	calls, cancelCalls := context.WithCancelCause(context.Background())
 	return &upstreamServer{
-		config:   config,
-		provider: provider,
-		logger:   logger,
+		config:             config,
+		provider:           provider,
+		logger:             logger,
+		tlsConfig:          tlsConfig,
+		reflectionFailures: &atomic.Uint32{},
+		conn:               &atomic.Pointer[grpc.ClientConn]{},
+		lastRefresh:        &atomic.Int64{},
+		refresh:            make(chan struct{}, 1),
+		inFlight:           &atomic.Int64{},
+		calls:              calls,
+		cancelCalls:        cancelCalls,
+		callsMutex:         &sync.Mutex{},
 		httpClient: &http.Client{
 			Transport: transport,
 		},
-	}
+	}, nil
 }
 
 func (server *upstreamServer) dialOptions() []grpc.DialOption {
@@ -68,7 +145,7 @@ func (server *upstreamServer) dialOptions() []grpc.DialOption {
 	}
 
 	return []grpc.DialOption{
-		grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{InsecureSkipVerify: server.config.InsecureSkipVerify})),
+		grpc.WithTransportCredentials(credentials.NewTLS(server.tlsConfig.Clone())),
 	}
 }
 
@@ -112,7 +189,14 @@ func (p *Proxy) ReplaceServers(provider string, newConfigs []UpstreamConfig) {
 
 	for config, shouldBuild := range shouldBuildConfigs {
 		if shouldBuild {
-			server := newUpstream(provider, config, p.logger.Named("upstream").With(zap.String("upstream_host", config.Address)))
+			logger := p.logger.Named("upstream").With(zap.String("upstream_host", config.Address))
+			server, err := newUpstream(provider, config, logger)
+			if err != nil {
+				logger.Error("Failed to create upstream server", zap.Error(err))
+				p.recentErrors.add(config.Address, "failed to create upstream server", err)
+				continue
+			}
+
 			go server.watchServices(context.Background(), p)
 			newServers = append(newServers, server)
 			server.logger.Debug("Adding server to new server list")
@@ -120,4 +204,14 @@ func (p *Proxy) ReplaceServers(provider string, newConfigs []UpstreamConfig) {
 	}
 
 	p.servers[provider] = newServers
+
+	if p.concurrencyLimits != nil {
+		var addresses []string
+		for _, servers := range p.servers {
+			for _, server := range servers {
+				addresses = append(addresses, server.config.Address)
+			}
+		}
+		p.concurrencyLimits.RetainUpstreams(addresses)
+	}
 }
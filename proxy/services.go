@@ -31,6 +31,7 @@ func (srv *upstreamServer) reflectClient() (*reflection.ReflectionClient, error)
 
 	client := reflection.NewClient(conn)
 	srv.reflectionClient = client
+	srv.conn.Store(conn)
 	return client, nil
 }
 
@@ -63,12 +64,17 @@ func (srv *upstreamServer) watchServices(ctx context.Context, proxy *Proxy) erro
 		for {
 			info, err = srv.getServiceInfo()
 			if err == nil {
+				srv.reflectionFailures.Store(0)
+				srv.lastRefresh.Store(time.Now().UnixNano())
 				break
 			}
 
+			srv.reflectionFailures.Add(1)
 			srv.logger.Error("Failed to get service info", zap.Error(err))
+			proxy.recentErrors.add(srv.config.Address, "failed to get service info", err)
 			select {
 			case <-time.After(time.Second * 10):
+			case <-srv.refresh:
 			case <-ctx.Done():
 				return ctx.Err()
 			}
@@ -89,6 +95,9 @@ func (srv *upstreamServer) watchServices(ctx context.Context, proxy *Proxy) erro
 			}
 			srv.logger.Info("Refreshing service info")
 			continue
+		case <-srv.refresh:
+			srv.logger.Info("Refreshing service info on request")
+			continue
 		case <-ctx.Done():
 			return ctx.Err()
 		}
@@ -120,10 +129,13 @@ func (p *Proxy) replaceServices(targetServer *upstreamServer, info serviceInfoRe
 
 		if err := p.reflectionResolver.RegisterFiles(info.fileDescriptors); err != nil {
 			p.logger.Error("Failed to register proto files for server", zap.Error(err))
+			p.recentErrors.add(targetServer.config.Address, "failed to register proto files", err)
 		}
 
 		service.servers = append(service.servers, targetServer)
 	}
+
+	p.servicesGeneration.Add(1)
 }
 
 type serviceInfoResult struct {
@@ -0,0 +1,257 @@
+package proxy
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+)
+
+const (
+	// statsWindow is the time the call statistics of the dashboard and admin API are computed over.
+	statsWindow = time.Minute
+
+	// The window is split into buckets, which are reset once they're older than the window.
+	statsBucketWidth = 5 * time.Second
+	statsBuckets     = int(statsWindow / statsBucketWidth)
+)
+
+// latencyBounds are the upper bounds of the latency histogram used for percentiles.
+var latencyBounds = [...]time.Duration{
+	time.Millisecond, 2 * time.Millisecond, 5 * time.Millisecond,
+	10 * time.Millisecond, 20 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 200 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 2 * time.Second, 5 * time.Second,
+	10 * time.Second, 30 * time.Second, time.Minute,
+}
+
+// CallStats summarizes the calls of a service or upstream server during the last minute.
+type CallStats struct {
+	// RequestRate is the number of finished calls per second.
+	RequestRate float64 `json:"request_rate"`
+
+	// ErrorRate is the fraction of calls that failed with a server error,
+	// like UNAVAILABLE or INTERNAL. Client errors like NOT_FOUND aren't counted.
+	ErrorRate float64 `json:"error_rate"`
+
+	// Latency percentiles in milliseconds, estimated from a histogram.
+	LatencyP50 float64 `json:"latency_p50_ms"`
+	LatencyP90 float64 `json:"latency_p90_ms"`
+	LatencyP99 float64 `json:"latency_p99_ms"`
+
+	// InFlight is the number of calls currently forwarded.
+	InFlight int64 `json:"in_flight"`
+}
+
+// isServerError reports whether a status code indicates a failure of the upstream server or the proxy.
+func isServerError(code codes.Code) bool {
+	switch code {
+	case codes.Unknown, codes.DeadlineExceeded, codes.Unimplemented, codes.Internal, codes.Unavailable, codes.DataLoss:
+		return true
+	}
+	return false
+}
+
+type statsBucket struct {
+	// index is the number of the bucket since the unix epoch, buckets with an old index are reset.
+	index     int64
+	requests  int64
+	errors    int64
+	latencies [len(latencyBounds) + 1]int64
+}
+
+// windowStats contains the calls of a single service or upstream server.
+type windowStats struct {
+	buckets  [statsBuckets]statsBucket
+	inFlight int64
+}
+
+func (s *windowStats) add(now time.Time, code codes.Code, latency time.Duration) {
+	index := now.UnixNano() / int64(statsBucketWidth)
+	bucket := &s.buckets[index%int64(statsBuckets)]
+	if bucket.index != index {
+		*bucket = statsBucket{index: index}
+	}
+
+	bucket.requests++
+	if isServerError(code) {
+		bucket.errors++
+	}
+	i := 0
+	for i < len(latencyBounds) && latency > latencyBounds[i] {
+		i++
+	}
+	bucket.latencies[i]++
+}
+
+// summary sums up the buckets within the window.
+func (s *windowStats) summary(now time.Time) statsBucket {
+	index := now.UnixNano() / int64(statsBucketWidth)
+
+	var sum statsBucket
+	for _, bucket := range s.buckets {
+		if bucket.index <= index-int64(statsBuckets) {
+			continue
+		}
+		sum.requests += bucket.requests
+		sum.errors += bucket.errors
+		for i, count := range bucket.latencies {
+			sum.latencies[i] += count
+		}
+	}
+	return sum
+}
+
+func (s *windowStats) stats(now time.Time) CallStats {
+	sum := s.summary(now)
+	stats := CallStats{InFlight: s.inFlight}
+	if sum.requests == 0 {
+		return stats
+	}
+
+	stats.RequestRate = float64(sum.requests) / statsWindow.Seconds()
+	stats.ErrorRate = float64(sum.errors) / float64(sum.requests)
+	stats.LatencyP50 = percentile(sum, 0.5)
+	stats.LatencyP90 = percentile(sum, 0.9)
+	stats.LatencyP99 = percentile(sum, 0.99)
+	return stats
+}
+
+// percentile estimates a latency percentile in milliseconds, interpolating within the histogram bucket.
+// Latencies above the last bound are reported as the last bound.
+func percentile(sum statsBucket, q float64) float64 {
+	target := math.Ceil(q * float64(sum.requests))
+
+	var seen float64
+	for i, count := range sum.latencies {
+		if count == 0 || seen+float64(count) < target {
+			seen += float64(count)
+			continue
+		}
+		if i == len(latencyBounds) {
+			break
+		}
+
+		var lower time.Duration
+		if i > 0 {
+			lower = latencyBounds[i-1]
+		}
+		upper := latencyBounds[i]
+		latency := lower + time.Duration(float64(upper-lower)*(target-seen)/float64(count))
+		return float64(latency) / float64(time.Millisecond)
+	}
+	return float64(latencyBounds[len(latencyBounds)-1]) / float64(time.Millisecond)
+}
+
+// callStatistics collects the calls of the last minute by service and upstream address.
+type callStatistics struct {
+	mutex     *sync.Mutex
+	services  map[string]*windowStats
+	upstreams map[string]*windowStats
+	lastPrune time.Time
+}
+
+func newCallStatistics() *callStatistics {
+	return &callStatistics{
+		mutex:     &sync.Mutex{},
+		services:  make(map[string]*windowStats),
+		upstreams: make(map[string]*windowStats),
+		lastPrune: time.Now(),
+	}
+}
+
+func getWindowStats(m map[string]*windowStats, key string) *windowStats {
+	stats, ok := m[key]
+	if !ok {
+		stats = &windowStats{}
+		m[key] = stats
+	}
+	return stats
+}
+
+// forwarded records that a call of the service is forwarded to an upstream server.
+func (s *callStatistics) forwarded(service string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	getWindowStats(s.services, service).inFlight++
+}
+
+// finish records the end of a call. upstream is empty if the call wasn't forwarded.
+func (s *callStatistics) finish(service, upstream string, code codes.Code, latency time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	serviceStats := getWindowStats(s.services, service)
+	serviceStats.add(now, code, latency)
+	if upstream != "" {
+		serviceStats.inFlight--
+		getWindowStats(s.upstreams, upstream).add(now, code, latency)
+	}
+
+	if now.Sub(s.lastPrune) > statsWindow {
+		s.lastPrune = now
+		prune(s.services, now)
+		prune(s.upstreams, now)
+	}
+}
+
+// prune removes the stats without calls during the window, so removed services and servers don't stay forever.
+func prune(m map[string]*windowStats, now time.Time) {
+	for key, stats := range m {
+		if stats.inFlight == 0 && stats.summary(now).requests == 0 {
+			delete(m, key)
+		}
+	}
+}
+
+// service returns the stats of a service.
+func (s *callStatistics) service(name string) CallStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if stats, ok := s.services[name]; ok {
+		return stats.stats(time.Now())
+	}
+	return CallStats{}
+}
+
+// upstream returns the stats of the upstream servers with the address.
+// The in-flight calls are counted by the servers themselves.
+func (s *callStatistics) upstream(address string) CallStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if stats, ok := s.upstreams[address]; ok {
+		return stats.stats(time.Now())
+	}
+	return CallStats{}
+}
+
+// recordStats records a finished call in the statistics.
+// Calls of unknown services are ignored, so clients can't create stats for made up names.
+func (p *Proxy) recordStats(c *call, code codes.Code) {
+	if c.server == nil {
+		p.servicesMutex.RLock()
+		_, ok := p.services[c.service]
+		p.servicesMutex.RUnlock()
+		if !ok {
+			return
+		}
+	}
+	p.stats.finish(c.service, c.upstream(), code, time.Since(c.start))
+}
+
+// serverHealthy reports whether a server receives calls and its connection and reflection work.
+func (p *Proxy) serverHealthy(server *upstreamServer) bool {
+	if !p.overrides.accepts(server.config.Address) || server.reflectionFailures.Load() != 0 {
+		return false
+	}
+	if conn := server.conn.Load(); conn != nil {
+		state := conn.GetState()
+		return state != connectivity.TransientFailure && state != connectivity.Shutdown
+	}
+	return true
+}
@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.34.0"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/codes"
+)
+
+// startServerSpan starts the span of a call, continuing the trace of the client.
+// If tracing is disabled, the returned span does nothing.
+func (p *Proxy) startServerSpan(r *http.Request, service, method string) (*http.Request, trace.Span) {
+	if p.tracing == nil {
+		return r, trace.SpanFromContext(context.Background())
+	}
+
+	ctx := p.tracing.Propagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := p.tracing.Tracer().Start(ctx, service+"/"+method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(semconv.RPCSystemGRPC, semconv.RPCService(service), semconv.RPCMethod(method)),
+	)
+	return r.WithContext(ctx), span
+}
+
+// startClientSpan starts the span of a request to an upstream server and injects its context into the request headers.
+// If tracing is disabled, the returned span does nothing.
+func (p *Proxy) startClientSpan(req *http.Request, server *upstreamServer) trace.Span {
+	if p.tracing == nil {
+		return trace.SpanFromContext(context.Background())
+	}
+
+	service, _ := getTargetService(req)
+	method := getTargetMethod(req)
+
+	ctx, span := p.tracing.Tracer().Start(req.Context(), service+"/"+method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.RPCSystemGRPC, semconv.RPCService(service), semconv.RPCMethod(method)),
+	)
+
+	if host, port, err := net.SplitHostPort(server.config.Address); err == nil {
+		span.SetAttributes(semconv.ServerAddress(host))
+		if port, err := strconv.Atoi(port); err == nil {
+			span.SetAttributes(semconv.ServerPort(port))
+		}
+	} else {
+		span.SetAttributes(semconv.ServerAddress(server.config.Address))
+	}
+
+	p.tracing.Propagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	return span
+}
+
+// endSpan records the status code of a call and ends its span.
+func endSpan(span trace.Span, code codes.Code) {
+	span.SetAttributes(semconv.RPCGRPCStatusCodeKey.Int(int(code)))
+	if code != codes.OK {
+		span.SetStatus(otelcodes.Error, code.String())
+	}
+	span.End()
+}
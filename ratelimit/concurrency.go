@@ -0,0 +1,352 @@
+package ratelimit
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"math"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/natk64/pancake-proxy/auth"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ConcurrencyConfig configures [ConcurrencyLimits].
+type ConcurrencyConfig struct {
+	// Upstream limits the requests to every upstream server.
+	Upstream LimitConfig `mapstructure:"upstream"`
+
+	// Services limits the requests to services. Every matching service has its own limit.
+	Services []ServiceLimitConfig `mapstructure:"services"`
+}
+
+// LimitConfig configures the limit of a single [ConcurrencyLimiter].
+type LimitConfig struct {
+	// MaxInFlight is the maximum number of concurrent requests, unlimited if 0.
+	MaxInFlight int `mapstructure:"max_in_flight"`
+
+	// MaxQueue is the maximum number of requests waiting for a slot, further requests are rejected immediately.
+	MaxQueue int `mapstructure:"max_queue"`
+
+	// QueueTimeout is the maximum time requests wait in the queue.
+	QueueTimeout time.Duration `mapstructure:"queue_timeout"`
+
+	// Adaptive adjusts the limit based on the latency of the requests.
+	Adaptive AdaptiveConfig `mapstructure:"adaptive"`
+}
+
+// ServiceLimitConfig limits the requests to a set of services.
+type ServiceLimitConfig struct {
+	LimitConfig `mapstructure:",squash"`
+
+	// Services lists the services, see [auth.MatchMethod] for the syntax.
+	Services []string `mapstructure:"services"`
+}
+
+// AdaptiveConfig configures an AIMD limit, which is increased by one after a full window of successful requests
+// and multiplied by the backoff ratio when a request indicates an overload.
+// Requests indicate an overload if they take longer than the latency threshold,
+// or fail with UNAVAILABLE, RESOURCE_EXHAUSTED or DEADLINE_EXCEEDED.
+type AdaptiveConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+
+	// MinLimit and MaxLimit bound the limit. The limit starts at MaxInFlight, or MaxLimit if it's not set.
+	MinLimit int `mapstructure:"min_limit"`
+	MaxLimit int `mapstructure:"max_limit"`
+
+	LatencyThreshold time.Duration `mapstructure:"latency_threshold"`
+
+	// BackoffRatio is the factor the limit is multiplied with on overload, the default is 0.9.
+	BackoffRatio float64 `mapstructure:"backoff_ratio"`
+}
+
+// ConcurrencyStats contains the state of a [ConcurrencyLimiter].
+type ConcurrencyStats struct {
+	Key      string
+	InFlight int
+	Queued   int
+	Limit    int
+}
+
+// Release must be called once a request that acquired a slot is finished.
+// code is the gRPC status code of the request, latency the time the upstream took to respond.
+type Release func(code codes.Code, latency time.Duration)
+
+// ConcurrencyLimits manages the concurrency limiters of upstream servers and services.
+//
+// ConcurrencyLimits must be created using [NewConcurrencyLimits].
+type ConcurrencyLimits struct {
+	config ConcurrencyConfig
+
+	mutex     *sync.Mutex
+	upstreams map[string]*ConcurrencyLimiter
+	services  map[string]*ConcurrencyLimiter
+}
+
+// NewConcurrencyLimits creates the limits.
+func NewConcurrencyLimits(config ConcurrencyConfig) (*ConcurrencyLimits, error) {
+	if err := checkLimitConfig(config.Upstream); err != nil {
+		return nil, fmt.Errorf("upstream limit, %w", err)
+	}
+	for i, service := range config.Services {
+		if err := checkLimitConfig(service.LimitConfig); err != nil {
+			return nil, fmt.Errorf("service limit #%d, %w", i+1, err)
+		}
+	}
+
+	return &ConcurrencyLimits{
+		config:    config,
+		mutex:     &sync.Mutex{},
+		upstreams: make(map[string]*ConcurrencyLimiter),
+		services:  make(map[string]*ConcurrencyLimiter),
+	}, nil
+}
+
+func checkLimitConfig(config LimitConfig) error {
+	if config.MaxInFlight < 0 || config.MaxQueue < 0 {
+		return fmt.Errorf("limits must not be negative")
+	}
+	if !config.Adaptive.Enabled {
+		return nil
+	}
+	if config.Adaptive.MinLimit <= 0 || config.Adaptive.MaxLimit < config.Adaptive.MinLimit {
+		return fmt.Errorf("adaptive limits require 0 < min_limit <= max_limit")
+	}
+	if config.Adaptive.BackoffRatio < 0 || config.Adaptive.BackoffRatio >= 1 {
+		return fmt.Errorf("the backoff ratio must be between 0 and 1")
+	}
+	return nil
+}
+
+// Acquire acquires a slot for a request to the service on the upstream server, waiting in the queues if necessary.
+// If the request is rejected, the returned error is a gRPC status error.
+func (c *ConcurrencyLimits) Acquire(ctx context.Context, service, upstream string) (Release, error) {
+	var releases []Release
+	releaseAll := func(code codes.Code, latency time.Duration) {
+		for _, release := range releases {
+			release(code, latency)
+		}
+	}
+
+	for _, limiter := range c.limiters(service, upstream) {
+		release, err := limiter.Acquire(ctx)
+		if err != nil {
+			releaseAll(codes.Canceled, 0)
+			return nil, err
+		}
+		releases = append(releases, release)
+	}
+
+	return releaseAll, nil
+}
+
+func (c *ConcurrencyLimits) limiters(service, upstream string) []*ConcurrencyLimiter {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var limiters []*ConcurrencyLimiter
+	for _, config := range c.config.Services {
+		if auth.MatchAnyMethod(config.Services, service) {
+			limiter, ok := c.services[service]
+			if !ok {
+				limiter = NewConcurrencyLimiter(config.LimitConfig)
+				c.services[service] = limiter
+			}
+			limiters = append(limiters, limiter)
+			break
+		}
+	}
+
+	if c.config.Upstream.MaxInFlight > 0 || c.config.Upstream.Adaptive.Enabled {
+		limiter, ok := c.upstreams[upstream]
+		if !ok {
+			limiter = NewConcurrencyLimiter(c.config.Upstream)
+			c.upstreams[upstream] = limiter
+		}
+		limiters = append(limiters, limiter)
+	}
+
+	return limiters
+}
+
+// RetainUpstreams removes the limiters of upstream servers that aren't in the list, so removed servers don't stay forever.
+// Requests holding a slot of a removed limiter release it as usual.
+func (c *ConcurrencyLimits) RetainUpstreams(addresses []string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for address := range c.upstreams {
+		if !slices.Contains(addresses, address) {
+			delete(c.upstreams, address)
+		}
+	}
+}
+
+// Stats returns the state of the limiters of upstream servers and services.
+func (c *ConcurrencyLimits) Stats() (upstreams []ConcurrencyStats, services []ConcurrencyStats) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for key, limiter := range c.upstreams {
+		upstreams = append(upstreams, limiter.Stats(key))
+	}
+	for key, limiter := range c.services {
+		services = append(services, limiter.Stats(key))
+	}
+
+	compare := func(a, b ConcurrencyStats) int { return cmp.Compare(a.Key, b.Key) }
+	slices.SortFunc(upstreams, compare)
+	slices.SortFunc(services, compare)
+	return upstreams, services
+}
+
+// ConcurrencyLimiter limits the number of concurrent requests.
+// Requests exceeding the limit wait in a bounded FIFO queue until a slot is free.
+//
+// ConcurrencyLimiter must be created using [NewConcurrencyLimiter].
+type ConcurrencyLimiter struct {
+	config LimitConfig
+
+	mutex    *sync.Mutex
+	limit    float64
+	inFlight int
+	queue    []chan struct{}
+
+	// lastBackoff is the time the limit was last decreased.
+	lastBackoff time.Time
+}
+
+// NewConcurrencyLimiter creates a limiter.
+func NewConcurrencyLimiter(config LimitConfig) *ConcurrencyLimiter {
+	limit := float64(config.MaxInFlight)
+	if config.Adaptive.Enabled {
+		if limit == 0 {
+			limit = float64(config.Adaptive.MaxLimit)
+		}
+		limit = min(max(limit, float64(config.Adaptive.MinLimit)), float64(config.Adaptive.MaxLimit))
+		if config.Adaptive.BackoffRatio == 0 {
+			config.Adaptive.BackoffRatio = 0.9
+		}
+	}
+	if limit == 0 {
+		limit = math.Inf(1)
+	}
+
+	return &ConcurrencyLimiter{
+		config: config,
+		mutex:  &sync.Mutex{},
+		limit:  limit,
+	}
+}
+
+// Acquire acquires a slot, waiting in the queue if necessary.
+// If the request is rejected, the returned error is a gRPC status error.
+func (c *ConcurrencyLimiter) Acquire(ctx context.Context) (Release, error) {
+	c.mutex.Lock()
+	if float64(c.inFlight) < math.Floor(c.limit) {
+		c.inFlight++
+		c.mutex.Unlock()
+		return c.releaseFunc(), nil
+	}
+
+	if len(c.queue) >= c.config.MaxQueue {
+		c.mutex.Unlock()
+		return nil, status.Error(codes.ResourceExhausted, "too many concurrent requests")
+	}
+
+	ready := make(chan struct{})
+	c.queue = append(c.queue, ready)
+	c.mutex.Unlock()
+
+	var timeout <-chan time.Time
+	if c.config.QueueTimeout > 0 {
+		timer := time.NewTimer(c.config.QueueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	var err error
+	select {
+	case <-ready:
+		return c.releaseFunc(), nil
+	case <-timeout:
+		err = status.Error(codes.ResourceExhausted, "too many concurrent requests")
+	case <-ctx.Done():
+		err = status.FromContextError(ctx.Err()).Err()
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	index := slices.Index(c.queue, ready)
+	if index == -1 {
+		// The slot was granted while giving up.
+		return c.releaseFunc(), nil
+	}
+	c.queue = slices.Delete(c.queue, index, index+1)
+	return nil, err
+}
+
+func (c *ConcurrencyLimiter) releaseFunc() Release {
+	start := time.Now()
+	var once sync.Once
+	return func(code codes.Code, latency time.Duration) {
+		once.Do(func() { c.release(start, code, latency) })
+	}
+}
+
+func (c *ConcurrencyLimiter) release(start time.Time, code codes.Code, latency time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.inFlight--
+	if c.config.Adaptive.Enabled && code != codes.Canceled {
+		c.adapt(start, code, latency)
+	}
+
+	for len(c.queue) != 0 && float64(c.inFlight) < math.Floor(c.limit) {
+		c.inFlight++
+		close(c.queue[0])
+		c.queue = c.queue[1:]
+	}
+}
+
+func (c *ConcurrencyLimiter) adapt(start time.Time, code codes.Code, latency time.Duration) {
+	adaptive := c.config.Adaptive
+	overloaded := code == codes.Unavailable || code == codes.ResourceExhausted || code == codes.DeadlineExceeded ||
+		(adaptive.LatencyThreshold > 0 && latency > adaptive.LatencyThreshold)
+
+	if !overloaded {
+		c.limit = min(c.limit+1/c.limit, float64(adaptive.MaxLimit))
+		return
+	}
+
+	// Requests started before the last backoff don't reflect the current limit.
+	if start.Before(c.lastBackoff) {
+		return
+	}
+
+	c.lastBackoff = time.Now()
+	c.limit = max(c.limit*adaptive.BackoffRatio, float64(adaptive.MinLimit))
+}
+
+// Stats returns the state of the limiter.
+func (c *ConcurrencyLimiter) Stats(key string) ConcurrencyStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	limit := -1
+	if !math.IsInf(c.limit, 1) {
+		limit = int(c.limit)
+	}
+
+	return ConcurrencyStats{
+		Key:      key,
+		InFlight: c.inFlight,
+		Queued:   len(c.queue),
+		Limit:    limit,
+	}
+}
@@ -0,0 +1,229 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	ratelimitv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	rlsv3 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"github.com/natk64/pancake-proxy/auth"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// Sources of descriptor entry values, see [DescriptorEntry.From].
+const (
+	FromService = "service"
+	FromMethod  = "method"
+	FromClient  = "client"
+	FromIP      = "ip"
+)
+
+// GlobalConfig configures a [Global] rate limiter.
+type GlobalConfig struct {
+	// Address is the address of a gRPC service implementing envoy.service.ratelimit.v3.RateLimitService.
+	Address string `mapstructure:"address"`
+
+	// Plaintext disables TLS for the rate limit service.
+	Plaintext bool `mapstructure:"plaintext"`
+
+	// Domain is the rate limit domain sent with every request.
+	Domain string `mapstructure:"domain"`
+
+	// Timeout limits the duration of a rate limit request. The default is 100ms.
+	Timeout time.Duration `mapstructure:"timeout"`
+
+	// FailOpen allows requests if the rate limit service fails, instead of rejecting them with UNAVAILABLE.
+	// The default is true.
+	FailOpen *bool `mapstructure:"fail_open"`
+
+	// Descriptors specify the descriptors sent for requests.
+	Descriptors []Descriptor `mapstructure:"descriptors"`
+
+	Logger *zap.Logger `mapstructure:"-"`
+}
+
+// Descriptor specifies a rate limit descriptor that is sent for requests to a set of methods.
+type Descriptor struct {
+	// Methods lists the methods the descriptor is sent for, see [auth.MatchMethod] for the syntax. All methods if empty.
+	Methods []string `mapstructure:"methods"`
+
+	Entries []DescriptorEntry `mapstructure:"entries"`
+}
+
+// DescriptorEntry is a key value pair of a descriptor.
+// If the value of an entry can't be determined, e.g. because the header is missing, the descriptor isn't sent.
+type DescriptorEntry struct {
+	Key string `mapstructure:"key"`
+
+	// Value is a fixed value for the entry.
+	Value string `mapstructure:"value"`
+
+	// From specifies where the value comes from if Value is empty.
+	// Either 'service', 'method', 'client', 'ip' or 'header:<name>'.
+	From string `mapstructure:"from"`
+}
+
+// Global limits requests using an external rate limit service compatible with Envoy,
+// so limits can be shared between multiple instances.
+//
+// Global must be created using [NewGlobal].
+type Global struct {
+	config GlobalConfig
+	client rlsv3.RateLimitServiceClient
+	logger *zap.Logger
+}
+
+// NewGlobal creates a limiter using the rate limit service.
+func NewGlobal(config GlobalConfig) (*Global, error) {
+	if config.Logger == nil {
+		config.Logger = zap.NewNop()
+	}
+	if config.Address == "" {
+		return nil, fmt.Errorf("the address of the rate limit service is required")
+	}
+	if config.Domain == "" {
+		return nil, fmt.Errorf("a rate limit domain is required")
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = time.Millisecond * 100
+	}
+	if config.FailOpen == nil {
+		failOpen := true
+		config.FailOpen = &failOpen
+	}
+
+	for i, descriptor := range config.Descriptors {
+		if len(descriptor.Entries) == 0 {
+			return nil, fmt.Errorf("descriptor #%d has no entries", i+1)
+		}
+		for _, entry := range descriptor.Entries {
+			if err := checkEntry(entry); err != nil {
+				return nil, fmt.Errorf("descriptor #%d, %w", i+1, err)
+			}
+		}
+	}
+
+	creds := credentials.NewTLS(nil)
+	if config.Plaintext {
+		creds = insecure.NewCredentials()
+	}
+
+	conn, err := grpc.NewClient(config.Address, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Global{
+		config: config,
+		client: rlsv3.NewRateLimitServiceClient(conn),
+		logger: config.Logger,
+	}, nil
+}
+
+func checkEntry(entry DescriptorEntry) error {
+	if entry.Key == "" {
+		return fmt.Errorf("descriptor entries require a key")
+	}
+	if entry.Value != "" {
+		return nil
+	}
+
+	switch {
+	case entry.From == FromService, entry.From == FromMethod, entry.From == FromClient, entry.From == FromIP:
+	case strings.HasPrefix(entry.From, KeyHeaderPrefix) && len(entry.From) > len(KeyHeaderPrefix):
+	default:
+		return fmt.Errorf("invalid value source '%s' of entry %s", entry.From, entry.Key)
+	}
+	return nil
+}
+
+// Allow asks the rate limit service whether a request is allowed.
+// If it isn't, the returned error is a gRPC status error and the duration is the time after which the limit is reset, if known.
+func (g *Global) Allow(ctx context.Context, r Request) (time.Duration, error) {
+	descriptors := g.descriptors(r)
+	if len(descriptors) == 0 {
+		return 0, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, g.config.Timeout)
+	defer cancel()
+
+	response, err := g.client.ShouldRateLimit(ctx, &rlsv3.RateLimitRequest{
+		Domain:      g.config.Domain,
+		Descriptors: descriptors,
+		HitsAddend:  1,
+	})
+	if err != nil {
+		if *g.config.FailOpen {
+			g.logger.Warn("Rate limit request failed, allowing request", zap.String("method", r.Method), zap.Error(err))
+			return 0, nil
+		}
+		g.logger.Warn("Rate limit request failed, rejecting request", zap.String("method", r.Method), zap.Error(err))
+		return 0, status.Error(codes.Unavailable, "rate limit service unavailable")
+	}
+
+	if response.OverallCode != rlsv3.RateLimitResponse_OVER_LIMIT {
+		return 0, nil
+	}
+
+	var retryAfter time.Duration
+	for _, descriptorStatus := range response.Statuses {
+		if descriptorStatus.Code == rlsv3.RateLimitResponse_OVER_LIMIT && descriptorStatus.DurationUntilReset != nil {
+			retryAfter = max(retryAfter, descriptorStatus.DurationUntilReset.AsDuration())
+		}
+	}
+
+	return retryAfter, status.Error(codes.ResourceExhausted, "rate limit exceeded")
+}
+
+func (g *Global) descriptors(r Request) []*ratelimitv3.RateLimitDescriptor {
+	var descriptors []*ratelimitv3.RateLimitDescriptor
+
+outer:
+	for _, descriptor := range g.config.Descriptors {
+		if len(descriptor.Methods) != 0 && !auth.MatchAnyMethod(descriptor.Methods, r.Method) {
+			continue
+		}
+
+		var entries []*ratelimitv3.RateLimitDescriptor_Entry
+		for _, entry := range descriptor.Entries {
+			value := entryValue(entry, r)
+			if value == "" {
+				continue outer
+			}
+			entries = append(entries, &ratelimitv3.RateLimitDescriptor_Entry{Key: entry.Key, Value: value})
+		}
+
+		descriptors = append(descriptors, &ratelimitv3.RateLimitDescriptor{Entries: entries})
+	}
+
+	return descriptors
+}
+
+func entryValue(entry DescriptorEntry, r Request) string {
+	if entry.Value != "" {
+		return entry.Value
+	}
+
+	service, _, _ := strings.Cut(strings.TrimPrefix(r.Method, "/"), "/")
+	switch {
+	case entry.From == FromService:
+		return service
+	case entry.From == FromMethod:
+		return strings.TrimPrefix(r.Method, "/")
+	case entry.From == FromClient:
+		return r.Client
+	case entry.From == FromIP:
+		return r.IP
+	case strings.HasPrefix(entry.From, KeyHeaderPrefix):
+		return r.Header.Get(strings.TrimPrefix(entry.From, KeyHeaderPrefix))
+	}
+	return ""
+}
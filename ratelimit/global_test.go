@@ -0,0 +1,155 @@
+package ratelimit
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	rlsv3 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// fakeRateLimitService answers rate limit requests with a fixed response.
+type fakeRateLimitService struct {
+	rlsv3.UnimplementedRateLimitServiceServer
+
+	response *rlsv3.RateLimitResponse
+	delay    time.Duration
+	requests chan *rlsv3.RateLimitRequest
+}
+
+func (s *fakeRateLimitService) ShouldRateLimit(ctx context.Context, r *rlsv3.RateLimitRequest) (*rlsv3.RateLimitResponse, error) {
+	s.requests <- r
+	select {
+	case <-time.After(s.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return s.response, nil
+}
+
+func startRateLimitService(t *testing.T, service *fakeRateLimitService) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	service.requests = make(chan *rlsv3.RateLimitRequest, 10)
+	server := grpc.NewServer()
+	rlsv3.RegisterRateLimitServiceServer(server, service)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	return listener.Addr().String()
+}
+
+func newTestGlobal(t *testing.T, config GlobalConfig) *Global {
+	t.Helper()
+
+	config.Plaintext = true
+	config.Domain = "pancake"
+	config.Descriptors = []Descriptor{
+		{Entries: []DescriptorEntry{{Key: "method", From: FromMethod}}},
+		{Methods: []string{"test.Service"}, Entries: []DescriptorEntry{{Key: "tenant", From: "header:x-tenant"}}},
+	}
+
+	limiter, err := NewGlobal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return limiter
+}
+
+func TestGlobalDefaults(t *testing.T) {
+	limiter := newTestGlobal(t, GlobalConfig{Address: "127.0.0.1:1"})
+
+	if limiter.config.Timeout != time.Millisecond*100 {
+		t.Errorf("expected the default timeout of 100ms, got %s", limiter.config.Timeout)
+	}
+	if limiter.config.FailOpen == nil || !*limiter.config.FailOpen {
+		t.Error("expected fail_open to default to true")
+	}
+}
+
+func TestGlobalDescriptors(t *testing.T) {
+	service := &fakeRateLimitService{response: &rlsv3.RateLimitResponse{OverallCode: rlsv3.RateLimitResponse_OK}}
+	limiter := newTestGlobal(t, GlobalConfig{Address: startRateLimitService(t, service)})
+
+	header := http.Header{}
+	header.Set("x-tenant", "acme")
+	if _, err := limiter.Allow(context.Background(), Request{Method: "/test.Service/Get", Header: header}); err != nil {
+		t.Fatalf("expected the request to be allowed, got %v", err)
+	}
+
+	request := <-service.requests
+	if request.Domain != "pancake" {
+		t.Errorf("expected domain pancake, got %s", request.Domain)
+	}
+	if len(request.Descriptors) != 2 {
+		t.Fatalf("expected 2 descriptors, got %d", len(request.Descriptors))
+	}
+	if entry := request.Descriptors[0].Entries[0]; entry.Key != "method" || entry.Value != "test.Service/Get" {
+		t.Errorf("unexpected method entry %s=%s", entry.Key, entry.Value)
+	}
+	if entry := request.Descriptors[1].Entries[0]; entry.Key != "tenant" || entry.Value != "acme" {
+		t.Errorf("unexpected tenant entry %s=%s", entry.Key, entry.Value)
+	}
+
+	// Without the header, the tenant descriptor isn't sent.
+	if _, err := limiter.Allow(context.Background(), Request{Method: "/test.Service/Get"}); err != nil {
+		t.Fatalf("expected the request to be allowed, got %v", err)
+	}
+	if request := <-service.requests; len(request.Descriptors) != 1 {
+		t.Errorf("expected 1 descriptor without the header, got %d", len(request.Descriptors))
+	}
+}
+
+func TestGlobalOverLimit(t *testing.T) {
+	service := &fakeRateLimitService{response: &rlsv3.RateLimitResponse{
+		OverallCode: rlsv3.RateLimitResponse_OVER_LIMIT,
+		Statuses: []*rlsv3.RateLimitResponse_DescriptorStatus{
+			{Code: rlsv3.RateLimitResponse_OVER_LIMIT, DurationUntilReset: durationpb.New(time.Second * 3)},
+			{Code: rlsv3.RateLimitResponse_OK},
+		},
+	}}
+	limiter := newTestGlobal(t, GlobalConfig{Address: startRateLimitService(t, service)})
+
+	retryAfter, err := limiter.Allow(context.Background(), Request{Method: "/test.Service/Get"})
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("expected RESOURCE_EXHAUSTED, got %v", err)
+	}
+	if retryAfter != time.Second*3 {
+		t.Errorf("expected a retry after 3s, got %s", retryAfter)
+	}
+}
+
+func TestGlobalFailure(t *testing.T) {
+	service := &fakeRateLimitService{
+		response: &rlsv3.RateLimitResponse{OverallCode: rlsv3.RateLimitResponse_OVER_LIMIT},
+		delay:    time.Second,
+	}
+	address := startRateLimitService(t, service)
+
+	// The default timeout and fail_open allow requests when the service is too slow.
+	limiter := newTestGlobal(t, GlobalConfig{Address: address})
+	start := time.Now()
+	if _, err := limiter.Allow(context.Background(), Request{Method: "/test.Service/Get"}); err != nil {
+		t.Errorf("expected the request to be allowed, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Millisecond*500 {
+		t.Errorf("expected the request to time out after 100ms, took %s", elapsed)
+	}
+
+	failOpen := false
+	limiter = newTestGlobal(t, GlobalConfig{Address: address, FailOpen: &failOpen})
+	if _, err := limiter.Allow(context.Background(), Request{Method: "/test.Service/Get"}); status.Code(err) != codes.Unavailable {
+		t.Errorf("expected UNAVAILABLE, got %v", err)
+	}
+}
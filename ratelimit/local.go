@@ -0,0 +1,251 @@
+package ratelimit
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/natk64/pancake-proxy/auth"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// Limiters that weren't used for this duration are removed.
+	idleTimeout = time.Minute * 10
+
+	defaultMaxKeys = 10000
+)
+
+// Key types of a [Rule].
+const (
+	// KeyClient limits every client separately, identified by the API key, JWT subject or certificate, in this order.
+	// Clients without an identity are identified by their IP address.
+	KeyClient = "client"
+
+	// KeyIP limits every IP address separately.
+	KeyIP = "ip"
+
+	// KeyHeaderPrefix followed by a header name limits every value of the header separately.
+	KeyHeaderPrefix = "header:"
+
+	// KeyGlobal uses a single limiter for all requests.
+	KeyGlobal = "global"
+)
+
+// Rule limits the requests to a set of methods.
+type Rule struct {
+	// Name identifies the rule in logs and statistics.
+	Name string `mapstructure:"name"`
+
+	// Methods lists the methods the rule applies to, see [auth.MatchMethod] for the syntax. All methods if empty.
+	Methods []string `mapstructure:"methods"`
+
+	// Key specifies how requests are grouped, see [KeyClient], [KeyIP], [KeyHeaderPrefix] and [KeyGlobal].
+	// The default is [KeyClient].
+	Key string `mapstructure:"key"`
+
+	// Rate is the number of requests per second.
+	Rate float64 `mapstructure:"rate"`
+
+	// Burst is the number of requests allowed to exceed the rate at once, the default is the rate rounded up.
+	Burst int `mapstructure:"burst"`
+
+	// MaxKeys is the maximum number of keys that have a limiter, the default is 10000.
+	// Once it's reached, the limiter of the least recently used key is removed,
+	// so clients can't exhaust the memory by sending many different keys.
+	MaxKeys int `mapstructure:"max_keys"`
+}
+
+// Request describes a request that is rate limited.
+type Request struct {
+	Method string
+
+	// Client identifies the client, if it's known.
+	Client string
+	IP     string
+	Header http.Header
+}
+
+// RuleStats contains the state of a rule.
+type RuleStats struct {
+	Name    string
+	Allowed uint64
+	Limited uint64
+
+	// Keys is the number of keys that currently have a limiter.
+	Keys int
+}
+
+// Local limits requests using token buckets kept in memory.
+//
+// Local must be created using [NewLocal].
+type Local struct {
+	rules []*localRule
+}
+
+type localRule struct {
+	Rule
+
+	allowed *atomic.Uint64
+	limited *atomic.Uint64
+
+	// limiters contains the elements of recentlyUsed by key.
+	// recentlyUsed contains the limiters ordered by their last use, the most recently used first.
+	mutex        *sync.Mutex
+	limiters     map[string]*list.Element
+	recentlyUsed *list.List
+}
+
+type keyLimiter struct {
+	key      string
+	limiter  *rate.Limiter
+	lastUsed time.Time
+}
+
+// NewLocal creates a limiter enforcing the rules.
+func NewLocal(rules []Rule) (*Local, error) {
+	l := &Local{}
+	for i, rule := range rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("#%d", i+1)
+		}
+		if rule.Key == "" {
+			rule.Key = KeyClient
+		}
+		if rule.Rate <= 0 {
+			return nil, fmt.Errorf("rate limit %s, rate must be positive", rule.Name)
+		}
+		if rule.Burst <= 0 {
+			rule.Burst = int(math.Ceil(rule.Rate))
+		}
+		if rule.MaxKeys <= 0 {
+			rule.MaxKeys = defaultMaxKeys
+		}
+
+		switch {
+		case rule.Key == KeyClient, rule.Key == KeyIP, rule.Key == KeyGlobal:
+		case strings.HasPrefix(rule.Key, KeyHeaderPrefix) && len(rule.Key) > len(KeyHeaderPrefix):
+		default:
+			return nil, fmt.Errorf("rate limit %s, invalid key '%s'", rule.Name, rule.Key)
+		}
+
+		l.rules = append(l.rules, &localRule{
+			Rule:         rule,
+			allowed:      &atomic.Uint64{},
+			limited:      &atomic.Uint64{},
+			mutex:        &sync.Mutex{},
+			limiters:     make(map[string]*list.Element),
+			recentlyUsed: list.New(),
+		})
+	}
+
+	return l, nil
+}
+
+// Allow checks whether a request is allowed by all rules that apply to it.
+// If it isn't, Allow returns the time after which the request would be allowed.
+func (l *Local) Allow(r Request) (time.Duration, bool) {
+	now := time.Now()
+	var matched []*localRule
+	var reservations []*rate.Reservation
+	for _, rule := range l.rules {
+		if len(rule.Methods) != 0 && !auth.MatchAnyMethod(rule.Methods, r.Method) {
+			continue
+		}
+
+		reservation := rule.limiter(rule.key(r), now).ReserveN(now, 1)
+		if delay := reservation.DelayFrom(now); !reservation.OK() || delay > 0 {
+			rule.limited.Add(1)
+
+			// Return the tokens, since the request is rejected.
+			reservation.CancelAt(now)
+			for _, reservation := range reservations {
+				reservation.CancelAt(now)
+			}
+
+			if !reservation.OK() {
+				delay = time.Second
+			}
+			return delay, false
+		}
+
+		matched = append(matched, rule)
+		reservations = append(reservations, reservation)
+	}
+
+	for _, rule := range matched {
+		rule.allowed.Add(1)
+	}
+	return 0, true
+}
+
+// Stats returns the state of every rule.
+func (l *Local) Stats() []RuleStats {
+	var stats []RuleStats
+	for _, rule := range l.rules {
+		rule.mutex.Lock()
+		keys := len(rule.limiters)
+		rule.mutex.Unlock()
+
+		stats = append(stats, RuleStats{
+			Name:    rule.Name,
+			Allowed: rule.allowed.Load(),
+			Limited: rule.limited.Load(),
+			Keys:    keys,
+		})
+	}
+	return stats
+}
+
+func (rule *localRule) key(r Request) string {
+	switch {
+	case rule.Key == KeyGlobal:
+		return ""
+	case rule.Key == KeyIP:
+		return r.IP
+	case strings.HasPrefix(rule.Key, KeyHeaderPrefix):
+		return r.Header.Get(strings.TrimPrefix(rule.Key, KeyHeaderPrefix))
+	}
+
+	if r.Client != "" {
+		return "client:" + r.Client
+	}
+	return "ip:" + r.IP
+}
+
+func (rule *localRule) limiter(key string, now time.Time) *rate.Limiter {
+	rule.mutex.Lock()
+	defer rule.mutex.Unlock()
+
+	for oldest := rule.recentlyUsed.Back(); oldest != nil; oldest = rule.recentlyUsed.Back() {
+		if now.Sub(oldest.Value.(*keyLimiter).lastUsed) <= idleTimeout {
+			break
+		}
+		rule.remove(oldest)
+	}
+
+	if element, ok := rule.limiters[key]; ok {
+		limiter := element.Value.(*keyLimiter)
+		limiter.lastUsed = now
+		rule.recentlyUsed.MoveToFront(element)
+		return limiter.limiter
+	}
+
+	if len(rule.limiters) >= rule.MaxKeys {
+		rule.remove(rule.recentlyUsed.Back())
+	}
+
+	limiter := &keyLimiter{key: key, limiter: rate.NewLimiter(rate.Limit(rule.Rate), rule.Burst), lastUsed: now}
+	rule.limiters[key] = rule.recentlyUsed.PushFront(limiter)
+	return limiter.limiter
+}
+
+func (rule *localRule) remove(element *list.Element) {
+	rule.recentlyUsed.Remove(element)
+	delete(rule.limiters, element.Value.(*keyLimiter).key)
+}
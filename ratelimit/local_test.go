@@ -0,0 +1,48 @@
+package ratelimit
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestLocalMaxKeys(t *testing.T) {
+	limiter, err := NewLocal([]Rule{{Name: "ips", Key: KeyIP, Rate: 1, MaxKeys: 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every IP can make a single request, then it's limited.
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2"} {
+		if _, ok := limiter.Allow(Request{Method: "/test.Service/Get", IP: ip}); !ok {
+			t.Fatalf("expected the first request of %s to be allowed", ip)
+		}
+	}
+	if _, ok := limiter.Allow(Request{Method: "/test.Service/Get", IP: "10.0.0.2"}); ok {
+		t.Fatal("expected the second request of 10.0.0.2 to be limited")
+	}
+
+	// A third key removes the least recently used one, which is 10.0.0.1.
+	if _, ok := limiter.Allow(Request{Method: "/test.Service/Get", IP: "10.0.0.3"}); !ok {
+		t.Fatal("expected the first request of 10.0.0.3 to be allowed")
+	}
+	if keys := limiter.Stats()[0].Keys; keys != 2 {
+		t.Errorf("expected 2 keys, got %d", keys)
+	}
+	if _, ok := limiter.Allow(Request{Method: "/test.Service/Get", IP: "10.0.0.2"}); ok {
+		t.Error("expected 10.0.0.2 to still be limited")
+	}
+}
+
+func TestLocalDefaultMaxKeys(t *testing.T) {
+	limiter, err := NewLocal([]Rule{{Key: KeyIP, Rate: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range defaultMaxKeys + 100 {
+		limiter.Allow(Request{Method: "/test.Service/Get", IP: fmt.Sprintf("ip-%d", i)})
+	}
+	if keys := limiter.Stats()[0].Keys; keys != defaultMaxKeys {
+		t.Errorf("expected %d keys, got %d", defaultMaxKeys, keys)
+	}
+}
@@ -0,0 +1,284 @@
+// Package record records calls to a file and replays them, to test upstream servers with real traffic.
+package record
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/natk64/pancake-proxy/auth"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Call is a recorded call. Recordings contain one call per line, encoded as JSON.
+type Call struct {
+	Time time.Time `json:"time"`
+
+	// Method is the full method name like '/package.Service/Method'.
+	Method   string `json:"method"`
+	Upstream string `json:"upstream"`
+
+	// Header contains the request metadata sent to the upstream server.
+	Header   http.Header `json:"header"`
+	Requests []Message   `json:"requests"`
+
+	ResponseHeader http.Header `json:"response_header"`
+	Responses      []Message   `json:"responses"`
+	Trailer        http.Header `json:"trailer"`
+
+	Code     codes.Code    `json:"code"`
+	Duration time.Duration `json:"duration"`
+
+	// Incomplete is set if messages are missing, because they were too large or there were too many.
+	Incomplete bool `json:"incomplete,omitempty"`
+}
+
+// Message is a single message of a recorded call.
+type Message struct {
+	// Offset is the time since the start of the call.
+	Offset     time.Duration `json:"offset"`
+	Compressed bool          `json:"compressed,omitempty"`
+	Data       []byte        `json:"data"`
+}
+
+// Config configures a [Recorder].
+type Config struct {
+	// Methods lists the recorded methods, see [auth.MatchMethod] for the syntax.
+	Methods []string `mapstructure:"methods"`
+
+	// Output is the path of the recording.
+	Output string `mapstructure:"output"`
+
+	// MaxSize is the size in megabytes at which the file is rotated. The default is 100.
+	MaxSize int `mapstructure:"max_size"`
+
+	// MaxBackups is the number of rotated files that are kept, all if 0.
+	MaxBackups int `mapstructure:"max_backups"`
+
+	// ExcludeHeaders lists request headers that aren't recorded in addition to [DefaultExcludeHeaders].
+	ExcludeHeaders []string `mapstructure:"exclude_headers"`
+
+	// MaxMessages is the maximum number of recorded messages per call. The default is 1000.
+	MaxMessages int `mapstructure:"max_messages"`
+
+	// MaxCallSize is the maximum size in megabytes of the recorded messages of a call. The default is 4.
+	// It limits the memory used by calls in progress.
+	MaxCallSize int `mapstructure:"max_call_size"`
+
+	Logger *zap.Logger `mapstructure:"-"`
+}
+
+// DefaultExcludeHeaders are the credential headers that are never recorded.
+var DefaultExcludeHeaders = []string{"authorization", "cookie", "x-api-key"}
+
+// Recorder writes calls to a recording.
+//
+// Recorder must be created using [New].
+type Recorder struct {
+	config Config
+	output io.WriteCloser
+	mutex  *sync.Mutex
+}
+
+// New creates a recorder writing to the configured output.
+func New(config Config) (*Recorder, error) {
+	if config.Logger == nil {
+		config.Logger = zap.NewNop()
+	}
+	if config.Output == "" {
+		return nil, errors.New("the recording output is required")
+	}
+	if config.MaxSize <= 0 {
+		config.MaxSize = 100
+	}
+	if config.MaxMessages <= 0 {
+		config.MaxMessages = 1000
+	}
+	if config.MaxCallSize <= 0 {
+		config.MaxCallSize = 4
+	}
+	config.ExcludeHeaders = append(slices.Clone(DefaultExcludeHeaders), config.ExcludeHeaders...)
+
+	return &Recorder{
+		config: config,
+		output: &lumberjack.Logger{
+			Filename:   config.Output,
+			MaxSize:    config.MaxSize,
+			MaxBackups: config.MaxBackups,
+		},
+		mutex: &sync.Mutex{},
+	}, nil
+}
+
+// Close closes the recording.
+func (r *Recorder) Close() error {
+	return r.output.Close()
+}
+
+// Recording collects a single call while it's in progress. All methods are safe to call on a nil Recording.
+type Recording struct {
+	recorder *Recorder
+	start    time.Time
+	call     Call
+	mutex    *sync.Mutex
+
+	// size is the total size of the recorded messages.
+	size int
+}
+
+// Start returns the recording of a call, or nil if the method isn't recorded.
+func (r *Recorder) Start(method string) *Recording {
+	if !auth.MatchAnyMethod(r.config.Methods, method) {
+		return nil
+	}
+
+	now := time.Now()
+	return &Recording{
+		recorder: r,
+		start:    now,
+		call:     Call{Time: now, Method: method},
+		mutex:    &sync.Mutex{},
+	}
+}
+
+// Request records the request metadata sent to the upstream server.
+func (r *Recording) Request(upstream string, header http.Header) {
+	if r == nil {
+		return
+	}
+
+	header = header.Clone()
+	for _, name := range r.recorder.config.ExcludeHeaders {
+		header.Del(name)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.call.Upstream = upstream
+	r.call.Header = header
+}
+
+// Response records the response metadata received from the upstream server.
+func (r *Recording) Response(header, trailer http.Header) {
+	if r == nil {
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.call.ResponseHeader = header.Clone()
+	r.call.Trailer = trailer.Clone()
+}
+
+// Accepts reports whether a message of the size would be recorded, so it's only buffered if it's needed.
+// If it wouldn't be recorded, the call is marked as incomplete. It returns false for a nil Recording.
+func (r *Recording) Accepts(size int) bool {
+	if r == nil {
+		return false
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if !r.acceptsLocked(size) {
+		r.call.Incomplete = true
+		return false
+	}
+	return true
+}
+
+func (r *Recording) acceptsLocked(size int) bool {
+	return len(r.call.Requests)+len(r.call.Responses) < r.recorder.config.MaxMessages &&
+		r.size+size <= r.recorder.config.MaxCallSize<<20
+}
+
+// Message records a complete message. If request is false, the message was sent by the server.
+func (r *Recording) Message(request, compressed bool, data []byte) {
+	if r == nil {
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if !r.acceptsLocked(len(data)) {
+		r.call.Incomplete = true
+		return
+	}
+
+	r.size += len(data)
+	message := Message{Offset: time.Since(r.start), Compressed: compressed, Data: data}
+	if request {
+		r.call.Requests = append(r.call.Requests, message)
+	} else {
+		r.call.Responses = append(r.call.Responses, message)
+	}
+}
+
+// Skipped marks the call as incomplete, because a message couldn't be recorded.
+func (r *Recording) Skipped() {
+	if r == nil {
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.call.Incomplete = true
+}
+
+// Finish writes the call to the recording. Calls that weren't forwarded to an upstream server aren't written.
+func (r *Recording) Finish(code codes.Code) {
+	if r == nil {
+		return
+	}
+
+	r.mutex.Lock()
+	call := r.call
+	r.mutex.Unlock()
+
+	if call.Header == nil {
+		return
+	}
+	call.Code = code
+	call.Duration = time.Since(r.start)
+
+	line, err := json.Marshal(call)
+	if err != nil {
+		r.recorder.config.Logger.Error("Failed to encode recorded call", zap.Error(err))
+		return
+	}
+	line = append(line, '\n')
+
+	r.recorder.mutex.Lock()
+	defer r.recorder.mutex.Unlock()
+	if _, err := r.recorder.output.Write(line); err != nil {
+		r.recorder.config.Logger.Error("Failed to write recorded call", zap.Error(err))
+	}
+}
+
+// Reader reads the calls of a recording.
+type Reader struct {
+	decoder *json.Decoder
+}
+
+// NewReader creates a reader for a recording.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{decoder: json.NewDecoder(r)}
+}
+
+// Next returns the next call of the recording, or [io.EOF] at its end.
+func (r *Reader) Next() (Call, error) {
+	var call Call
+	if err := r.decoder.Decode(&call); err != nil {
+		if errors.Is(err, io.EOF) {
+			return Call{}, io.EOF
+		}
+		return Call{}, fmt.Errorf("invalid recording, %w", err)
+	}
+	return call, nil
+}
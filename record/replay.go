@@ -0,0 +1,286 @@
+package record
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/natk64/pancake-proxy/payload"
+	"github.com/natk64/pancake-proxy/reflection"
+	"go.uber.org/zap"
+	"golang.org/x/net/http2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// ReplayConfig configures a [Replayer].
+type ReplayConfig struct {
+	// Target is the address of the proxy or upstream server the calls are sent to.
+	Target string
+
+	// Plaintext disables TLS, InsecureSkipVerify disables the verification of the server certificate.
+	Plaintext          bool
+	InsecureSkipVerify bool
+
+	// Header is added to the recorded request metadata, replacing recorded values, e.g. for credentials.
+	Header http.Header
+
+	// Ignore lists fields that aren't compared, as patterns of their full names like '*.created_at'.
+	Ignore []string
+
+	// Timing sends the request messages with the recorded delays, instead of all at once.
+	Timing bool
+
+	Logger *zap.Logger
+}
+
+// Result is the outcome of a replayed call.
+type Result struct {
+	Code      codes.Code
+	Responses []Message
+
+	// Differences describes how the responses differ from the recorded ones, it's empty if they match.
+	Differences []string
+}
+
+// Replayer sends recorded calls to a server and compares the responses.
+// The messages are compared as JSON if the server supports reflection, otherwise their binary encoding is compared.
+//
+// Replayer must be created using [NewReplayer].
+type Replayer struct {
+	config     ReplayConfig
+	httpClient *http.Client
+	decoder    *payload.Decoder
+
+	conn             *grpc.ClientConn
+	reflectionClient *reflection.ReflectionClient
+	resolver         *reflection.SimpleResolver
+
+	// resolved contains the services whose descriptors were requested.
+	resolved map[string]bool
+	mutex    *sync.Mutex
+}
+
+// NewReplayer creates a replayer for the target.
+func NewReplayer(config ReplayConfig) (*Replayer, error) {
+	if config.Logger == nil {
+		config.Logger = zap.NewNop()
+	}
+
+	// The decoder only redacts the ignored fields, messages must not be truncated.
+	decoder, err := payload.NewDecoder(payload.Config{Redact: config.Ignore, MaxSize: math.MaxInt})
+	if err != nil {
+		return nil, err
+	}
+
+	var transport *http2.Transport
+	var credentialsOption grpc.DialOption
+	if config.Plaintext {
+		transport = &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, addr)
+			},
+		}
+		credentialsOption = grpc.WithTransportCredentials(insecure.NewCredentials())
+	} else {
+		tlsConfig := &tls.Config{InsecureSkipVerify: config.InsecureSkipVerify}
+		transport = &http2.Transport{TLSClientConfig: tlsConfig}
+		credentialsOption = grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig.Clone()))
+	}
+
+	conn, err := grpc.NewClient(config.Target, credentialsOption)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Replayer{
+		config:           config,
+		httpClient:       &http.Client{Transport: transport},
+		decoder:          decoder,
+		conn:             conn,
+		reflectionClient: reflection.NewClient(conn),
+		resolver:         &reflection.SimpleResolver{},
+		resolved:         make(map[string]bool),
+		mutex:            &sync.Mutex{},
+	}, nil
+}
+
+// Close closes the connections to the target.
+func (r *Replayer) Close() error {
+	r.httpClient.CloseIdleConnections()
+	return r.conn.Close()
+}
+
+// Replay sends a recorded call to the target and compares the responses.
+// An error is returned if the call couldn't be sent.
+func (r *Replayer) Replay(ctx context.Context, call Call) (Result, error) {
+	body, writer := io.Pipe()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.url(call.Method), body)
+	if err != nil {
+		return Result{}, err
+	}
+
+	req.Header = call.Header.Clone()
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	for name, values := range r.config.Header {
+		req.Header[name] = values
+	}
+	if req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/grpc")
+	}
+	req.Header.Set("Te", "trailers")
+	// Compressed responses can't be compared.
+	req.Header.Del("Grpc-Accept-Encoding")
+
+	start := time.Now()
+	go r.writeRequests(writer, call, start)
+
+	response, err := r.httpClient.Do(req)
+	if err != nil {
+		body.Close()
+		return Result{}, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return Result{}, fmt.Errorf("unexpected HTTP status %d", response.StatusCode)
+	}
+
+	result := Result{Code: codes.Unknown}
+	if result.Responses, err = readMessages(response.Body, start); err != nil {
+		return Result{}, err
+	}
+
+	// Trailers-only responses contain the status in the headers.
+	rawCode := response.Trailer.Get("Grpc-Status")
+	if rawCode == "" {
+		rawCode = response.Header.Get("Grpc-Status")
+	}
+	if code, err := strconv.Atoi(rawCode); err == nil {
+		result.Code = codes.Code(code)
+	}
+
+	result.Differences = r.compare(call, result)
+	return result, nil
+}
+
+func (r *Replayer) url(method string) string {
+	if r.config.Plaintext {
+		return "http://" + r.config.Target + method
+	}
+	return "https://" + r.config.Target + method
+}
+
+// writeRequests writes the request messages to the body, waiting for their recorded offsets if timing is enabled.
+func (r *Replayer) writeRequests(w *io.PipeWriter, call Call, start time.Time) {
+	for _, message := range call.Requests {
+		if r.config.Timing {
+			time.Sleep(time.Until(start.Add(message.Offset)))
+		}
+
+		header := [5]byte{}
+		if message.Compressed {
+			header[0] = 1
+		}
+		binary.BigEndian.PutUint32(header[1:], uint32(len(message.Data)))
+		if _, err := w.Write(append(header[:], message.Data...)); err != nil {
+			w.CloseWithError(err)
+			return
+		}
+	}
+	w.Close()
+}
+
+// readMessages reads the length prefixed messages of a body.
+func readMessages(body io.Reader, start time.Time) ([]Message, error) {
+	var messages []Message
+	for {
+		header := [5]byte{}
+		if _, err := io.ReadFull(body, header[:]); err != nil {
+			if err == io.EOF {
+				return messages, nil
+			}
+			return nil, fmt.Errorf("failed to read response, %w", err)
+		}
+
+		data := make([]byte, binary.BigEndian.Uint32(header[1:]))
+		if _, err := io.ReadFull(body, data); err != nil {
+			return nil, fmt.Errorf("failed to read response, %w", err)
+		}
+		messages = append(messages, Message{Offset: time.Since(start), Compressed: header[0]&1 != 0, Data: data})
+	}
+}
+
+// compare describes the differences between the recorded and the replayed responses.
+func (r *Replayer) compare(call Call, result Result) []string {
+	var differences []string
+	if call.Code != result.Code {
+		differences = append(differences, fmt.Sprintf("status: recorded %s, replayed %s", call.Code, result.Code))
+	}
+	if len(call.Responses) != len(result.Responses) {
+		differences = append(differences, fmt.Sprintf("responses: recorded %d messages, replayed %d", len(call.Responses), len(result.Responses)))
+	}
+
+	decodable := r.resolve(call.Method)
+	for i := range min(len(call.Responses), len(result.Responses)) {
+		recorded, replayed := call.Responses[i], result.Responses[i]
+		if recorded.Compressed || replayed.Compressed {
+			r.config.Logger.Debug("Compressed messages aren't compared", zap.String("method", call.Method), zap.Int("response", i))
+			continue
+		}
+		if bytes.Equal(recorded.Data, replayed.Data) {
+			continue
+		}
+
+		if !decodable {
+			differences = append(differences, fmt.Sprintf("response %d: recorded %d bytes, replayed %d bytes", i, len(recorded.Data), len(replayed.Data)))
+			continue
+		}
+
+		// The binary encoding isn't deterministic, so equal messages may still differ.
+		recordedJSON := r.decoder.Decode(r.resolver, call.Method, false, recorded.Data)
+		replayedJSON := r.decoder.Decode(r.resolver, call.Method, false, replayed.Data)
+		if recordedJSON != replayedJSON {
+			differences = append(differences, fmt.Sprintf("response %d: recorded %s, replayed %s", i, recordedJSON, replayedJSON))
+		}
+	}
+	return differences
+}
+
+// resolve requests the descriptors of the service of a method using reflection, if they weren't requested before.
+// It reports whether the method can be decoded.
+func (r *Replayer) resolve(method string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	service, _, _ := strings.Cut(strings.TrimPrefix(method, "/"), "/")
+	if !r.resolved[service] {
+		r.resolved[service] = true
+
+		files, err := r.reflectionClient.AllFilesForSymbol(service)
+		if err != nil {
+			r.config.Logger.Warn("Failed to resolve service, messages are compared in binary", zap.String("service", service), zap.Error(err))
+		} else if err := r.resolver.RegisterFiles(files); err != nil {
+			r.config.Logger.Warn("Failed to register proto files", zap.String("service", service), zap.Error(err))
+		}
+	}
+
+	_, err := reflection.FindMethod(r.resolver, method)
+	return err == nil
+}
@@ -0,0 +1,94 @@
+package reflection
+
+import (
+	"strings"
+
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+var (
+	_ protoregistry.MessageTypeResolver   = TypeResolver{}
+	_ protoregistry.ExtensionTypeResolver = TypeResolver{}
+)
+
+// TypeResolver makes the descriptors of a [FileExtensionResolver] usable as message and extension types,
+// e.g. for protojson or proto.Unmarshal.
+//
+// All types are created using dynamicpb. Types which are not known to Files are looked up in [protoregistry.GlobalTypes].
+type TypeResolver struct {
+	Files FileExtensionResolver
+}
+
+// FindMessageByName implements protoregistry.MessageTypeResolver.
+func (t TypeResolver) FindMessageByName(name protoreflect.FullName) (protoreflect.MessageType, error) {
+	d, err := t.Files.FindDescriptorByName(name)
+	if err != nil {
+		return protoregistry.GlobalTypes.FindMessageByName(name)
+	}
+
+	md, ok := d.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, protoregistry.NotFound
+	}
+	return dynamicpb.NewMessageType(md), nil
+}
+
+// FindMessageByURL implements protoregistry.MessageTypeResolver.
+func (t TypeResolver) FindMessageByURL(url string) (protoreflect.MessageType, error) {
+	name := url
+	if i := strings.LastIndexByte(url, '/'); i >= 0 {
+		name = url[i+1:]
+	}
+	return t.FindMessageByName(protoreflect.FullName(name))
+}
+
+// FindExtensionByName implements protoregistry.ExtensionTypeResolver.
+func (t TypeResolver) FindExtensionByName(field protoreflect.FullName) (protoreflect.ExtensionType, error) {
+	d, err := t.Files.FindDescriptorByName(field)
+	if err != nil {
+		return protoregistry.GlobalTypes.FindExtensionByName(field)
+	}
+
+	xd, ok := d.(protoreflect.ExtensionDescriptor)
+	if !ok {
+		return nil, protoregistry.NotFound
+	}
+	return dynamicpb.NewExtensionType(xd), nil
+}
+
+// FindExtensionByNumber implements protoregistry.ExtensionTypeResolver.
+func (t TypeResolver) FindExtensionByNumber(message protoreflect.FullName, field protoreflect.FieldNumber) (protoreflect.ExtensionType, error) {
+	xd, err := t.Files.FindExtensionByNumber(message, field)
+	if err != nil {
+		return protoregistry.GlobalTypes.FindExtensionByNumber(message, field)
+	}
+	return dynamicpb.NewExtensionType(xd), nil
+}
+
+// FindMethod finds the descriptor of a method by its gRPC path, e.g. "/package.Service/Method".
+// The leading slash is optional.
+func FindMethod(resolver protodesc.Resolver, path string) (protoreflect.MethodDescriptor, error) {
+	serviceName, methodName, ok := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	if !ok {
+		return nil, protoregistry.NotFound
+	}
+
+	d, err := resolver.FindDescriptorByName(protoreflect.FullName(serviceName))
+	if err != nil {
+		return nil, err
+	}
+
+	service, ok := d.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil, protoregistry.NotFound
+	}
+
+	method := service.Methods().ByName(protoreflect.Name(methodName))
+	if method == nil {
+		return nil, protoregistry.NotFound
+	}
+	return method, nil
+}
@@ -0,0 +1,162 @@
+package rest
+
+import (
+	"fmt"
+	"net/http"
+
+	"go.uber.org/zap"
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// route maps an HTTP method and path template to a gRPC method.
+type route struct {
+	httpMethod   string
+	template     *pathTemplate
+	method       protoreflect.MethodDescriptor
+	body         string
+	responseBody string
+}
+
+// Router matches HTTP requests to the gRPC methods annotated with google.api.http rules.
+type Router struct {
+	routes []*route
+}
+
+// Match is a request matched by a [Router].
+type Match struct {
+	route  *route
+	values []string
+}
+
+// Method returns the gRPC method that is called for the request.
+func (m *Match) Method() protoreflect.MethodDescriptor {
+	return m.route.method
+}
+
+// NewRouter creates a router for the methods of the services.
+// Streaming methods and invalid rules are skipped.
+func NewRouter(services []protoreflect.ServiceDescriptor, logger *zap.Logger) *Router {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	router := &Router{}
+	for _, service := range services {
+		methods := service.Methods()
+		for i := range methods.Len() {
+			method := methods.Get(i)
+			rule := httpRule(method)
+			if rule == nil {
+				continue
+			}
+
+			if method.IsStreamingClient() || method.IsStreamingServer() {
+				logger.Warn("Ignoring HTTP rule of a streaming method", zap.String("method", string(method.FullName())))
+				continue
+			}
+
+			for _, rule := range append([]*annotations.HttpRule{rule}, rule.GetAdditionalBindings()...) {
+				r, err := newRoute(method, rule)
+				if err != nil {
+					logger.Warn("Ignoring invalid HTTP rule", zap.String("method", string(method.FullName())), zap.Error(err))
+					continue
+				}
+				router.routes = append(router.routes, r)
+			}
+		}
+	}
+	return router
+}
+
+// httpRule returns the google.api.http option of a method, or nil if it doesn't have one.
+func httpRule(method protoreflect.MethodDescriptor) *annotations.HttpRule {
+	options, ok := method.Options().(*descriptorpb.MethodOptions)
+	if !ok || options == nil {
+		return nil
+	}
+
+	// The options may have been parsed before the extension was known, in which case it's an unknown field.
+	if !proto.HasExtension(options, annotations.E_Http) && len(options.ProtoReflect().GetUnknown()) != 0 {
+		data, err := proto.Marshal(options)
+		if err != nil {
+			return nil
+		}
+		options = &descriptorpb.MethodOptions{}
+		if err := (proto.UnmarshalOptions{Resolver: protoregistry.GlobalTypes}).Unmarshal(data, options); err != nil {
+			return nil
+		}
+	}
+
+	rule, _ := proto.GetExtension(options, annotations.E_Http).(*annotations.HttpRule)
+	return rule
+}
+
+func newRoute(method protoreflect.MethodDescriptor, rule *annotations.HttpRule) (*route, error) {
+	var httpMethod, path string
+	switch pattern := rule.GetPattern().(type) {
+	case *annotations.HttpRule_Get:
+		httpMethod, path = http.MethodGet, pattern.Get
+	case *annotations.HttpRule_Put:
+		httpMethod, path = http.MethodPut, pattern.Put
+	case *annotations.HttpRule_Post:
+		httpMethod, path = http.MethodPost, pattern.Post
+	case *annotations.HttpRule_Delete:
+		httpMethod, path = http.MethodDelete, pattern.Delete
+	case *annotations.HttpRule_Patch:
+		httpMethod, path = http.MethodPatch, pattern.Patch
+	case *annotations.HttpRule_Custom:
+		httpMethod, path = pattern.Custom.GetKind(), pattern.Custom.GetPath()
+	default:
+		return nil, fmt.Errorf("rule doesn't have a pattern")
+	}
+
+	template, err := parseTemplate(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if body := rule.GetBody(); body != "" && body != "*" && method.Input().Fields().ByName(protoreflect.Name(body)) == nil {
+		return nil, fmt.Errorf("body field '%s' doesn't exist", body)
+	}
+	if responseBody := rule.GetResponseBody(); responseBody != "" && method.Output().Fields().ByName(protoreflect.Name(responseBody)) == nil {
+		return nil, fmt.Errorf("response body field '%s' doesn't exist", responseBody)
+	}
+
+	return &route{
+		httpMethod:   httpMethod,
+		template:     template,
+		method:       method,
+		body:         rule.GetBody(),
+		responseBody: rule.GetResponseBody(),
+	}, nil
+}
+
+// Match finds the route of a request.
+// If several templates match the path, the one with the most literal segments is used.
+func (router *Router) Match(r *http.Request) (*Match, bool) {
+	var best *Match
+	bestLiterals := -1
+	path := r.URL.EscapedPath()
+
+	for _, route := range router.routes {
+		if route.httpMethod != r.Method {
+			continue
+		}
+
+		values, ok := route.template.match(path)
+		if !ok {
+			continue
+		}
+
+		if literals := route.template.literals(); literals > bestLiterals {
+			best = &Match{route: route, values: values}
+			bestLiterals = literals
+		}
+	}
+
+	return best, best != nil
+}
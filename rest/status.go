@@ -0,0 +1,81 @@
+package rest
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	spb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// HTTP status codes of the gRPC codes, as used by google.api.http transcoders.
+var codeHTTPStatus = map[codes.Code]int{
+	codes.OK:                 http.StatusOK,
+	codes.Canceled:           499,
+	codes.Unknown:            http.StatusInternalServerError,
+	codes.InvalidArgument:    http.StatusBadRequest,
+	codes.DeadlineExceeded:   http.StatusGatewayTimeout,
+	codes.NotFound:           http.StatusNotFound,
+	codes.AlreadyExists:      http.StatusConflict,
+	codes.PermissionDenied:   http.StatusForbidden,
+	codes.ResourceExhausted:  http.StatusTooManyRequests,
+	codes.FailedPrecondition: http.StatusBadRequest,
+	codes.Aborted:            http.StatusConflict,
+	codes.OutOfRange:         http.StatusBadRequest,
+	codes.Unimplemented:      http.StatusNotImplemented,
+	codes.Internal:           http.StatusInternalServerError,
+	codes.Unavailable:        http.StatusServiceUnavailable,
+	codes.DataLoss:           http.StatusInternalServerError,
+	codes.Unauthenticated:    http.StatusUnauthorized,
+}
+
+func httpStatus(code codes.Code) int {
+	if status, ok := codeHTTPStatus[code]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+// NotFound writes the error returned for requests that don't match any route.
+func NotFound(w http.ResponseWriter, r *http.Request) {
+	data, _ := protojson.Marshal(status.Newf(codes.NotFound, "no route matches %s %s", r.Method, r.URL.Path).Proto())
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusNotFound)
+	w.Write(data)
+}
+
+// statusFromHeaders reads the gRPC status from the headers written by the handler.
+// The bool result is false if no grpc-status was found.
+func statusFromHeaders(get func(key string) string) (*status.Status, bool) {
+	rawCode := get("Grpc-Status")
+	if rawCode == "" {
+		return nil, false
+	}
+
+	code, err := strconv.ParseUint(rawCode, 10, 32)
+	if err != nil {
+		return status.Newf(codes.Internal, "invalid grpc-status '%s'", rawCode), true
+	}
+
+	message := get("Grpc-Message")
+	if decoded, err := url.PathUnescape(message); err == nil {
+		message = decoded
+	}
+	st := &spb.Status{Code: int32(code), Message: message}
+
+	if rawDetails := get("Grpc-Status-Details-Bin"); rawDetails != "" {
+		data, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(rawDetails, "="))
+		var details spb.Status
+		if err == nil && proto.Unmarshal(data, &details) == nil {
+			st.Details = details.Details
+		}
+	}
+
+	return status.FromProto(st), true
+}
@@ -0,0 +1,170 @@
+package rest
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+type segmentKind int
+
+const (
+	segmentLiteral segmentKind = iota
+	// segmentWildcard matches a single path segment.
+	segmentWildcard
+	// segmentDeepWildcard matches any number of path segments, it's always the last segment.
+	segmentDeepWildcard
+)
+
+type segment struct {
+	kind    segmentKind
+	literal string
+	// variable is the index of the variable the segment belongs to, or -1.
+	variable int
+}
+
+// pathTemplate is a parsed google.api.http path template, e.g. "/v1/{name=shelves/*}/books:publish".
+type pathTemplate struct {
+	segments []segment
+	// variables contains the field paths of the variables.
+	variables []string
+	verb      string
+}
+
+// parseTemplate parses a path template using the syntax described in google/api/http.proto.
+func parseTemplate(template string) (*pathTemplate, error) {
+	if !strings.HasPrefix(template, "/") {
+		return nil, fmt.Errorf("path template '%s' doesn't start with /", template)
+	}
+
+	t := &pathTemplate{}
+	path := template[1:]
+	if i := strings.LastIndexByte(path, ':'); i >= 0 && !strings.ContainsAny(path[i:], "/}") {
+		t.verb = path[i+1:]
+		path = path[:i]
+	}
+
+	for path != "" || len(t.segments) == 0 {
+		if strings.HasPrefix(path, "{") {
+			end := strings.IndexByte(path, '}')
+			if end < 0 {
+				return nil, fmt.Errorf("path template '%s' contains an unterminated variable", template)
+			}
+
+			fieldPath, pattern, found := strings.Cut(path[1:end], "=")
+			if !found {
+				pattern = "*"
+			}
+			if fieldPath == "" {
+				return nil, fmt.Errorf("path template '%s' contains a variable without a field", template)
+			}
+
+			for _, part := range strings.Split(pattern, "/") {
+				t.segments = append(t.segments, newSegment(part, len(t.variables)))
+			}
+			t.variables = append(t.variables, fieldPath)
+			path = path[end+1:]
+		} else {
+			part, _, _ := strings.Cut(path, "/")
+			t.segments = append(t.segments, newSegment(part, -1))
+			path = path[len(part):]
+		}
+
+		if path == "" {
+			break
+		}
+		if !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("path template '%s' contains a variable that isn't a complete segment", template)
+		}
+		path = path[1:]
+	}
+
+	for i, s := range t.segments {
+		if s.kind == segmentLiteral && s.literal == "" {
+			return nil, fmt.Errorf("path template '%s' contains an empty segment", template)
+		}
+		if s.kind == segmentDeepWildcard && i != len(t.segments)-1 {
+			return nil, fmt.Errorf("path template '%s' contains ** before the last segment", template)
+		}
+	}
+
+	return t, nil
+}
+
+func newSegment(part string, variable int) segment {
+	switch part {
+	case "*":
+		return segment{kind: segmentWildcard, variable: variable}
+	case "**":
+		return segment{kind: segmentDeepWildcard, variable: variable}
+	default:
+		return segment{kind: segmentLiteral, literal: part, variable: variable}
+	}
+}
+
+// literals returns the number of literal segments, templates with more literals are more specific.
+func (t *pathTemplate) literals() int {
+	count := 0
+	for _, s := range t.segments {
+		if s.kind == segmentLiteral {
+			count++
+		}
+	}
+	return count
+}
+
+// match matches an escaped URL path against the template and returns the values of the variables.
+func (t *pathTemplate) match(path string) ([]string, bool) {
+	if t.verb != "" {
+		var found bool
+		if path, found = strings.CutSuffix(path, ":"+t.verb); !found {
+			return nil, false
+		}
+	}
+
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	values := make([][]string, len(t.variables))
+
+	i := 0
+	for _, s := range t.segments {
+		var matched []string
+		switch s.kind {
+		case segmentDeepWildcard:
+			matched = parts[i:]
+			i = len(parts)
+		case segmentWildcard:
+			if i >= len(parts) || parts[i] == "" {
+				return nil, false
+			}
+			matched = parts[i : i+1]
+			i++
+		default:
+			if i >= len(parts) || parts[i] != s.literal {
+				return nil, false
+			}
+			matched = parts[i : i+1]
+			i++
+		}
+
+		if s.variable >= 0 {
+			values[s.variable] = append(values[s.variable], matched...)
+		}
+	}
+	if i != len(parts) {
+		return nil, false
+	}
+
+	result := make([]string, len(values))
+	for i, parts := range values {
+		unescaped := make([]string, len(parts))
+		for j, part := range parts {
+			value, err := url.PathUnescape(part)
+			if err != nil {
+				return nil, false
+			}
+			unescaped[j] = value
+		}
+		result[i] = strings.Join(unescaped, "/")
+	}
+	return result, true
+}
@@ -0,0 +1,46 @@
+package rest
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestTemplateMatch(t *testing.T) {
+	tests := []struct {
+		template string
+		path     string
+		values   []string
+		ok       bool
+	}{
+		{"/v1/users/{user}", "/v1/users/alice", []string{"alice"}, true},
+		{"/v1/users/{user}", "/v1/users/a%2Fb", []string{"a/b"}, true},
+		{"/v1/users/{user}", "/v1/users/alice/books", nil, false},
+		{"/v1/users/{user}", "/v1/users/", nil, false},
+		{"/v1/{name=shelves/*/books/*}", "/v1/shelves/1/books/2", []string{"shelves/1/books/2"}, true},
+		{"/v1/{name=shelves/*/books/*}", "/v1/shelves/1/authors/2", nil, false},
+		{"/v1/files/{path=**}", "/v1/files/a/b/c", []string{"a/b/c"}, true},
+		{"/v1/{name=books/*}:publish", "/v1/books/1:publish", []string{"books/1"}, true},
+		{"/v1/{name=books/*}:publish", "/v1/books/1", nil, false},
+		{"/v1/*/books", "/v1/shelf/books", []string{}, true},
+	}
+
+	for _, test := range tests {
+		template, err := parseTemplate(test.template)
+		if err != nil {
+			t.Fatalf("%s: %v", test.template, err)
+		}
+
+		values, ok := template.match(test.path)
+		if ok != test.ok || (ok && !slices.Equal(values, test.values)) {
+			t.Errorf("%s matching %s: expected %v %v, got %v %v", test.template, test.path, test.values, test.ok, values, ok)
+		}
+	}
+}
+
+func TestParseTemplateErrors(t *testing.T) {
+	for _, template := range []string{"v1/users", "/v1/{user", "/v1/**/users", "/v1//users", "/v1/{user}x", "/v1/{=*}"} {
+		if _, err := parseTemplate(template); err == nil {
+			t.Errorf("expected an error for %s", template)
+		}
+	}
+}
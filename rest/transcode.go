@@ -0,0 +1,390 @@
+package rest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/natk64/pancake-proxy/reflection"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// MaxBodySize is the maximum size of a request body in bytes.
+const MaxBodySize = 4 << 20
+
+// Headers of the incoming request that are not forwarded to the gRPC handler.
+var ignoredHeaders = []string{
+	"Accept",
+	"Accept-Encoding",
+	"Connection",
+	"Content-Length",
+	"Content-Encoding",
+}
+
+// Serve translates a REST request matched by a [Router] into a unary gRPC request, passes it to the handler
+// and writes the response message as JSON.
+//
+// The request message is built from the body, the path variables and, unless the whole body is mapped
+// to the request message, the query parameters. Request bodies larger than [MaxBodySize] are rejected.
+//
+// Errors are written as a JSON encoded google.rpc.Status with an HTTP status derived from the gRPC code.
+// Response metadata is sent in headers prefixed with Grpc-Metadata-, trailers are prefixed with Grpc-Trailer-.
+func Serve(w http.ResponseWriter, r *http.Request, match *Match, resolver reflection.FileExtensionResolver, handler http.Handler) {
+	types := reflection.TypeResolver{Files: resolver}
+	route := match.route
+
+	request, err := buildRequest(r, match, types)
+	if err != nil {
+		writeError(w, status.Convert(err), types)
+		return
+	}
+
+	data, err := proto.Marshal(request)
+	if err != nil {
+		writeError(w, status.New(codes.Internal, err.Error()), types)
+		return
+	}
+
+	grpcRequest := r.Clone(r.Context())
+	for _, key := range ignoredHeaders {
+		grpcRequest.Header.Del(key)
+	}
+
+	grpcRequest.Method = http.MethodPost
+	grpcRequest.URL = &url.URL{Path: fmt.Sprintf("/%s/%s", route.method.Parent().FullName(), route.method.Name())}
+	grpcRequest.Header.Set("Content-Type", "application/grpc")
+	grpcRequest.Header.Set("Te", "trailers")
+	grpcRequest.Body = io.NopCloser(bytes.NewReader(appendFrame(nil, data)))
+	grpcRequest.ContentLength = -1
+	grpcRequest.ProtoMajor = 2
+	grpcRequest.ProtoMinor = 0
+
+	rw := &responseWriter{headers: make(http.Header)}
+	handler.ServeHTTP(rw, grpcRequest)
+	rw.finish(w, route, types)
+}
+
+// buildRequest creates the request message of the matched method.
+func buildRequest(r *http.Request, match *Match, types reflection.TypeResolver) (*dynamicpb.Message, error) {
+	route := match.route
+	request := dynamicpb.NewMessage(route.method.Input())
+
+	if route.body != "" {
+		body, err := io.ReadAll(io.LimitReader(r.Body, MaxBodySize+1))
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "failed to read request body: %v", err)
+		}
+		if len(body) > MaxBodySize {
+			return nil, status.Errorf(codes.ResourceExhausted, "request body is larger than %d bytes", MaxBodySize)
+		}
+
+		if len(body) != 0 {
+			if route.body != "*" {
+				// Only a single JSON value can be mapped to the field, otherwise the body could set other fields.
+				if !json.Valid(body) {
+					return nil, status.Error(codes.InvalidArgument, "request body is not valid JSON")
+				}
+				body = fmt.Appendf(nil, `{"%s":%s}`, route.body, body)
+			}
+
+			if err := (protojson.UnmarshalOptions{Resolver: types}).Unmarshal(body, request); err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid request body: %v", err)
+			}
+		}
+	}
+
+	if route.body != "*" {
+		for key, values := range r.URL.Query() {
+			if err := setField(request, key, values, types); err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid query parameter '%s': %v", key, err)
+			}
+		}
+	}
+
+	for i, fieldPath := range route.template.variables {
+		if err := setField(request, fieldPath, match.values[i:i+1], types); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid path variable '%s': %v", fieldPath, err)
+		}
+	}
+
+	return request, nil
+}
+
+// setField sets the field with a dot separated path to the values.
+// Only repeated fields use all values, other fields use the last one.
+func setField(msg protoreflect.Message, fieldPath string, values []string, types reflection.TypeResolver) error {
+	names := strings.Split(fieldPath, ".")
+	for i, name := range names {
+		fields := msg.Descriptor().Fields()
+		field := fields.ByName(protoreflect.Name(name))
+		if field == nil {
+			field = fields.ByJSONName(name)
+		}
+		if field == nil {
+			return fmt.Errorf("unknown field '%s'", name)
+		}
+		if field.IsMap() {
+			return errors.New("map fields are not supported")
+		}
+
+		if i < len(names)-1 {
+			if field.Message() == nil || field.IsList() {
+				return fmt.Errorf("field '%s' is not a message", name)
+			}
+			msg = msg.Mutable(field).Message()
+			continue
+		}
+
+		if field.IsList() {
+			list := msg.Mutable(field).List()
+			for _, value := range values {
+				v, err := parseValue(field, value, types)
+				if err != nil {
+					return err
+				}
+				list.Append(v)
+			}
+			return nil
+		}
+
+		v, err := parseValue(field, values[len(values)-1], types)
+		if err != nil {
+			return err
+		}
+		msg.Set(field, v)
+	}
+	return nil
+}
+
+// parseValue converts the string representation of a field value.
+// Messages, e.g. well-known types like google.protobuf.Timestamp, use the JSON representation of a string.
+func parseValue(field protoreflect.FieldDescriptor, value string, types reflection.TypeResolver) (protoreflect.Value, error) {
+	switch field.Kind() {
+	case protoreflect.StringKind:
+		return protoreflect.ValueOfString(value), nil
+	case protoreflect.BoolKind:
+		v, err := strconv.ParseBool(value)
+		return protoreflect.ValueOfBool(v), err
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		v, err := strconv.ParseInt(value, 10, 32)
+		return protoreflect.ValueOfInt32(int32(v)), err
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		v, err := strconv.ParseInt(value, 10, 64)
+		return protoreflect.ValueOfInt64(v), err
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		v, err := strconv.ParseUint(value, 10, 32)
+		return protoreflect.ValueOfUint32(uint32(v)), err
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		v, err := strconv.ParseUint(value, 10, 64)
+		return protoreflect.ValueOfUint64(v), err
+	case protoreflect.FloatKind:
+		v, err := strconv.ParseFloat(value, 32)
+		return protoreflect.ValueOfFloat32(float32(v)), err
+	case protoreflect.DoubleKind:
+		v, err := strconv.ParseFloat(value, 64)
+		return protoreflect.ValueOfFloat64(v), err
+	case protoreflect.BytesKind:
+		for _, encoding := range []*base64.Encoding{base64.StdEncoding, base64.URLEncoding, base64.RawStdEncoding, base64.RawURLEncoding} {
+			if v, err := encoding.DecodeString(value); err == nil {
+				return protoreflect.ValueOfBytes(v), nil
+			}
+		}
+		return protoreflect.Value{}, errors.New("invalid base64 value")
+	case protoreflect.EnumKind:
+		if v := field.Enum().Values().ByName(protoreflect.Name(value)); v != nil {
+			return protoreflect.ValueOfEnum(v.Number()), nil
+		}
+		v, err := strconv.ParseInt(value, 10, 32)
+		if err != nil {
+			return protoreflect.Value{}, fmt.Errorf("unknown enum value '%s'", value)
+		}
+		return protoreflect.ValueOfEnum(protoreflect.EnumNumber(v)), nil
+	default:
+		msg := dynamicpb.NewMessage(field.Message())
+		data, err := json.Marshal(value)
+		if err != nil {
+			return protoreflect.Value{}, err
+		}
+		if err := (protojson.UnmarshalOptions{Resolver: types}).Unmarshal(data, msg); err != nil {
+			return protoreflect.Value{}, err
+		}
+		return protoreflect.ValueOfMessage(msg), nil
+	}
+}
+
+func appendFrame(dst []byte, msg []byte) []byte {
+	dst = append(dst, 0)
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(msg)))
+	return append(dst, msg...)
+}
+
+// writeError writes a status as JSON.
+func writeError(w http.ResponseWriter, st *status.Status, types reflection.TypeResolver) {
+	data, err := protojson.MarshalOptions{Resolver: types}.Marshal(st.Proto())
+	if err != nil {
+		// The details can't be encoded without their descriptors.
+		data, _ = protojson.Marshal(status.New(st.Code(), st.Message()).Proto())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpStatus(st.Code()))
+	w.Write(data)
+}
+
+// responseWriter buffers the gRPC response of a unary call.
+type responseWriter struct {
+	headers http.Header
+	// sentHeaders are the headers at the time WriteHeader was called, everything added later is a trailer.
+	sentHeaders http.Header
+	body        bytes.Buffer
+}
+
+// Header implements http.ResponseWriter.
+func (rw *responseWriter) Header() http.Header {
+	return rw.headers
+}
+
+// WriteHeader implements http.ResponseWriter.
+func (rw *responseWriter) WriteHeader(statusCode int) {
+	if rw.sentHeaders == nil {
+		rw.sentHeaders = rw.headers.Clone()
+	}
+}
+
+// Write implements http.ResponseWriter.
+func (rw *responseWriter) Write(data []byte) (int, error) {
+	rw.WriteHeader(http.StatusOK)
+	return rw.body.Write(data)
+}
+
+// getHeader returns a header value, regardless of whether it was set as a header or a trailer.
+func (rw *responseWriter) getHeader(key string) string {
+	if value := rw.headers.Get(key); value != "" {
+		return value
+	}
+	if values := rw.headers[http.TrailerPrefix+key]; len(values) != 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// finish writes the buffered response to w.
+func (rw *responseWriter) finish(w http.ResponseWriter, route *route, types reflection.TypeResolver) {
+	rw.WriteHeader(http.StatusOK)
+
+	for key, values := range rw.headers {
+		trailer := strings.HasPrefix(key, http.TrailerPrefix) || rw.sentHeaders[key] == nil
+		key = strings.ToLower(strings.TrimPrefix(key, http.TrailerPrefix))
+		if key == "trailer" || key == "content-type" || strings.HasPrefix(key, "grpc-") {
+			continue
+		}
+
+		prefix := "Grpc-Metadata-"
+		if trailer {
+			prefix = "Grpc-Trailer-"
+		}
+		for _, value := range values {
+			w.Header().Add(prefix+key, value)
+		}
+	}
+
+	st, ok := statusFromHeaders(rw.getHeader)
+	if !ok {
+		st = status.New(codes.Unknown, "upstream did not send a gRPC status")
+	}
+	if st.Code() != codes.OK {
+		writeError(w, st, types)
+		return
+	}
+
+	data, err := rw.decodeResponse(route, types)
+	if err != nil {
+		writeError(w, status.Newf(codes.Internal, "failed to decode response message: %v", err), types)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// decodeResponse decodes the response message and encodes it, or the response body field, as JSON.
+func (rw *responseWriter) decodeResponse(route *route, types reflection.TypeResolver) ([]byte, error) {
+	frame := rw.body.Bytes()
+	if len(frame) < 5 {
+		return nil, errors.New("no response message")
+	}
+	flags, length := frame[0], binary.BigEndian.Uint32(frame[1:5])
+	if uint64(len(frame)-5) < uint64(length) {
+		return nil, errors.New("incomplete response message")
+	}
+	data := frame[5 : 5+length]
+
+	if flags&1 != 0 {
+		if encoding := rw.getHeader("Grpc-Encoding"); encoding != "gzip" {
+			return nil, fmt.Errorf("unsupported response compression '%s'", encoding)
+		}
+
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		if data, err = io.ReadAll(gz); err != nil {
+			return nil, err
+		}
+	}
+
+	msg := dynamicpb.NewMessage(route.method.Output())
+	if err := (proto.UnmarshalOptions{Resolver: types}).Unmarshal(data, msg); err != nil {
+		return nil, err
+	}
+
+	if route.responseBody == "" {
+		return protojson.MarshalOptions{Resolver: types}.Marshal(msg)
+	}
+
+	// The field can be of any type, so the whole message is encoded and the field is taken from the result.
+	data, err := protojson.MarshalOptions{Resolver: types}.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	field := msg.Descriptor().Fields().ByName(protoreflect.Name(route.responseBody))
+	if value, ok := jsonField(data, field.JSONName()); ok {
+		return value, nil
+	}
+
+	// Unset fields are omitted, their default value is taken from an empty message.
+	empty := dynamicpb.NewMessage(route.method.Output())
+	if field.ContainingOneof() != nil {
+		empty.Set(field, empty.NewField(field))
+	}
+	if data, err = (protojson.MarshalOptions{Resolver: types, EmitUnpopulated: true}).Marshal(empty); err != nil {
+		return nil, err
+	}
+	value, _ := jsonField(data, field.JSONName())
+	return value, nil
+}
+
+// jsonField returns a field of a JSON object.
+func jsonField(data []byte, name string) (json.RawMessage, bool) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, false
+	}
+	value, ok := fields[name]
+	return value, ok
+}
@@ -0,0 +1,258 @@
+package sse
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/natk64/pancake-proxy/reflection"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// Headers of the incoming request that are not forwarded to the gRPC handler.
+var ignoredHeaders = []string{
+	"Accept",
+	"Accept-Encoding",
+	"Cache-Control",
+	"Connection",
+	"Content-Length",
+	"Last-Event-Id",
+}
+
+// Status is the data of the terminal "status" event.
+type Status struct {
+	Code     int                 `json:"code"`
+	CodeName string              `json:"codeName"`
+	Message  string              `json:"message,omitempty"`
+	Metadata map[string][]string `json:"metadata,omitempty"`
+}
+
+// Serve invokes a server streaming method by passing a gRPC request to the handler
+// and sends every response message as a Server-Sent Event containing the message encoded as JSON.
+//
+// The request message is read from the "json" query parameter, an empty message is used if it's missing.
+// Descriptors for the request and response messages are looked up in the resolver.
+//
+// Response messages are sent as "message" events. Once the call is finished,
+// a "status" event containing a [Status] is sent and the stream is closed.
+// Clients should close the EventSource when they receive it, otherwise the browser will repeat the call.
+func Serve(w http.ResponseWriter, r *http.Request, fullMethod string, resolver reflection.FileExtensionResolver, handler http.Handler) {
+	method, err := reflection.FindMethod(resolver, fullMethod)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, "unknown method")
+		return
+	}
+
+	if method.IsStreamingClient() {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "client streaming methods are not supported")
+		return
+	}
+
+	types := reflection.TypeResolver{Files: resolver}
+	request := dynamicpb.NewMessage(method.Input())
+	if query := r.URL.Query().Get("json"); query != "" {
+		if err := (protojson.UnmarshalOptions{Resolver: types}).Unmarshal([]byte(query), request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "invalid request message: %v", err)
+			return
+		}
+	}
+
+	data, err := proto.Marshal(request)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	grpcRequest := r.Clone(r.Context())
+	for _, key := range ignoredHeaders {
+		grpcRequest.Header.Del(key)
+	}
+
+	grpcRequest.Method = http.MethodPost
+	grpcRequest.URL = &url.URL{Path: "/" + strings.TrimPrefix(fullMethod, "/")}
+	grpcRequest.Header.Set("Content-Type", "application/grpc")
+	grpcRequest.Header.Set("Te", "trailers")
+	grpcRequest.Body = io.NopCloser(bytes.NewReader(appendFrame(nil, data)))
+	grpcRequest.ContentLength = -1
+	grpcRequest.ProtoMajor = 2
+	grpcRequest.ProtoMinor = 0
+
+	ew := &eventWriter{
+		inner:   w,
+		headers: make(http.Header),
+		output:  method.Output(),
+		types:   types,
+	}
+
+	handler.ServeHTTP(ew, grpcRequest)
+	ew.finish()
+}
+
+func appendFrame(dst []byte, msg []byte) []byte {
+	dst = append(dst, 0)
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(msg)))
+	return append(dst, msg...)
+}
+
+// eventWriter receives a gRPC response and translates it into events.
+type eventWriter struct {
+	inner   http.ResponseWriter
+	headers http.Header
+	output  protoreflect.MessageDescriptor
+	types   reflection.TypeResolver
+
+	statusCode int
+	pending    bytes.Buffer
+	decodeErr  error
+}
+
+// Header implements http.ResponseWriter.
+func (e *eventWriter) Header() http.Header {
+	return e.headers
+}
+
+// WriteHeader implements http.ResponseWriter.
+func (e *eventWriter) WriteHeader(statusCode int) {
+	if e.statusCode != 0 {
+		return
+	}
+	e.statusCode = statusCode
+
+	target := e.inner.Header()
+	target.Set("Content-Type", "text/event-stream")
+	target.Set("Cache-Control", "no-cache")
+	e.inner.WriteHeader(http.StatusOK)
+}
+
+// Write implements http.ResponseWriter.
+func (e *eventWriter) Write(data []byte) (int, error) {
+	e.WriteHeader(http.StatusOK)
+	e.pending.Write(data)
+
+	for e.pending.Len() >= 5 {
+		length := binary.BigEndian.Uint32(e.pending.Bytes()[1:5])
+		if uint64(e.pending.Len()) < 5+uint64(length) {
+			break
+		}
+
+		frame := e.pending.Next(5 + int(length))
+		if e.decodeErr != nil {
+			continue
+		}
+
+		msg, err := e.decodeMessage(frame[0], frame[5:])
+		if err != nil {
+			e.decodeErr = err
+			continue
+		}
+
+		if err := e.writeEvent("message", msg); err != nil {
+			return len(data), err
+		}
+	}
+
+	return len(data), nil
+}
+
+func (e *eventWriter) decodeMessage(flags byte, data []byte) ([]byte, error) {
+	if flags&1 != 0 {
+		if encoding := e.getHeader("Grpc-Encoding"); encoding != "gzip" {
+			return nil, fmt.Errorf("unsupported response compression '%s'", encoding)
+		}
+
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		if data, err = io.ReadAll(gz); err != nil {
+			return nil, err
+		}
+	}
+
+	msg := dynamicpb.NewMessage(e.output)
+	if err := (proto.UnmarshalOptions{Resolver: e.types}).Unmarshal(data, msg); err != nil {
+		return nil, err
+	}
+
+	return protojson.MarshalOptions{Resolver: e.types}.Marshal(msg)
+}
+
+// writeEvent writes a single event. data must not contain line breaks.
+func (e *eventWriter) writeEvent(event string, data []byte) error {
+	if _, err := fmt.Fprintf(e.inner, "event: %s\ndata: %s\n\n", event, data); err != nil {
+		return err
+	}
+
+	if f, ok := e.inner.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+// getHeader returns a header value, regardless of whether it was set as a header or a trailer.
+func (e *eventWriter) getHeader(key string) string {
+	if value := e.headers.Get(key); value != "" {
+		return value
+	}
+	if values := e.headers[http.TrailerPrefix+key]; len(values) != 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// finish sends the status event.
+func (e *eventWriter) finish() {
+	e.WriteHeader(http.StatusOK)
+
+	status := Status{Code: int(codes.Unknown)}
+	if rawCode := e.getHeader("Grpc-Status"); rawCode != "" {
+		if code, err := strconv.Atoi(rawCode); err == nil {
+			status.Code = code
+		}
+		status.Message = e.getHeader("Grpc-Message")
+		if decoded, err := url.PathUnescape(status.Message); err == nil {
+			status.Message = decoded
+		}
+	} else {
+		status.Message = "upstream did not send a gRPC status"
+	}
+
+	if status.Code == int(codes.OK) && e.decodeErr != nil {
+		status.Code = int(codes.Internal)
+		status.Message = fmt.Sprintf("failed to decode response message: %v", e.decodeErr)
+	}
+
+	status.CodeName = codes.Code(status.Code).String()
+
+	for key, values := range e.headers {
+		key = strings.ToLower(strings.TrimPrefix(key, http.TrailerPrefix))
+		if key == "trailer" || key == "content-type" || strings.HasPrefix(key, "grpc-") {
+			continue
+		}
+
+		if status.Metadata == nil {
+			status.Metadata = make(map[string][]string)
+		}
+		status.Metadata[key] = append(status.Metadata[key], values...)
+	}
+
+	data, err := json.Marshal(status)
+	if err != nil {
+		return
+	}
+	e.writeEvent("status", data)
+}
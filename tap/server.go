@@ -0,0 +1,115 @@
+package tap
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/natk64/pancake-proxy/reflection"
+	"github.com/natk64/pancake-proxy/tap/tappb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// Server serves the tap using gRPC and Server-Sent Events.
+type Server struct {
+	tappb.UnimplementedTapServer
+
+	tap      *Tap
+	resolver reflection.FileExtensionResolver
+}
+
+var _ tappb.TapServer = &Server{}
+
+// NewServer creates a server for the tap. Messages are decoded using the descriptors in the resolver.
+func NewServer(tap *Tap, resolver reflection.FileExtensionResolver) *Server {
+	return &Server{tap: tap, resolver: resolver}
+}
+
+// Watch implements tappb.TapServer.
+func (s *Server) Watch(request *tappb.WatchRequest, stream grpc.ServerStreamingServer[tappb.WatchResponse]) error {
+	return s.tap.Watch(stream.Context(), s.resolver, request, stream.Send)
+}
+
+// ServeEvents streams the events as Server-Sent Events, every event contains a [tappb.WatchResponse] as JSON.
+//
+// The filter is read from the query parameters 'method', 'header' as 'name:value' and 'code', which may be repeated,
+// and 'duration' like '5m'.
+func (s *Server) ServeEvents(w http.ResponseWriter, r *http.Request) {
+	request, err := parseWatchRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// Invalid requests are reported before the stream starts.
+	if _, _, err := s.tap.newWatcher(request); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, status.Convert(err).Message())
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	s.tap.Watch(r.Context(), s.resolver, request, func(response *tappb.WatchResponse) error {
+		data, err := protojson.Marshal(response)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "event: call\ndata: %s\n\n", data); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	})
+
+	fmt.Fprint(w, "event: end\ndata: {}\n\n")
+}
+
+func parseWatchRequest(r *http.Request) (*tappb.WatchRequest, error) {
+	query := r.URL.Query()
+	request := &tappb.WatchRequest{
+		Methods: query["method"],
+		Headers: make(map[string]string),
+	}
+
+	for _, header := range query["header"] {
+		name, value, ok := strings.Cut(header, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid header filter '%s', expected 'name:value'", header)
+		}
+		request.Headers[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+
+	for _, rawCode := range query["code"] {
+		code, err := strconv.ParseUint(rawCode, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid status code '%s'", rawCode)
+		}
+		request.Codes = append(request.Codes, uint32(code))
+	}
+
+	if rawDuration := query.Get("duration"); rawDuration != "" {
+		duration, err := time.ParseDuration(rawDuration)
+		if err != nil {
+			return nil, fmt.Errorf("invalid duration '%s'", rawDuration)
+		}
+		request.Duration = durationpb.New(duration)
+	}
+
+	return request, nil
+}
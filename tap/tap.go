@@ -0,0 +1,342 @@
+// Package tap streams the calls handled by the proxy to operators, for debugging.
+package tap
+
+//go:generate protoc -I .. --go_out=.. --go_opt=paths=source_relative --go-grpc_out=.. --go-grpc_opt=paths=source_relative ../tap/tappb/tap.proto
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/natk64/pancake-proxy/auth"
+	"github.com/natk64/pancake-proxy/payload"
+	"github.com/natk64/pancake-proxy/reflection"
+	"github.com/natk64/pancake-proxy/tap/tappb"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	defaultWatchDuration = time.Minute
+
+	// Events that aren't received fast enough are dropped, once this many are buffered.
+	watcherBufferSize = 1024
+
+	// Calls watched with a status code filter buffer at most this many events until they finish.
+	maxPendingEvents = 256
+)
+
+// Config configures a [Tap].
+type Config struct {
+	// Redaction and truncation of the messages, see [payload.Config].
+	payload.Config `mapstructure:",squash"`
+
+	// MaxDuration is the maximum duration of a watch. The default is 10 minutes.
+	MaxDuration time.Duration `mapstructure:"max_duration"`
+
+	Logger *zap.Logger `mapstructure:"-"`
+}
+
+// Tap distributes the events of calls to the watchers whose filters match.
+//
+// Tap must be created using [New].
+type Tap struct {
+	config  Config
+	decoder *payload.Decoder
+
+	watchers map[*watcher]struct{}
+	mutex    *sync.RWMutex
+
+	// watching is the number of watchers, so that calls aren't tracked if there are none.
+	watching *atomic.Int32
+	nextID   *atomic.Uint64
+}
+
+type watcher struct {
+	methods []string
+	headers map[string]string
+	codes   []codes.Code
+
+	events  chan event
+	dropped *atomic.Uint64
+}
+
+// event is the internal representation of a [tappb.WatchResponse].
+// Messages are decoded by the watcher, so that calls aren't slowed down.
+type event struct {
+	callID   uint64
+	time     time.Time
+	method   string
+	started  *tappb.CallStarted
+	message  *message
+	finished *tappb.CallFinished
+}
+
+type message struct {
+	request bool
+	data    []byte
+}
+
+// CallInfo describes a call when it starts.
+type CallInfo struct {
+	// Method is the full method name like '/package.Service/Method'.
+	Method    string
+	Protocol  string
+	Peer      string
+	UserAgent string
+	Header    http.Header
+}
+
+// Call publishes the events of a single watched call. All methods are safe to call on a nil Call.
+type Call struct {
+	id     uint64
+	method string
+
+	// watchers receive the events immediately, delayed watchers receive them once the call finished.
+	watchers []*watcher
+	delayed  []*watcher
+
+	pending []event
+	mutex   *sync.Mutex
+
+	// overflow counts the events that didn't fit into pending, they are reported as dropped.
+	overflow uint64
+}
+
+// New creates a tap.
+func New(config Config) (*Tap, error) {
+	if config.Logger == nil {
+		config.Logger = zap.NewNop()
+	}
+	if config.MaxDuration <= 0 {
+		config.MaxDuration = 10 * time.Minute
+	}
+
+	decoder, err := payload.NewDecoder(config.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Tap{
+		config:   config,
+		decoder:  decoder,
+		watchers: make(map[*watcher]struct{}),
+		mutex:    &sync.RWMutex{},
+		watching: &atomic.Int32{},
+		nextID:   &atomic.Uint64{},
+	}, nil
+}
+
+// Start returns the publisher of a call, or nil if nobody watches it.
+func (t *Tap) Start(info CallInfo) *Call {
+	if t.watching.Load() == 0 {
+		return nil
+	}
+
+	t.mutex.RLock()
+	var watchers, delayed []*watcher
+	for w := range t.watchers {
+		if !w.matches(info) {
+			continue
+		}
+		if len(w.codes) != 0 {
+			delayed = append(delayed, w)
+		} else {
+			watchers = append(watchers, w)
+		}
+	}
+	t.mutex.RUnlock()
+
+	if len(watchers) == 0 && len(delayed) == 0 {
+		return nil
+	}
+
+	c := &Call{
+		id:       t.nextID.Add(1),
+		method:   info.Method,
+		watchers: watchers,
+		delayed:  delayed,
+		mutex:    &sync.Mutex{},
+	}
+	c.publish(event{started: &tappb.CallStarted{
+		Method:    info.Method,
+		Protocol:  info.Protocol,
+		Peer:      info.Peer,
+		UserAgent: info.UserAgent,
+	}})
+	return c
+}
+
+func (w *watcher) matches(info CallInfo) bool {
+	if len(w.methods) != 0 && !auth.MatchAnyMethod(w.methods, info.Method) {
+		return false
+	}
+	for key, value := range w.headers {
+		if !slices.Contains(info.Header.Values(key), value) {
+			return false
+		}
+	}
+	return true
+}
+
+// Message publishes a complete message of the call.
+// If request is false, the message was sent by the server.
+func (c *Call) Message(request bool, data []byte) {
+	if c == nil {
+		return
+	}
+	c.publish(event{message: &message{request: request, data: data}})
+}
+
+// Finish publishes the end of the call and sends the pending events to the watchers filtering by status code.
+func (c *Call) Finish(upstream, client string, code codes.Code, duration time.Duration) {
+	if c == nil {
+		return
+	}
+	c.publish(event{finished: &tappb.CallFinished{
+		Upstream: upstream,
+		Client:   client,
+		Code:     uint32(code),
+		Duration: durationpb.New(duration),
+	}})
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, w := range c.delayed {
+		if !slices.Contains(w.codes, code) {
+			continue
+		}
+		for _, e := range c.pending {
+			w.send(e)
+		}
+		w.dropped.Add(c.overflow)
+	}
+	c.pending = nil
+}
+
+func (c *Call) publish(e event) {
+	e.callID = c.id
+	e.time = time.Now()
+	e.method = c.method
+
+	for _, w := range c.watchers {
+		w.send(e)
+	}
+
+	if len(c.delayed) != 0 {
+		c.mutex.Lock()
+		if len(c.pending) < maxPendingEvents {
+			c.pending = append(c.pending, e)
+		} else {
+			c.overflow++
+		}
+		c.mutex.Unlock()
+	}
+}
+
+// send delivers an event without blocking, it's dropped if the buffer is full.
+func (w *watcher) send(e event) {
+	select {
+	case w.events <- e:
+	default:
+		w.dropped.Add(1)
+	}
+}
+
+// Watch streams the events of the calls matching the request to send, until the duration passed or the context is cancelled.
+// The messages are decoded using the descriptors in the resolver.
+func (t *Tap) Watch(ctx context.Context, resolver reflection.FileExtensionResolver, request *tappb.WatchRequest, send func(*tappb.WatchResponse) error) error {
+	w, duration, err := t.newWatcher(request)
+	if err != nil {
+		return err
+	}
+
+	t.mutex.Lock()
+	t.watchers[w] = struct{}{}
+	t.mutex.Unlock()
+	t.watching.Add(1)
+
+	defer func() {
+		t.mutex.Lock()
+		delete(t.watchers, w)
+		t.mutex.Unlock()
+		t.watching.Add(-1)
+	}()
+
+	t.config.Logger.Info("Watch started",
+		zap.Strings("methods", w.methods),
+		zap.Any("headers", w.headers),
+		zap.Duration("duration", duration),
+	)
+
+	ctx, cancel := context.WithTimeout(ctx, duration)
+	defer cancel()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case e := <-w.events:
+			if err := send(t.response(resolver, w, e)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (t *Tap) newWatcher(request *tappb.WatchRequest) (*watcher, time.Duration, error) {
+	duration := defaultWatchDuration
+	if request.Duration != nil {
+		if err := request.Duration.CheckValid(); err != nil {
+			return nil, 0, status.Errorf(codes.InvalidArgument, "invalid duration, %v", err)
+		}
+		duration = request.Duration.AsDuration()
+	}
+	if duration <= 0 {
+		return nil, 0, status.Error(codes.InvalidArgument, "the duration must be positive")
+	}
+	duration = min(duration, t.config.MaxDuration)
+
+	w := &watcher{
+		methods: request.Methods,
+		headers: request.Headers,
+		events:  make(chan event, watcherBufferSize),
+		dropped: &atomic.Uint64{},
+	}
+	for _, code := range request.Codes {
+		if code > uint32(codes.Unauthenticated) {
+			return nil, 0, status.Errorf(codes.InvalidArgument, "unknown status code %d", code)
+		}
+		w.codes = append(w.codes, codes.Code(code))
+	}
+	return w, duration, nil
+}
+
+// response converts an event to the message sent to the watcher.
+func (t *Tap) response(resolver reflection.FileExtensionResolver, w *watcher, e event) *tappb.WatchResponse {
+	response := &tappb.WatchResponse{
+		CallId:  e.callID,
+		Time:    timestamppb.New(e.time),
+		Dropped: w.dropped.Swap(0),
+	}
+
+	switch {
+	case e.started != nil:
+		response.Event = &tappb.WatchResponse_Started{Started: e.started}
+	case e.message != nil:
+		response.Event = &tappb.WatchResponse_Message{Message: &tappb.CallMessage{
+			Request: e.message.request,
+			Json:    t.decoder.Decode(resolver, e.method, e.message.request, e.message.data),
+			Size:    uint32(len(e.message.data)),
+		}}
+	case e.finished != nil:
+		response.Event = &tappb.WatchResponse_Finished{Finished: e.finished}
+	}
+	return response
+}
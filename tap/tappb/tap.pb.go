@@ -0,0 +1,533 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.6
+// 	protoc        (unknown)
+// source: tap/tappb/tap.proto
+
+package tappb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	durationpb "google.golang.org/protobuf/types/known/durationpb"
+	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type WatchRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Methods lists the watched methods, like 'package.Service' or 'package.Service/Get*'.
+	// All methods are watched if empty.
+	Methods []string `protobuf:"bytes,1,rep,name=methods,proto3" json:"methods,omitempty"`
+	// Headers must all be present in the request metadata with the same values.
+	Headers map[string]string `protobuf:"bytes,2,rep,name=headers,proto3" json:"headers,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	// Codes restricts the watched calls to ones finishing with any of the status codes.
+	// The events of these calls are sent once the call finished.
+	Codes []uint32 `protobuf:"varint,3,rep,packed,name=codes,proto3" json:"codes,omitempty"`
+	// Duration is how long calls are watched, limited by the configured maximum.
+	// The default is one minute.
+	Duration      *durationpb.Duration `protobuf:"bytes,4,opt,name=duration,proto3" json:"duration,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *WatchRequest) Reset() {
+	*x = WatchRequest{}
+	mi := &file_tap_tappb_tap_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *WatchRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*WatchRequest) ProtoMessage() {}
+
+func (x *WatchRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_tap_tappb_tap_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use WatchRequest.ProtoReflect.Descriptor instead.
+func (*WatchRequest) Descriptor() ([]byte, []int) {
+	return file_tap_tappb_tap_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *WatchRequest) GetMethods() []string {
+	if x != nil {
+		return x.Methods
+	}
+	return nil
+}
+
+func (x *WatchRequest) GetHeaders() map[string]string {
+	if x != nil {
+		return x.Headers
+	}
+	return nil
+}
+
+func (x *WatchRequest) GetCodes() []uint32 {
+	if x != nil {
+		return x.Codes
+	}
+	return nil
+}
+
+func (x *WatchRequest) GetDuration() *durationpb.Duration {
+	if x != nil {
+		return x.Duration
+	}
+	return nil
+}
+
+type WatchResponse struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// CallId identifies the call the event belongs to.
+	CallId uint64                 `protobuf:"varint,1,opt,name=call_id,json=callId,proto3" json:"call_id,omitempty"`
+	Time   *timestamppb.Timestamp `protobuf:"bytes,2,opt,name=time,proto3" json:"time,omitempty"`
+	// Dropped is the number of events dropped before this one, because they weren't received fast enough.
+	Dropped uint64 `protobuf:"varint,3,opt,name=dropped,proto3" json:"dropped,omitempty"`
+	// Types that are valid to be assigned to Event:
+	//
+	//	*WatchResponse_Started
+	//	*WatchResponse_Message
+	//	*WatchResponse_Finished
+	Event         isWatchResponse_Event `protobuf_oneof:"event"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *WatchResponse) Reset() {
+	*x = WatchResponse{}
+	mi := &file_tap_tappb_tap_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *WatchResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*WatchResponse) ProtoMessage() {}
+
+func (x *WatchResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_tap_tappb_tap_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use WatchResponse.ProtoReflect.Descriptor instead.
+func (*WatchResponse) Descriptor() ([]byte, []int) {
+	return file_tap_tappb_tap_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *WatchResponse) GetCallId() uint64 {
+	if x != nil {
+		return x.CallId
+	}
+	return 0
+}
+
+func (x *WatchResponse) GetTime() *timestamppb.Timestamp {
+	if x != nil {
+		return x.Time
+	}
+	return nil
+}
+
+func (x *WatchResponse) GetDropped() uint64 {
+	if x != nil {
+		return x.Dropped
+	}
+	return 0
+}
+
+func (x *WatchResponse) GetEvent() isWatchResponse_Event {
+	if x != nil {
+		return x.Event
+	}
+	return nil
+}
+
+func (x *WatchResponse) GetStarted() *CallStarted {
+	if x != nil {
+		if x, ok := x.Event.(*WatchResponse_Started); ok {
+			return x.Started
+		}
+	}
+	return nil
+}
+
+func (x *WatchResponse) GetMessage() *CallMessage {
+	if x != nil {
+		if x, ok := x.Event.(*WatchResponse_Message); ok {
+			return x.Message
+		}
+	}
+	return nil
+}
+
+func (x *WatchResponse) GetFinished() *CallFinished {
+	if x != nil {
+		if x, ok := x.Event.(*WatchResponse_Finished); ok {
+			return x.Finished
+		}
+	}
+	return nil
+}
+
+type isWatchResponse_Event interface {
+	isWatchResponse_Event()
+}
+
+type WatchResponse_Started struct {
+	Started *CallStarted `protobuf:"bytes,4,opt,name=started,proto3,oneof"`
+}
+
+type WatchResponse_Message struct {
+	Message *CallMessage `protobuf:"bytes,5,opt,name=message,proto3,oneof"`
+}
+
+type WatchResponse_Finished struct {
+	Finished *CallFinished `protobuf:"bytes,6,opt,name=finished,proto3,oneof"`
+}
+
+func (*WatchResponse_Started) isWatchResponse_Event() {}
+
+func (*WatchResponse_Message) isWatchResponse_Event() {}
+
+func (*WatchResponse_Finished) isWatchResponse_Event() {}
+
+type CallStarted struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Method is the full method name like '/package.Service/Method'.
+	Method        string `protobuf:"bytes,1,opt,name=method,proto3" json:"method,omitempty"`
+	Protocol      string `protobuf:"bytes,2,opt,name=protocol,proto3" json:"protocol,omitempty"`
+	Peer          string `protobuf:"bytes,3,opt,name=peer,proto3" json:"peer,omitempty"`
+	UserAgent     string `protobuf:"bytes,4,opt,name=user_agent,json=userAgent,proto3" json:"user_agent,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CallStarted) Reset() {
+	*x = CallStarted{}
+	mi := &file_tap_tappb_tap_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CallStarted) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CallStarted) ProtoMessage() {}
+
+func (x *CallStarted) ProtoReflect() protoreflect.Message {
+	mi := &file_tap_tappb_tap_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CallStarted.ProtoReflect.Descriptor instead.
+func (*CallStarted) Descriptor() ([]byte, []int) {
+	return file_tap_tappb_tap_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *CallStarted) GetMethod() string {
+	if x != nil {
+		return x.Method
+	}
+	return ""
+}
+
+func (x *CallStarted) GetProtocol() string {
+	if x != nil {
+		return x.Protocol
+	}
+	return ""
+}
+
+func (x *CallStarted) GetPeer() string {
+	if x != nil {
+		return x.Peer
+	}
+	return ""
+}
+
+func (x *CallStarted) GetUserAgent() string {
+	if x != nil {
+		return x.UserAgent
+	}
+	return ""
+}
+
+type CallMessage struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Request is true for messages sent by the client, false for messages sent by the server.
+	Request bool `protobuf:"varint,1,opt,name=request,proto3" json:"request,omitempty"`
+	// Json is the redacted message. It's truncated if it's too large.
+	Json string `protobuf:"bytes,2,opt,name=json,proto3" json:"json,omitempty"`
+	// Size is the size of the binary message in bytes.
+	Size          uint32 `protobuf:"varint,3,opt,name=size,proto3" json:"size,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CallMessage) Reset() {
+	*x = CallMessage{}
+	mi := &file_tap_tappb_tap_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CallMessage) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CallMessage) ProtoMessage() {}
+
+func (x *CallMessage) ProtoReflect() protoreflect.Message {
+	mi := &file_tap_tappb_tap_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CallMessage.ProtoReflect.Descriptor instead.
+func (*CallMessage) Descriptor() ([]byte, []int) {
+	return file_tap_tappb_tap_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *CallMessage) GetRequest() bool {
+	if x != nil {
+		return x.Request
+	}
+	return false
+}
+
+func (x *CallMessage) GetJson() string {
+	if x != nil {
+		return x.Json
+	}
+	return ""
+}
+
+func (x *CallMessage) GetSize() uint32 {
+	if x != nil {
+		return x.Size
+	}
+	return 0
+}
+
+type CallFinished struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Upstream is the address of the server the call was forwarded to, if any.
+	Upstream string `protobuf:"bytes,1,opt,name=upstream,proto3" json:"upstream,omitempty"`
+	// Client is the name of the authenticated client, if any.
+	Client        string               `protobuf:"bytes,2,opt,name=client,proto3" json:"client,omitempty"`
+	Code          uint32               `protobuf:"varint,3,opt,name=code,proto3" json:"code,omitempty"`
+	Duration      *durationpb.Duration `protobuf:"bytes,4,opt,name=duration,proto3" json:"duration,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CallFinished) Reset() {
+	*x = CallFinished{}
+	mi := &file_tap_tappb_tap_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CallFinished) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CallFinished) ProtoMessage() {}
+
+func (x *CallFinished) ProtoReflect() protoreflect.Message {
+	mi := &file_tap_tappb_tap_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CallFinished.ProtoReflect.Descriptor instead.
+func (*CallFinished) Descriptor() ([]byte, []int) {
+	return file_tap_tappb_tap_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *CallFinished) GetUpstream() string {
+	if x != nil {
+		return x.Upstream
+	}
+	return ""
+}
+
+func (x *CallFinished) GetClient() string {
+	if x != nil {
+		return x.Client
+	}
+	return ""
+}
+
+func (x *CallFinished) GetCode() uint32 {
+	if x != nil {
+		return x.Code
+	}
+	return 0
+}
+
+func (x *CallFinished) GetDuration() *durationpb.Duration {
+	if x != nil {
+		return x.Duration
+	}
+	return nil
+}
+
+var File_tap_tappb_tap_proto protoreflect.FileDescriptor
+
+const file_tap_tappb_tap_proto_rawDesc = "" +
+	"\n" +
+	"\x13tap/tappb/tap.proto\x12\x0epancake.tap.v1\x1a\x1egoogle/protobuf/duration.proto\x1a\x1fgoogle/protobuf/timestamp.proto\"\xf6\x01\n" +
+	"\fWatchRequest\x12\x18\n" +
+	"\amethods\x18\x01 \x03(\tR\amethods\x12C\n" +
+	"\aheaders\x18\x02 \x03(\v2).pancake.tap.v1.WatchRequest.HeadersEntryR\aheaders\x12\x14\n" +
+	"\x05codes\x18\x03 \x03(\rR\x05codes\x125\n" +
+	"\bduration\x18\x04 \x01(\v2\x19.google.protobuf.DurationR\bduration\x1a:\n" +
+	"\fHeadersEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01\"\xa9\x02\n" +
+	"\rWatchResponse\x12\x17\n" +
+	"\acall_id\x18\x01 \x01(\x04R\x06callId\x12.\n" +
+	"\x04time\x18\x02 \x01(\v2\x1a.google.protobuf.TimestampR\x04time\x12\x18\n" +
+	"\adropped\x18\x03 \x01(\x04R\adropped\x127\n" +
+	"\astarted\x18\x04 \x01(\v2\x1b.pancake.tap.v1.CallStartedH\x00R\astarted\x127\n" +
+	"\amessage\x18\x05 \x01(\v2\x1b.pancake.tap.v1.CallMessageH\x00R\amessage\x12:\n" +
+	"\bfinished\x18\x06 \x01(\v2\x1c.pancake.tap.v1.CallFinishedH\x00R\bfinishedB\a\n" +
+	"\x05event\"t\n" +
+	"\vCallStarted\x12\x16\n" +
+	"\x06method\x18\x01 \x01(\tR\x06method\x12\x1a\n" +
+	"\bprotocol\x18\x02 \x01(\tR\bprotocol\x12\x12\n" +
+	"\x04peer\x18\x03 \x01(\tR\x04peer\x12\x1d\n" +
+	"\n" +
+	"user_agent\x18\x04 \x01(\tR\tuserAgent\"O\n" +
+	"\vCallMessage\x12\x18\n" +
+	"\arequest\x18\x01 \x01(\bR\arequest\x12\x12\n" +
+	"\x04json\x18\x02 \x01(\tR\x04json\x12\x12\n" +
+	"\x04size\x18\x03 \x01(\rR\x04size\"\x8d\x01\n" +
+	"\fCallFinished\x12\x1a\n" +
+	"\bupstream\x18\x01 \x01(\tR\bupstream\x12\x16\n" +
+	"\x06client\x18\x02 \x01(\tR\x06client\x12\x12\n" +
+	"\x04code\x18\x03 \x01(\rR\x04code\x125\n" +
+	"\bduration\x18\x04 \x01(\v2\x19.google.protobuf.DurationR\bduration2M\n" +
+	"\x03Tap\x12F\n" +
+	"\x05Watch\x12\x1c.pancake.tap.v1.WatchRequest\x1a\x1d.pancake.tap.v1.WatchResponse0\x01B+Z)github.com/natk64/pancake-proxy/tap/tappbb\x06proto3"
+
+var (
+	file_tap_tappb_tap_proto_rawDescOnce sync.Once
+	file_tap_tappb_tap_proto_rawDescData []byte
+)
+
+func file_tap_tappb_tap_proto_rawDescGZIP() []byte {
+	file_tap_tappb_tap_proto_rawDescOnce.Do(func() {
+		file_tap_tappb_tap_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_tap_tappb_tap_proto_rawDesc), len(file_tap_tappb_tap_proto_rawDesc)))
+	})
+	return file_tap_tappb_tap_proto_rawDescData
+}
+
+var file_tap_tappb_tap_proto_msgTypes = make([]protoimpl.MessageInfo, 6)
+var file_tap_tappb_tap_proto_goTypes = []any{
+	(*WatchRequest)(nil),          // 0: pancake.tap.v1.WatchRequest
+	(*WatchResponse)(nil),         // 1: pancake.tap.v1.WatchResponse
+	(*CallStarted)(nil),           // 2: pancake.tap.v1.CallStarted
+	(*CallMessage)(nil),           // 3: pancake.tap.v1.CallMessage
+	(*CallFinished)(nil),          // 4: pancake.tap.v1.CallFinished
+	nil,                           // 5: pancake.tap.v1.WatchRequest.HeadersEntry
+	(*durationpb.Duration)(nil),   // 6: google.protobuf.Duration
+	(*timestamppb.Timestamp)(nil), // 7: google.protobuf.Timestamp
+}
+var file_tap_tappb_tap_proto_depIdxs = []int32{
+	5, // 0: pancake.tap.v1.WatchRequest.headers:type_name -> pancake.tap.v1.WatchRequest.HeadersEntry
+	6, // 1: pancake.tap.v1.WatchRequest.duration:type_name -> google.protobuf.Duration
+	7, // 2: pancake.tap.v1.WatchResponse.time:type_name -> google.protobuf.Timestamp
+	2, // 3: pancake.tap.v1.WatchResponse.started:type_name -> pancake.tap.v1.CallStarted
+	3, // 4: pancake.tap.v1.WatchResponse.message:type_name -> pancake.tap.v1.CallMessage
+	4, // 5: pancake.tap.v1.WatchResponse.finished:type_name -> pancake.tap.v1.CallFinished
+	6, // 6: pancake.tap.v1.CallFinished.duration:type_name -> google.protobuf.Duration
+	0, // 7: pancake.tap.v1.Tap.Watch:input_type -> pancake.tap.v1.WatchRequest
+	1, // 8: pancake.tap.v1.Tap.Watch:output_type -> pancake.tap.v1.WatchResponse
+	8, // [8:9] is the sub-list for method output_type
+	7, // [7:8] is the sub-list for method input_type
+	7, // [7:7] is the sub-list for extension type_name
+	7, // [7:7] is the sub-list for extension extendee
+	0, // [0:7] is the sub-list for field type_name
+}
+
+func init() { file_tap_tappb_tap_proto_init() }
+func file_tap_tappb_tap_proto_init() {
+	if File_tap_tappb_tap_proto != nil {
+		return
+	}
+	file_tap_tappb_tap_proto_msgTypes[1].OneofWrappers = []any{
+		(*WatchResponse_Started)(nil),
+		(*WatchResponse_Message)(nil),
+		(*WatchResponse_Finished)(nil),
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_tap_tappb_tap_proto_rawDesc), len(file_tap_tappb_tap_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   6,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_tap_tappb_tap_proto_goTypes,
+		DependencyIndexes: file_tap_tappb_tap_proto_depIdxs,
+		MessageInfos:      file_tap_tappb_tap_proto_msgTypes,
+	}.Build()
+	File_tap_tappb_tap_proto = out.File
+	file_tap_tappb_tap_proto_goTypes = nil
+	file_tap_tappb_tap_proto_depIdxs = nil
+}
@@ -0,0 +1,130 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: tap/tappb/tap.proto
+
+package tappb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Tap_Watch_FullMethodName = "/pancake.tap.v1.Tap/Watch"
+)
+
+// TapClient is the client API for Tap service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Tap streams the calls handled by the proxy, for debugging.
+type TapClient interface {
+	// Watch streams the calls matching the request, until the duration passed or the client cancels the call.
+	Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[WatchResponse], error)
+}
+
+type tapClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewTapClient(cc grpc.ClientConnInterface) TapClient {
+	return &tapClient{cc}
+}
+
+func (c *tapClient) Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[WatchResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Tap_ServiceDesc.Streams[0], Tap_Watch_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[WatchRequest, WatchResponse]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Tap_WatchClient = grpc.ServerStreamingClient[WatchResponse]
+
+// TapServer is the server API for Tap service.
+// All implementations must embed UnimplementedTapServer
+// for forward compatibility.
+//
+// Tap streams the calls handled by the proxy, for debugging.
+type TapServer interface {
+	// Watch streams the calls matching the request, until the duration passed or the client cancels the call.
+	Watch(*WatchRequest, grpc.ServerStreamingServer[WatchResponse]) error
+	mustEmbedUnimplementedTapServer()
+}
+
+// UnimplementedTapServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedTapServer struct{}
+
+func (UnimplementedTapServer) Watch(*WatchRequest, grpc.ServerStreamingServer[WatchResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method Watch not implemented")
+}
+func (UnimplementedTapServer) mustEmbedUnimplementedTapServer() {}
+func (UnimplementedTapServer) testEmbeddedByValue()             {}
+
+// UnsafeTapServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to TapServer will
+// result in compilation errors.
+type UnsafeTapServer interface {
+	mustEmbedUnimplementedTapServer()
+}
+
+func RegisterTapServer(s grpc.ServiceRegistrar, srv TapServer) {
+	// If the following call pancis, it indicates UnimplementedTapServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Tap_ServiceDesc, srv)
+}
+
+func _Tap_Watch_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(TapServer).Watch(m, &grpc.GenericServerStream[WatchRequest, WatchResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Tap_WatchServer = grpc.ServerStreamingServer[WatchResponse]
+
+// Tap_ServiceDesc is the grpc.ServiceDesc for Tap service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Tap_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "pancake.tap.v1.Tap",
+	HandlerType: (*TapServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Watch",
+			Handler:       _Tap_Watch_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "tap/tappb/tap.proto",
+}
@@ -0,0 +1,96 @@
+package tracing
+
+import (
+	"context"
+	"encoding/base64"
+
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const binaryHeader = "grpc-trace-bin"
+
+// Field IDs of the binary format.
+const (
+	binaryTraceIDField = 0
+	binarySpanIDField  = 1
+	binaryOptionsField = 2
+)
+
+// BinaryPropagator propagates the trace context in the grpc-trace-bin header, using the binary format of OpenCensus.
+// The header is base64 encoded, like every binary gRPC metadata value.
+type BinaryPropagator struct{}
+
+var _ propagation.TextMapPropagator = BinaryPropagator{}
+
+// Inject implements propagation.TextMapPropagator.
+func (BinaryPropagator) Inject(ctx context.Context, carrier propagation.TextMapCarrier) {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return
+	}
+
+	traceID, spanID := sc.TraceID(), sc.SpanID()
+	data := make([]byte, 0, 29)
+	data = append(data, 0, binaryTraceIDField)
+	data = append(data, traceID[:]...)
+	data = append(data, binarySpanIDField)
+	data = append(data, spanID[:]...)
+	data = append(data, binaryOptionsField, byte(sc.TraceFlags()&trace.FlagsSampled))
+
+	carrier.Set(binaryHeader, base64.StdEncoding.EncodeToString(data))
+}
+
+// Extract implements propagation.TextMapPropagator.
+// It keeps the context unchanged if it already contains a remote span, e.g. from the traceparent header.
+func (BinaryPropagator) Extract(ctx context.Context, carrier propagation.TextMapCarrier) context.Context {
+	if trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx
+	}
+
+	value := carrier.Get(binaryHeader)
+	if value == "" {
+		return ctx
+	}
+
+	data, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		data, err = base64.RawStdEncoding.DecodeString(value)
+	}
+	if err != nil || len(data) == 0 || data[0] != 0 {
+		return ctx
+	}
+
+	var config trace.SpanContextConfig
+	config.Remote = true
+	data = data[1:]
+	for len(data) != 0 {
+		field := data[0]
+		data = data[1:]
+		switch {
+		case field == binaryTraceIDField && len(data) >= 16:
+			copy(config.TraceID[:], data)
+			data = data[16:]
+		case field == binarySpanIDField && len(data) >= 8:
+			copy(config.SpanID[:], data)
+			data = data[8:]
+		case field == binaryOptionsField && len(data) >= 1:
+			config.TraceFlags = trace.TraceFlags(data[0]) & trace.FlagsSampled
+			data = data[1:]
+		default:
+			// Unknown or truncated field, the rest can't be parsed.
+			data = nil
+		}
+	}
+
+	sc := trace.NewSpanContext(config)
+	if !sc.IsValid() {
+		return ctx
+	}
+	return trace.ContextWithRemoteSpanContext(ctx, sc)
+}
+
+// Fields implements propagation.TextMapPropagator.
+func (BinaryPropagator) Fields() []string {
+	return []string{binaryHeader}
+}
@@ -0,0 +1,126 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.34.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// Protocols of the OTLP exporter, see [Config.Protocol].
+const (
+	ProtocolGRPC = "grpc"
+	ProtocolHTTP = "http"
+)
+
+// Config configures [Tracing].
+type Config struct {
+	// Endpoint is the address of the OTLP collector, e.g. localhost:4317.
+	Endpoint string `mapstructure:"endpoint"`
+
+	// Protocol is the OTLP protocol, either 'grpc' or 'http'. The default is 'grpc'.
+	Protocol string `mapstructure:"protocol"`
+
+	// Insecure disables TLS for the collector.
+	Insecure bool `mapstructure:"insecure"`
+
+	// Headers are sent with every export request, e.g. for authentication.
+	Headers map[string]string `mapstructure:"headers"`
+
+	// ServiceName is reported as the service.name resource attribute.
+	ServiceName string `mapstructure:"service_name"`
+
+	// SampleRatio is the fraction of new traces that are sampled, 0 samples none. The default is 1.
+	// Requests that are part of a trace follow the sampling decision of the parent.
+	SampleRatio *float64 `mapstructure:"sample_ratio"`
+
+	Logger *zap.Logger `mapstructure:"-"`
+}
+
+// Tracing creates spans and exports them to an OTLP collector.
+//
+// Tracing must be created using [New].
+type Tracing struct {
+	provider   *sdktrace.TracerProvider
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+}
+
+// New creates the exporter and tracer.
+func New(ctx context.Context, config Config) (*Tracing, error) {
+	if config.Logger == nil {
+		config.Logger = zap.NewNop()
+	}
+	if config.Endpoint == "" {
+		return nil, fmt.Errorf("the endpoint of the collector is required")
+	}
+	if config.ServiceName == "" {
+		config.ServiceName = "pancake"
+	}
+	if config.SampleRatio == nil {
+		sampleRatio := 1.0
+		config.SampleRatio = &sampleRatio
+	}
+	if *config.SampleRatio < 0 || *config.SampleRatio > 1 {
+		return nil, fmt.Errorf("the sample ratio must be between 0 and 1")
+	}
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch config.Protocol {
+	case "", ProtocolGRPC:
+		options := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(config.Endpoint), otlptracegrpc.WithHeaders(config.Headers)}
+		if config.Insecure {
+			options = append(options, otlptracegrpc.WithInsecure())
+		}
+		exporter, err = otlptracegrpc.New(ctx, options...)
+	case ProtocolHTTP:
+		options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(config.Endpoint), otlptracehttp.WithHeaders(config.Headers)}
+		if config.Insecure {
+			options = append(options, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(ctx, options...)
+	default:
+		return nil, fmt.Errorf("unknown OTLP protocol '%s'", config.Protocol)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create exporter, %w", err)
+	}
+
+	res := resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(config.ServiceName))
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(*config.SampleRatio))),
+	)
+
+	config.Logger.Info("Exporting traces", zap.String("endpoint", config.Endpoint), zap.Float64("sample_ratio", *config.SampleRatio))
+	return &Tracing{
+		provider:   provider,
+		tracer:     provider.Tracer("github.com/natk64/pancake-proxy"),
+		propagator: propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, BinaryPropagator{}),
+	}, nil
+}
+
+// Tracer returns the tracer used for the spans of the proxy.
+func (t *Tracing) Tracer() trace.Tracer {
+	return t.tracer
+}
+
+// Propagator returns the propagator that reads and writes the trace context of requests.
+// It supports W3C trace context (traceparent) and the binary grpc-trace-bin format.
+func (t *Tracing) Propagator() propagation.TextMapPropagator {
+	return t.propagator
+}
+
+// Shutdown exports the remaining spans and stops the exporter.
+func (t *Tracing) Shutdown(ctx context.Context) error {
+	return t.provider.Shutdown(ctx)
+}
@@ -0,0 +1,202 @@
+package tracing
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	collectorpb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+// fakeCollector receives the export requests of the OTLP gRPC exporter.
+type fakeCollector struct {
+	collectorpb.UnimplementedTraceServiceServer
+
+	requests chan *collectorpb.ExportTraceServiceRequest
+	headers  chan metadata.MD
+}
+
+func (c *fakeCollector) Export(ctx context.Context, r *collectorpb.ExportTraceServiceRequest) (*collectorpb.ExportTraceServiceResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	c.headers <- md
+	c.requests <- r
+	return &collectorpb.ExportTraceServiceResponse{}, nil
+}
+
+func startCollector(t *testing.T) (*fakeCollector, string) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	collector := &fakeCollector{
+		requests: make(chan *collectorpb.ExportTraceServiceRequest, 10),
+		headers:  make(chan metadata.MD, 10),
+	}
+	server := grpc.NewServer()
+	collectorpb.RegisterTraceServiceServer(server, collector)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	return collector, listener.Addr().String()
+}
+
+// exportedSpans returns the names of the spans in an export request and the service name of their resources.
+func exportedSpans(r *collectorpb.ExportTraceServiceRequest) (string, []string) {
+	var serviceName string
+	var names []string
+	for _, resourceSpans := range r.ResourceSpans {
+		for _, attribute := range resourceSpans.Resource.Attributes {
+			if attribute.Key == "service.name" {
+				serviceName = attribute.Value.GetStringValue()
+			}
+		}
+		for _, scopeSpans := range resourceSpans.ScopeSpans {
+			for _, span := range scopeSpans.Spans {
+				names = append(names, span.Name)
+			}
+		}
+	}
+	return serviceName, names
+}
+
+func TestTracingGRPC(t *testing.T) {
+	collector, address := startCollector(t)
+
+	// Without a sample ratio, every trace is sampled.
+	tracing, err := New(context.Background(), Config{
+		Endpoint: address,
+		Insecure: true,
+		Headers:  map[string]string{"x-token": "secret"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, span := tracing.Tracer().Start(context.Background(), "test.Service/Get")
+	span.End()
+
+	// The spans are batched, shutting down exports them.
+	if err := tracing.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case request := <-collector.requests:
+		serviceName, names := exportedSpans(request)
+		if serviceName != "pancake" {
+			t.Errorf("expected the default service name pancake, got %s", serviceName)
+		}
+		if len(names) != 1 || names[0] != "test.Service/Get" {
+			t.Errorf("expected the span test.Service/Get, got %v", names)
+		}
+	default:
+		t.Fatal("no spans were exported on shutdown")
+	}
+
+	if md := <-collector.headers; strings.Join(md.Get("x-token"), ",") != "secret" {
+		t.Errorf("expected the configured header, got %v", md.Get("x-token"))
+	}
+}
+
+func TestTracingHTTP(t *testing.T) {
+	requests := make(chan *collectorpb.ExportTraceServiceRequest, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" {
+			http.NotFound(w, r)
+			return
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		request := &collectorpb.ExportTraceServiceRequest{}
+		if err := proto.Unmarshal(body, request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		requests <- request
+		w.Header().Set("Content-Type", "application/x-protobuf")
+	}))
+	defer server.Close()
+
+	tracing, err := New(context.Background(), Config{
+		Endpoint:    strings.TrimPrefix(server.URL, "http://"),
+		Protocol:    ProtocolHTTP,
+		Insecure:    true,
+		ServiceName: "gateway",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, span := tracing.Tracer().Start(context.Background(), "test.Service/List")
+	span.End()
+	if err := tracing.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case request := <-requests:
+		serviceName, names := exportedSpans(request)
+		if serviceName != "gateway" {
+			t.Errorf("expected the service name gateway, got %s", serviceName)
+		}
+		if len(names) != 1 || names[0] != "test.Service/List" {
+			t.Errorf("expected the span test.Service/List, got %v", names)
+		}
+	default:
+		t.Fatal("no spans were exported on shutdown")
+	}
+}
+
+func TestTracingSampleRatioZero(t *testing.T) {
+	collector, address := startCollector(t)
+
+	// An explicit ratio of 0 samples no new traces, instead of falling back to the default.
+	sampleRatio := 0.0
+	tracing, err := New(context.Background(), Config{
+		Endpoint:    address,
+		Insecure:    true,
+		SampleRatio: &sampleRatio,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, span := tracing.Tracer().Start(context.Background(), "test.Service/Get")
+	if span.SpanContext().IsSampled() {
+		t.Error("expected the span not to be sampled")
+	}
+	span.End()
+	if err := tracing.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case request := <-collector.requests:
+		_, names := exportedSpans(request)
+		t.Errorf("expected no spans to be exported, got %v", names)
+	default:
+	}
+}
+
+func TestTracingConfig(t *testing.T) {
+	if _, err := New(context.Background(), Config{}); err == nil {
+		t.Error("expected an error without an endpoint")
+	}
+	sampleRatio := 2.0
+	if _, err := New(context.Background(), Config{Endpoint: "localhost:4317", SampleRatio: &sampleRatio}); err == nil {
+		t.Error("expected an error for a sample ratio above 1")
+	}
+	if _, err := New(context.Background(), Config{Endpoint: "localhost:4317", Protocol: "thrift"}); err == nil {
+		t.Error("expected an error for an unknown protocol")
+	}
+}